@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/codegangsta/martini"
+	"github.com/coopernurse/gorp"
+	"github.com/martini-contrib/render"
+	"github.com/martini-contrib/sessions"
+)
+
+// collects what an action sends, to answer a request with rather than write down a websocket
+type recordConn struct {
+	msgs []Message
+}
+
+func (c *recordConn) Send(msg Message) error {
+	c.msgs = append(c.msgs, msg)
+	return nil
+}
+
+// sends what an action sends down the host's connection as usual, and records it to answer a request with too
+type teeConn struct {
+	conn Conn
+	recordConn
+}
+
+func (c *teeConn) Send(msg Message) error {
+	c.recordConn.Send(msg)
+	return c.conn.Send(msg)
+}
+
+// how long a request waits on the host's goroutine before giving up
+const apiTimeout = 5 * time.Second
+
+// A message from a request for the host's goroutine to handle as if the host's browser had sent it. What the action
+// sent comes back on reply, or nil if it failed.
+type hostRequest struct {
+	msg   Message
+	reply chan []Message
+}
+
+// game id -> the requests for the goroutine of the host connected to this server
+var hostRequests = struct {
+	sync.Mutex
+	m map[string]chan hostRequest
+}{m: map[string]chan hostRequest{}}
+
+// takes requests for the game's host, replacing those of an older connection of theirs
+func takeHostRequests(gameId string) chan hostRequest {
+	hostRequests.Lock()
+	defer hostRequests.Unlock()
+	requests := make(chan hostRequest)
+	hostRequests.m[gameId] = requests
+	return requests
+}
+
+// stops taking requests for the game's host, unless a newer connection of theirs has taken them since
+func stopHostRequests(gameId string, requests chan hostRequest) {
+	hostRequests.Lock()
+	defer hostRequests.Unlock()
+	if hostRequests.m[gameId] == requests {
+		delete(hostRequests.m, gameId)
+	}
+}
+
+// the game and player of the session, or nil if there aren't any, in which case the response has been written
+func apiPlayer(r render.Render, params martini.Params, gs GameService, db *gorp.DbMap, session sessions.Session) (*Game, *Player) {
+	playerId := sessionPlayer(r, session)
+	if playerId == 0 {
+		return nil, nil
+	}
+	game, player, err := gs.GetGame(db, params["id"], playerId)
+	if err == errGameEnded {
+		r.JSON(410, Message{"type": "ended", "message": "This game has ended"})
+		return nil, nil
+	}
+	if err != nil {
+		r.JSON(404, Message{"message": "You aren't in this game"})
+		return nil, nil
+	}
+	// players only get a turn when they connect, and rounds can't be played without one for everybody
+	if player.Role != Host {
+		if err = ensureTurn(game.Id, player.Id, db); err != nil {
+			log.Printf("Unable to insert turn row: %#v", err)
+			r.JSON(500, Message{"message": "Failed to join game"})
+			return nil, nil
+		}
+	}
+	return game, player
+}
+
+// the message of the type a request's body makes, or nil if it isn't one, in which case the response has been written
+func apiMessage(r render.Render, req *http.Request, msgType string) Message {
+	msg := Message{}
+	if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+		r.JSON(400, Message{"message": "The body must be a JSON object"})
+		return nil
+	}
+	msg["type"] = msgType
+	return msg
+}
+
+// answers with what an action sent back. An error it sent back is a 409.
+func apiRespond(r render.Render, sent []Message) {
+	for _, msg := range sent {
+		if msg["type"] == "error" {
+			r.JSON(409, msg)
+			return
+		}
+	}
+	r.JSON(200, Message{"messages": sent})
+}
+
+// Hands a message from a request to the actions a websocket message of its type would go to, answering with what
+// they sent back.
+func apiDispatch(r render.Render, req *http.Request, msgType string, handleMap map[string]Action, direction string, game *Game, player *Player, gs GameService, db *gorp.DbMap, log *log.Logger) {
+	msg := apiMessage(r, req, msgType)
+	if msg == nil {
+		return
+	}
+	conn := &recordConn{}
+	_, err := dispatchMessage(handleMap, direction, msg, game.Id, player.Id, gs, conn, db, log)
+	if err != nil {
+		log.Printf("Error while handling %v from the API: %#v", msgType, err)
+		r.JSON(500, Message{"message": "Failed to " + msgType})
+		return
+	}
+	apiRespond(r, conn.msgs)
+}
+
+// Hands a message from a request to the goroutine of the host connected to this server, which handles it as one
+// from the host's browser, so the host's screen gets what it sends and nothing else changes the game underneath it.
+func hostDispatch(r render.Render, req *http.Request, msgType string, game *Game, gs GameService, log *log.Logger) {
+	hostRequests.Lock()
+	requests := hostRequests.m[game.Id]
+	hostRequests.Unlock()
+	if requests == nil {
+		if gs.HostConnected(game.Id) {
+			r.JSON(409, Message{"message": "The host is connected to another server"})
+		} else {
+			r.JSON(409, Message{"message": "The host isn't connected"})
+		}
+		return
+	}
+	msg := apiMessage(r, req, msgType)
+	if msg == nil {
+		return
+	}
+
+	request := hostRequest{msg: msg, reply: make(chan []Message, 1)}
+	select {
+	case requests <- request:
+	case <-time.After(apiTimeout):
+		r.JSON(503, Message{"message": "The host is busy"})
+		return
+	}
+	sent := <-request.reply
+	if sent == nil {
+		log.Printf("Host failed to handle %v from the API", msgType)
+		r.JSON(500, Message{"message": "Failed to " + msgType})
+		return
+	}
+	apiRespond(r, sent)
+}
+
+// The game as the player would see it on connecting, with the cursor to fetch updates after.
+func SnapshotHandler(r render.Render, params martini.Params, gs GameService, db *gorp.DbMap, session sessions.Session, log *log.Logger) {
+	game, player := apiPlayer(r, params, gs, db, session)
+	if game == nil {
+		return
+	}
+	update, err := currentUpdate(game, db)
+	if err != nil {
+		r.JSON(500, Message{"message": "Failed to get board"})
+		return
+	}
+	cursor, err := db.SelectInt("select coalesce(max(id), 0) from events where game=?", game.Id)
+	if err != nil {
+		log.Printf("Failed to get latest event: %v", err)
+		r.JSON(500, Message{"message": "Failed to get snapshot"})
+		return
+	}
+	snapshot := Message{
+		"type":      "snapshot",
+		"game":      game.Id,
+		"game_type": game.Type,
+		"state":     game.State,
+		"rounds":    game.Rounds,
+		"host":      player.Role == Host,
+		"player":    player.Id,
+		"update":    update,
+		"cursor":    cursor,
+	}
+	if gameMode(game) == ClassicMode {
+		seats, err := getSeats(game.Id, db)
+		if err != nil {
+			log.Printf("Unable to get seats for snapshot: %#v", err)
+			r.JSON(500, Message{"message": "Failed to get snapshot"})
+			return
+		}
+		snapshot["seats"] = seats.toMessage()
+	}
+	r.JSON(200, snapshot)
+}
+
+// Makes a move for the player, as if they'd sent a move message.
+func MoveHandler(r render.Render, req *http.Request, params martini.Params, gs GameService, db *gorp.DbMap, session sessions.Session, log *log.Logger) {
+	game, player := apiPlayer(r, params, gs, db, session)
+	if game == nil {
+		return
+	}
+	if player.Role == Host {
+		r.JSON(403, Message{"message": "The host doesn't make moves"})
+		return
+	}
+	// what the action sends the host would wait for them to connect, so there's no playing without them
+	if !gs.HostConnected(game.Id) {
+		r.JSON(409, Message{"message": "The host isn't connected"})
+		return
+	}
+	apiDispatch(r, req, "move", PlayerFromWeb, PlayerFromWebDir, game, player, gs, db, log)
+}
+
+// Starts, pauses or otherwise changes the state of the game for the host, as if they'd sent a state message.
+func StateHandler(r render.Render, req *http.Request, params martini.Params, gs GameService, db *gorp.DbMap, session sessions.Session, log *log.Logger) {
+	game, player := apiPlayer(r, params, gs, db, session)
+	if game == nil {
+		return
+	}
+	if player.Role != Host {
+		r.JSON(403, Message{"message": "Only the host can change the state of the game"})
+		return
+	}
+	hostDispatch(r, req, "state", game, gs, log)
+}
+
+// The updates the game has had since the cursor, and the cursor to ask with next time.
+func UpdatesHandler(r render.Render, req *http.Request, params martini.Params, gs GameService, db *gorp.DbMap, session sessions.Session, log *log.Logger) {
+	game, _ := apiPlayer(r, params, gs, db, session)
+	if game == nil {
+		return
+	}
+	cursor := 0
+	if s := req.URL.Query().Get("cursor"); s != "" {
+		var err error
+		cursor, err = strconv.Atoi(s)
+		if err != nil {
+			r.JSON(400, Message{"message": "`cursor` must be the cursor of a snapshot or the last updates"})
+			return
+		}
+	}
+
+	events, err := getEvents(db, game.Id, MessageEvent, HostToWebDir, "update", cursor)
+	if err != nil {
+		r.JSON(500, Message{"message": "Failed to get updates"})
+		return
+	}
+	updates := []json.RawMessage{}
+	for _, e := range events {
+		updates = append(updates, json.RawMessage(e.Payload))
+		cursor = e.Id
+	}
+	r.JSON(200, Message{"updates": updates, "cursor": cursor})
+}
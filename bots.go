@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/coopernurse/gorp"
+)
+
+// how long a bot pretends to think before each message it sends, unless the host asks for something else
+const defaultThinkTime = time.Second
+
+// A Bot plays a game in place of a phone. It is given every message a phone would be sent (through the
+// PlayerFromHost actions) and returns the messages the phone would send back, which go through the PlayerFromWeb
+// actions just like a phone's. Receive is never called concurrently.
+type Bot interface {
+	Receive(msg Message) []Message
+}
+
+// Makes a bot to play as the given player.
+type BotFactory func(player *Player, db *gorp.DbMap) Bot
+
+// game type -> kind of bot -> factory
+var botFactories = map[string]map[string]BotFactory{}
+
+// Makes a kind of bot available to hosts of a type of game. Call this from init.
+func RegisterBot(gameType, kind string, factory BotFactory) {
+	if botFactories[gameType] == nil {
+		botFactories[gameType] = map[string]BotFactory{}
+	}
+	botFactories[gameType][kind] = factory
+}
+
+// the kinds of bots a type of game has, for telling the host what it can choose from
+func botKinds(gameType string) []string {
+	kinds := []string{}
+	for kind := range botFactories[gameType] {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// botConn is the bot's end of the game. Whatever the actions send to it the bot receives, and the bot's replies
+// are queued up to be sent after it has thought about them.
+type botConn struct {
+	sync.Mutex
+	bot     Bot
+	replies chan Message
+	closed  bool
+}
+
+func (c *botConn) Send(msg Message) error {
+	c.Lock()
+	defer c.Unlock()
+	if c.closed {
+		return nil
+	}
+	for _, reply := range c.bot.Receive(msg) {
+		select {
+		case c.replies <- reply:
+		default:
+			log.Printf("Bot is too far behind, dropping %v message", reply["type"])
+		}
+	}
+	return nil
+}
+
+// stops queueing replies, once nothing more will be sent
+func (c *botConn) close() {
+	c.Lock()
+	defer c.Unlock()
+	c.closed = true
+	close(c.replies)
+}
+
+// A bot that has been attached to a game.
+type botRunner struct {
+	player *Player
+	gameId string
+	think  time.Duration
+	conn   *botConn
+	stop   chan bool
+}
+
+// bot player id -> the bot playing as them
+var runningBots = struct {
+	sync.Mutex
+	m map[int]*botRunner
+}{m: map[int]*botRunner{}}
+
+// Attaches a new bot of the given kind to a game. The bot gets its own player and joins the game like a phone
+// would, so it can be attached at any point in the game.
+func attachBot(game *Game, kind string, think time.Duration, gs GameService, db *gorp.DbMap, log *log.Logger) (*Player, error) {
+	factory, ok := botFactories[game.Type][kind]
+	if !ok {
+		return nil, fmt.Errorf("%v has no %v bot", game.Type, kind)
+	}
+
+	player := &Player{
+		Game: game.Id,
+		Name: fmt.Sprintf("Bot (%v)", kind),
+		Bot:  kind,
+	}
+	err := db.Insert(player)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &botRunner{
+		player: player,
+		gameId: game.Id,
+		think:  think,
+		conn:   &botConn{bot: factory(player, db), replies: make(chan Message, 16)},
+		stop:   make(chan bool),
+	}
+	runningBots.Lock()
+	runningBots.m[player.Id] = r
+	runningBots.Unlock()
+
+	// join before returning so the bot is in the player list straight away
+	read := gs.PlayerJoin(game.Id, player.Id)
+	go r.run(read, gs, db, log)
+	go r.reply(gs, db, log)
+	log.Printf("Attached %v bot %v to game %v", kind, player.Id, game.Id)
+	return player, nil
+}
+
+// Tells a bot to leave its game. Returns false if there is no such bot in the game.
+func detachBot(gameId string, playerId int) bool {
+	runningBots.Lock()
+	defer runningBots.Unlock()
+	r, ok := runningBots.m[playerId]
+	if !ok || r.gameId != gameId {
+		return false
+	}
+	delete(runningBots.m, playerId)
+	close(r.stop)
+	return true
+}
+
+// Does what WebsocketHandler does for a phone: runs the bot's messages from the host until it is told to stop.
+// This runs in its own goroutine since the host's goroutine is the one that attached it.
+func (r *botRunner) run(read chan Message, gs GameService, db *gorp.DbMap, log *log.Logger) {
+	defer r.conn.close()
+	defer r.leave(read, gs, db, log)
+
+	err := PlayerInit(r.player.Id, r.gameId, gs, r.conn, db)
+	if err != nil {
+		log.Printf("Bot %v failed to join: %#v", r.player.Id, err)
+		return
+	}
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case msg, ok := <-read:
+			if !ok {
+				return
+			}
+			handled, err := dispatchMessage(PlayerFromHost, PlayerFromHostDir, msg, r.gameId, r.player.Id, gs, r.conn, db, log)
+			if err != nil {
+				log.Printf("Error while handling message from host to bot: %#v", err)
+				return
+			}
+			if !handled {
+				log.Printf("Unknown message from host to bot: %#v", msg)
+			}
+		}
+	}
+}
+
+// Sends the bot's replies one at a time, after thinking about each. This is separate from run so the bot keeps
+// taking messages from the host while it thinks.
+func (r *botRunner) reply(gs GameService, db *gorp.DbMap, log *log.Logger) {
+	for msg := range r.conn.replies {
+		select {
+		case <-r.stop:
+			continue // drain what's left without sending it
+		case <-time.After(r.think):
+		}
+		handled, err := dispatchMessage(PlayerFromWeb, PlayerFromWebDir, msg, r.gameId, r.player.Id, gs, r.conn, db, log)
+		if err != nil {
+			log.Printf("Error while handling message from bot: %#v", err)
+		} else if !handled {
+			log.Printf("Unknown message from bot: %#v", msg)
+		}
+	}
+}
+
+// leaves the game like a phone disconnecting, and takes the bot's player out of the game so the rounds don't
+// wait on it
+func (r *botRunner) leave(read chan Message, gs GameService, db *gorp.DbMap, log *log.Logger) {
+	gs.PlayerLeave(r.gameId, r.player.Id, read)
+
+	runningBots.Lock()
+	delete(runningBots.m, r.player.Id)
+	runningBots.Unlock()
+
+	// out of the game before the host hears it left, so it gives up its seat rather than keeping it to come back to
+	r.player.Game = ""
+	_, err := db.Update(r.player)
+	if err != nil {
+		log.Printf("Unable to take bot %v out of game: %#v", r.player.Id, err)
+	}
+	PlayerLeave(r.player.Id, r.gameId, gs, r.conn, db)
+	log.Printf("Bot %v left game %v", r.player.Id, r.gameId)
+}
+
+// the host attaches a bot, optionally with how many milliseconds it should think before each move
+func hostAddBot(msg Message, gameId string, playerId int, gs GameService, conn Conn, db *gorp.DbMap, log *log.Logger) error {
+	game, _, err := gs.GetGame(db, gameId, playerId)
+	if err != nil {
+		log.Printf("Couldn't get game to add bot: %#v", err)
+		return err
+	}
+	kind, _ := msg["bot"].(string)
+	if _, ok := botFactories[game.Type][kind]; !ok {
+		conn.Send(Message{"type": "error", "message": "`bot` must be one of the game's bots", "bots": botKinds(game.Type)})
+		return nil
+	}
+	think := defaultThinkTime
+	if ms, ok := msg["think"].(float64); ok && ms >= 0 {
+		think = time.Duration(ms) * time.Millisecond
+	}
+
+	_, err = attachBot(game, kind, think, gs, db, log)
+	if err != nil {
+		log.Printf("Unable to attach bot: %#v", err)
+		return err
+	}
+	return nil
+}
+
+// the host removes a bot from the game
+func hostRemoveBot(msg Message, gameId string, playerId int, gs GameService, conn Conn, db *gorp.DbMap, log *log.Logger) error {
+	pid, ok := msg["player"].(float64)
+	if !ok || !detachBot(gameId, int(pid)) {
+		conn.Send(Message{"type": "error", "message": "That bot isn't in this game"})
+	}
+	return nil
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The broker passes messages between game servers so a host on one server can play with phones connected to
+// another. It speaks JSON over TCP, one frame per line:
+//
+//	{"op":"sub","id":1,"topic":"game/abc/host"}    start receiving messages published to a topic
+//	{"op":"unsub","id":2,"topic":"game/abc/host"}  stop receiving them
+//	{"op":"pub","topic":"game/abc/host","msg":{}}  send a message to everyone subscribed to a topic
+//	{"op":"list","id":3,"prefix":"game/abc/"}      ask which topics under a prefix have subscribers
+//
+// The broker sends back {"op":"msg","topic":...,"msg":...} for every message published to a subscribed topic,
+// {"op":"ok","id":1} once a sub or unsub with an id has taken effect, and {"op":"list","id":3,"topics":[...]} in
+// answer to a list. The broker keeps nothing, so a message published to a topic nobody is subscribed to is dropped.
+type brokerFrame struct {
+	Op     string   `json:"op"`
+	Id     int      `json:"id,omitempty"`
+	Topic  string   `json:"topic,omitempty"`
+	Prefix string   `json:"prefix,omitempty"`
+	Msg    Message  `json:"msg,omitempty"`
+	Topics []string `json:"topics,omitempty"`
+}
+
+// how long to wait for the broker to answer a request before giving up on it
+const brokerTimeout = 5 * time.Second
+
+// how many messages can be waiting for a player or host before more are dropped, whichever fabric they're on
+const brokerQueue = 256
+
+// Broker is the server side of the protocol. Run one somewhere every game server can reach, for example with
+// -serve-broker, and point the game servers at it with -broker.
+type Broker struct {
+	sync.Mutex
+	subs map[string]map[*brokerConn]bool // topic -> connections subscribed to it
+}
+
+func NewBroker() *Broker {
+	return &Broker{subs: map[string]map[*brokerConn]bool{}}
+}
+
+// a game server connected to the broker
+type brokerConn struct {
+	sync.Mutex
+	conn   net.Conn
+	enc    *json.Encoder
+	topics map[string]bool
+}
+
+func (c *brokerConn) send(frame brokerFrame) error {
+	c.Lock()
+	defer c.Unlock()
+	return c.enc.Encode(frame)
+}
+
+// Serve accepts game servers until the listener is closed.
+func (b *Broker) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go b.handle(conn)
+	}
+}
+
+func (b *Broker) handle(conn net.Conn) {
+	c := &brokerConn{conn: conn, enc: json.NewEncoder(conn), topics: map[string]bool{}}
+	defer b.drop(c)
+
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	for {
+		var frame brokerFrame
+		err := dec.Decode(&frame)
+		if err != nil {
+			log.Printf("Broker connection from %v closed: %v", conn.RemoteAddr(), err)
+			return
+		}
+
+		switch frame.Op {
+		case "sub":
+			b.Lock()
+			if b.subs[frame.Topic] == nil {
+				b.subs[frame.Topic] = map[*brokerConn]bool{}
+			}
+			b.subs[frame.Topic][c] = true
+			c.topics[frame.Topic] = true
+			b.Unlock()
+			if frame.Id != 0 {
+				c.send(brokerFrame{Op: "ok", Id: frame.Id})
+			}
+		case "unsub":
+			b.Lock()
+			b.unsubscribe(c, frame.Topic)
+			b.Unlock()
+			if frame.Id != 0 {
+				c.send(brokerFrame{Op: "ok", Id: frame.Id})
+			}
+		case "pub":
+			b.Lock()
+			conns := []*brokerConn{}
+			for sub := range b.subs[frame.Topic] {
+				conns = append(conns, sub)
+			}
+			b.Unlock()
+			for _, sub := range conns {
+				err = sub.send(brokerFrame{Op: "msg", Topic: frame.Topic, Msg: frame.Msg})
+				if err != nil {
+					log.Printf("Broker couldn't deliver to %v: %v", sub.conn.RemoteAddr(), err)
+				}
+			}
+		case "list":
+			topics := []string{}
+			b.Lock()
+			for topic, conns := range b.subs {
+				if strings.HasPrefix(topic, frame.Prefix) && len(conns) > 0 {
+					topics = append(topics, topic)
+				}
+			}
+			b.Unlock()
+			c.send(brokerFrame{Op: "list", Id: frame.Id, Topics: topics})
+		default:
+			log.Printf("Broker got unknown op %#v", frame.Op)
+		}
+	}
+}
+
+// must be called with the broker locked
+func (b *Broker) unsubscribe(c *brokerConn, topic string) {
+	delete(b.subs[topic], c)
+	if len(b.subs[topic]) == 0 {
+		delete(b.subs, topic)
+	}
+	delete(c.topics, topic)
+}
+
+// forgets everything a game server subscribed to once it disconnects, which is how its players leave other
+// servers' player lists if it dies
+func (b *Broker) drop(c *brokerConn) {
+	b.Lock()
+	defer b.Unlock()
+	for topic := range c.topics {
+		b.unsubscribe(c, topic)
+	}
+	c.conn.Close()
+}
+
+func hostTopic(gameId string) string {
+	return "game/" + gameId + "/host"
+}
+
+func playerTopic(gameId string, playerId int) string {
+	return "game/" + gameId + "/player/" + strconv.Itoa(playerId)
+}
+
+// every server with players in the game subscribes to this once, and hands broadcasts out to its own players
+func broadcastTopic(gameId string) string {
+	return "game/" + gameId + "/players"
+}
+
+// a local host or player's channel. Messages wait in the queue so one slow reader can't hold up the connection to
+// the broker, and the channel is only ever closed by the goroutine sending on it.
+type subscription struct {
+	ch    chan Message
+	queue chan Message
+	done  chan bool
+}
+
+func newSubscription() *subscription {
+	s := &subscription{
+		ch:    make(chan Message),
+		queue: make(chan Message, brokerQueue),
+		done:  make(chan bool),
+	}
+	go s.run()
+	return s
+}
+
+func (s *subscription) run() {
+	defer close(s.ch)
+	for {
+		select {
+		case msg := <-s.queue:
+			select {
+			case s.ch <- msg:
+			case <-s.done:
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *subscription) deliver(msg Message) {
+	select {
+	case s.queue <- msg:
+	default:
+		log.Printf("Subscriber is too far behind, dropping %v message", msg["type"])
+	}
+}
+
+// BrokerFabric sends every message through a broker so games can be shared with other servers connected to it.
+// Joining and leaving wait for the broker, so every server agrees on who is connected once they return. Messages are
+// JSON on the way through, so numbers come out the other side as float64 like they do from a browser.
+type BrokerFabric struct {
+	sync.Mutex
+	joins     sync.Mutex // held through each join and leave so the broker sees them in the order they happened
+	writes    sync.Mutex // separate so the reader never waits on a write stuck behind a busy broker
+	conn      net.Conn
+	enc       *json.Encoder
+	hosts     map[string]*subscription
+	hostConns map[string]int // the host's subscription is shared by each of their connections here
+	players   map[string]map[int]*subscription
+	pending   map[int]chan brokerFrame // request id -> where the answer goes
+	nextId    int
+	closed    bool
+}
+
+func NewBrokerFabric(addr string) (*BrokerFabric, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	f := &BrokerFabric{
+		conn:      conn,
+		enc:       json.NewEncoder(conn),
+		hosts:     map[string]*subscription{},
+		hostConns: map[string]int{},
+		players:   map[string]map[int]*subscription{},
+		pending:   map[int]chan brokerFrame{},
+	}
+	go f.read()
+	return f, nil
+}
+
+func (f *BrokerFabric) send(frame brokerFrame) {
+	f.Lock()
+	closed := f.closed
+	f.Unlock()
+	if closed {
+		return
+	}
+
+	f.writes.Lock()
+	defer f.writes.Unlock()
+	err := f.enc.Encode(frame)
+	if err != nil {
+		log.Printf("Couldn't send %v to broker: %v", frame.Op, err)
+	}
+}
+
+// sends a frame and waits for the broker to answer it
+func (f *BrokerFabric) request(frame brokerFrame) (brokerFrame, bool) {
+	f.Lock()
+	if f.closed {
+		f.Unlock()
+		return brokerFrame{}, false
+	}
+	f.nextId++
+	frame.Id = f.nextId
+	answer := make(chan brokerFrame, 1)
+	f.pending[frame.Id] = answer
+	f.Unlock()
+	f.send(frame)
+
+	select {
+	case reply, ok := <-answer:
+		return reply, ok
+	case <-time.After(brokerTimeout):
+		log.Printf("Broker didn't answer %v %v", frame.Op, frame.Topic+frame.Prefix)
+		f.Lock()
+		delete(f.pending, frame.Id)
+		f.Unlock()
+		return brokerFrame{}, false
+	}
+}
+
+func (f *BrokerFabric) read() {
+	dec := json.NewDecoder(bufio.NewReader(f.conn))
+	for {
+		var frame brokerFrame
+		err := dec.Decode(&frame)
+		if err != nil {
+			log.Printf("Lost connection to broker: %v", err)
+			f.Close()
+			return
+		}
+
+		f.Lock()
+		switch frame.Op {
+		case "msg":
+			f.route(frame.Topic, frame.Msg)
+		case "ok", "list":
+			if answer, ok := f.pending[frame.Id]; ok {
+				delete(f.pending, frame.Id)
+				answer <- frame
+			}
+		}
+		f.Unlock()
+	}
+}
+
+// hands a message from the broker to whoever is subscribed to its topic here, must be called with the fabric locked
+func (f *BrokerFabric) route(topic string, msg Message) {
+	parts := strings.Split(topic, "/")
+	if len(parts) < 3 || parts[0] != "game" {
+		log.Printf("Message from broker for unknown topic %v", topic)
+		return
+	}
+	gameId := parts[1]
+	switch {
+	case len(parts) == 3 && parts[2] == "host":
+		if host, ok := f.hosts[gameId]; ok {
+			host.deliver(msg)
+		}
+	case len(parts) == 3 && parts[2] == "players":
+		for _, p := range f.players[gameId] {
+			p.deliver(msg)
+		}
+	case len(parts) == 4 && parts[2] == "player":
+		pid, _ := strconv.Atoi(parts[3])
+		if p, ok := f.players[gameId][pid]; ok {
+			p.deliver(msg)
+		}
+	}
+}
+
+// Close disconnects from the broker and closes every host and player channel, as if they had all left.
+func (f *BrokerFabric) Close() {
+	f.Lock()
+	defer f.Unlock()
+	if f.closed {
+		return
+	}
+	f.closed = true
+	f.conn.Close()
+	for gameId, host := range f.hosts {
+		close(host.done)
+		delete(f.hosts, gameId)
+		delete(f.hostConns, gameId)
+	}
+	for gameId, players := range f.players {
+		for _, p := range players {
+			close(p.done)
+		}
+		delete(f.players, gameId)
+	}
+	for id, answer := range f.pending {
+		close(answer)
+		delete(f.pending, id)
+	}
+}
+
+func (f *BrokerFabric) HostJoin(gameId string) chan Message {
+	f.joins.Lock()
+	defer f.joins.Unlock()
+
+	f.Lock()
+	host, ok := f.hosts[gameId]
+	if !ok {
+		log.Printf("Host connecting to game %v for first time", gameId)
+		host = newSubscription()
+		f.hosts[gameId] = host
+	}
+	f.hostConns[gameId]++
+	f.Unlock()
+
+	if !ok {
+		f.request(brokerFrame{Op: "sub", Topic: hostTopic(gameId)})
+	}
+	return host.ch
+}
+
+func (f *BrokerFabric) HostLeave(gameId string) {
+	f.joins.Lock()
+	defer f.joins.Unlock()
+
+	f.Lock()
+	host, ok := f.hosts[gameId]
+	if ok {
+		// only the host's last connection here gives up the subscription
+		f.hostConns[gameId]--
+		ok = f.hostConns[gameId] <= 0
+	}
+	if ok {
+		close(host.done)
+		delete(f.hosts, gameId)
+		delete(f.hostConns, gameId)
+	}
+	f.Unlock()
+
+	if ok {
+		f.request(brokerFrame{Op: "unsub", Topic: hostTopic(gameId)})
+	}
+}
+
+// asks the broker whether the host is connected to any server
+func (f *BrokerFabric) HostConnected(gameId string) bool {
+	reply, _ := f.request(brokerFrame{Op: "list", Prefix: hostTopic(gameId)})
+	return len(reply.Topics) > 0
+}
+
+func (f *BrokerFabric) PlayerJoin(gameId string, playerId int) chan Message {
+	f.joins.Lock()
+	defer f.joins.Unlock()
+
+	f.Lock()
+	first := f.players[gameId] == nil
+	if first {
+		f.players[gameId] = map[int]*subscription{}
+	}
+	if old, ok := f.players[gameId][playerId]; ok {
+		close(old.done)
+	}
+	p := newSubscription()
+	f.players[gameId][playerId] = p
+	f.Unlock()
+
+	if first {
+		f.request(brokerFrame{Op: "sub", Topic: broadcastTopic(gameId)})
+	}
+	f.request(brokerFrame{Op: "sub", Topic: playerTopic(gameId, playerId)})
+	return p.ch
+}
+
+func (f *BrokerFabric) PlayerLeave(gameId string, playerId int, ch chan Message) bool {
+	f.joins.Lock()
+	defer f.joins.Unlock()
+
+	f.Lock()
+	// the old connection of a player who has reconnected was closed when they did
+	p, ok := f.players[gameId][playerId]
+	if !ok || p.ch != ch {
+		f.Unlock()
+		return false
+	}
+	close(p.done)
+	delete(f.players[gameId], playerId)
+	last := len(f.players[gameId]) == 0
+	if last {
+		delete(f.players, gameId)
+	}
+	f.Unlock()
+
+	f.request(brokerFrame{Op: "unsub", Topic: playerTopic(gameId, playerId)})
+	if last {
+		f.request(brokerFrame{Op: "unsub", Topic: broadcastTopic(gameId)})
+	}
+	return true
+}
+
+func (f *BrokerFabric) Broadcast(gameId string, msg Message) {
+	f.send(brokerFrame{Op: "pub", Topic: broadcastTopic(gameId), Msg: msg})
+}
+
+func (f *BrokerFabric) SendHost(gameId string, msg Message) {
+	f.send(brokerFrame{Op: "pub", Topic: hostTopic(gameId), Msg: msg})
+}
+
+func (f *BrokerFabric) SendPlayer(gameId string, playerId int, msg Message) {
+	f.send(brokerFrame{Op: "pub", Topic: playerTopic(gameId, playerId), Msg: msg})
+}
+
+// asks the broker which players are subscribed on any server, not just this one
+func (f *BrokerFabric) GetConnectedPlayers(gameId string) []int {
+	prefix := "game/" + gameId + "/player/"
+	reply, _ := f.request(brokerFrame{Op: "list", Prefix: prefix})
+
+	players := []int{}
+	for _, topic := range reply.Topics {
+		pid, err := strconv.Atoi(strings.TrimPrefix(topic, prefix))
+		if err == nil {
+			players = append(players, pid)
+		}
+	}
+	return players
+}
+
+// the broker forgets topics once nobody is subscribed, so there is nothing to free unless someone is still connected
+func (f *BrokerFabric) Forget(gameId string) bool {
+	reply, ok := f.request(brokerFrame{Op: "list", Prefix: "game/" + gameId + "/"})
+	return ok && len(reply.Topics) == 0
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// starts a broker on loopback standing in for the real one, with two servers connected to it
+func startBroker(t *testing.T) (net.Listener, *BrokerFabric, *BrokerFabric) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go NewBroker().Serve(l)
+
+	a, err := NewBrokerFabric(l.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect to broker: %v", err)
+	}
+	b, err := NewBrokerFabric(l.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect to broker: %v", err)
+	}
+	return l, a, b
+}
+
+func receive(t *testing.T, ch chan Message) Message {
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(awaitTimeout):
+		t.Fatalf("Nothing came through the broker")
+	}
+	return nil
+}
+
+func Test_Broker(t *testing.T) {
+	l, a, b := startBroker(t)
+	defer l.Close()
+	defer a.Close()
+	defer b.Close()
+
+	// the host is on one server and the player on the other
+	hostRead := a.HostJoin("game")
+	playerRead := b.PlayerJoin("game", 7)
+
+	players := a.GetConnectedPlayers("game")
+	if len(players) != 1 || players[0] != 7 {
+		t.Errorf("Host's server should see the other server's player, got %v", players)
+	}
+
+	b.SendHost("game", Message{"type": "move", "move": 4})
+	msg := receive(t, hostRead)
+	if msg["type"] != "move" || msg["move"] != float64(4) {
+		t.Errorf("Couldn't send from player to host: %#v", msg)
+	}
+
+	a.Broadcast("game", Message{"type": "update"})
+	msg = receive(t, playerRead)
+	if msg["type"] != "update" {
+		t.Errorf("Couldn't send from host to player: %#v", msg)
+	}
+
+	a.SendPlayer("game", 7, Message{"type": "collision"})
+	msg = receive(t, playerRead)
+	if msg["type"] != "collision" {
+		t.Errorf("Couldn't send from host to just the one player: %#v", msg)
+	}
+
+	b.PlayerLeave("game", 7, playerRead)
+	if _, ok := <-playerRead; ok {
+		t.Errorf("Player's channel should close when they leave")
+	}
+	if players = a.GetConnectedPlayers("game"); len(players) != 0 {
+		t.Errorf("Player who left is still connected: %v", players)
+	}
+}
+
+// the old connections of a host and player who have reconnected leaving doesn't disconnect the new ones
+func Test_Broker_Reconnect(t *testing.T) {
+	l, a, b := startBroker(t)
+	defer l.Close()
+	defer a.Close()
+	defer b.Close()
+
+	a.HostJoin("game")
+	hostRead := a.HostJoin("game")
+	a.HostLeave("game")
+	if !b.HostConnected("game") {
+		t.Errorf("Host's old connection leaving disconnected the new one")
+	}
+
+	old := b.PlayerJoin("game", 7)
+	current := b.PlayerJoin("game", 7)
+	if b.PlayerLeave("game", 7, old) {
+		t.Errorf("Old connection leaving should say the player is still here")
+	}
+
+	a.Broadcast("game", Message{"type": "update"})
+	if msg := receive(t, current); msg["type"] != "update" {
+		t.Errorf("Reconnected player got %#v", msg)
+	}
+	b.SendHost("game", Message{"type": "move"})
+	if msg := receive(t, hostRead); msg["type"] != "move" {
+		t.Errorf("Reconnected host got %#v", msg)
+	}
+	if players := a.GetConnectedPlayers("game"); len(players) != 1 {
+		t.Errorf("Expected the reconnected player, got %v", players)
+	}
+}
+
+func Test_Broker_Disconnect(t *testing.T) {
+	l, a, b := startBroker(t)
+	defer l.Close()
+	defer a.Close()
+
+	a.HostJoin("game")
+	b.PlayerJoin("game", 1)
+	if players := a.GetConnectedPlayers("game"); len(players) != 1 {
+		t.Fatalf("Expected one player, got %v", players)
+	}
+
+	// a server going away takes its players with it
+	b.Close()
+	deadline := time.Now().Add(awaitTimeout)
+	for len(a.GetConnectedPlayers("game")) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Players of a server that went away are still connected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// a game made on one server is played by phones on another, sharing the database and the broker
+func Test_Broker_TwoServers(t *testing.T) {
+	l, fa, fb := startBroker(t)
+	defer l.Close()
+	defer fa.Close()
+	defer fb.Close()
+	dir, err := ioutil.TempDir("", "game-server")
+	if err != nil {
+		t.Fatalf("Failed to make temp dir: %v", err)
+	}
+	a, b := startServerWith(t, dir, fa), startServerWith(t, dir, fb)
+	defer a.stop()
+	defer b.stop()
+
+	g := a.newGame("tictactoe", 1)
+	defer g.close()
+	p := b.newClient()
+	p.join(g.id)
+	p.await("update", inState("lobby"))
+	g.players = append(g.players, p)
+	g.host.await("players", playerCount(2))
+	g.start()
+
+	g.players[0].send(Message{"type": "move", "move": 0})
+	p.send(Message{"type": "move", "move": 4})
+	both := func(msg Message) bool {
+		board, _ := toInts(msg["board"])
+		return len(board) == 9 && board[0] != 0 && board[4] != 0
+	}
+	g.host.await("update", both)
+	p.await("update", both)
+}
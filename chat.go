@@ -0,0 +1,322 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/coopernurse/gorp"
+)
+
+// the period a game's rate limit counts messages over
+const chatWindow = 10 * time.Second
+
+// the reactions phones can send, anything else is turned away
+var chatReactions = []string{"👍", "👎", "😂", "😮", "😢", "😡", "🎉", "❤️"}
+
+// How a game's chat is set up, changed by the host. Games without a row use defaultChatSettings.
+type ChatSettings struct {
+	Game      string
+	Enabled   bool
+	MaxLength int    // longest message in characters
+	RateLimit int    // most messages and reactions a player can send each chatWindow
+	Phones    bool   // whether the phones see the chat too, or just the TV
+	Muted     string // JSON list of muted player ids
+}
+
+func defaultChatSettings(gameId string) *ChatSettings {
+	return &ChatSettings{Game: gameId, Enabled: true, MaxLength: 140, RateLimit: 5, Muted: "[]"}
+}
+
+func (c ChatSettings) getMuted() ([]int, error) {
+	muted := []int{}
+	err := json.Unmarshal([]byte(c.Muted), &muted)
+	return muted, err
+}
+
+func (c *ChatSettings) setMuted(v []int) error {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	c.Muted = string(bytes)
+	return nil
+}
+
+func (c ChatSettings) isMuted(playerId int) bool {
+	muted, _ := c.getMuted()
+	for _, pid := range muted {
+		if pid == playerId {
+			return true
+		}
+	}
+	return false
+}
+
+// what the phones and TV are told about the settings
+func (c ChatSettings) toMessage() Message {
+	return Message{
+		"type":       "chat_settings",
+		"enabled":    c.Enabled,
+		"max_length": c.MaxLength,
+		"rate_limit": c.RateLimit,
+		"phones":     c.Phones,
+		"reactions":  chatReactions,
+	}
+}
+
+func getChatSettings(gameId string, db *gorp.DbMap) (*ChatSettings, error) {
+	settings := &ChatSettings{}
+	err := db.SelectOne(settings, "select * from chat_settings where Game=?", gameId)
+	if err == sql.ErrNoRows {
+		return defaultChatSettings(gameId), nil
+	}
+	return settings, err
+}
+
+func saveChatSettings(settings *ChatSettings, db *gorp.DbMap) error {
+	count, err := db.Update(settings)
+	if err == nil && count == 0 {
+		err = db.Insert(settings)
+	}
+	return err
+}
+
+// A ChatFilter looks at what a player wants to say and returns what should be shown instead, for example with rude
+// words starred out, or false to drop the message altogether.
+type ChatFilter func(gameId string, playerId int, text string) (string, bool)
+
+var chatFilters []ChatFilter
+
+// Runs every chat message through a filter, after any registered before it. Call this from init.
+func RegisterChatFilter(filter ChatFilter) {
+	chatFilters = append(chatFilters, filter)
+}
+
+// Makes a filter that stars out the given words wherever they appear, in any case.
+func BlockWords(words ...string) ChatFilter {
+	quoted := []string{}
+	for _, w := range words {
+		quoted = append(quoted, regexp.QuoteMeta(w))
+	}
+	re := regexp.MustCompile(`(?i)` + strings.Join(quoted, "|"))
+	return func(gameId string, playerId int, text string) (string, bool) {
+		return re.ReplaceAllStringFunc(text, func(w string) string {
+			return strings.Repeat("*", utf8.RuneCountInString(w))
+		}), true
+	}
+}
+
+// player id -> when they last sent chat, for the rate limit
+var chatTimes = struct {
+	sync.Mutex
+	m map[int][]time.Time
+}{m: map[int][]time.Time{}}
+
+// records a message from the player if they are under the limit, otherwise returns false
+func chatAllowed(playerId int, limit int, now time.Time) bool {
+	chatTimes.Lock()
+	defer chatTimes.Unlock()
+
+	recent := []time.Time{}
+	for _, t := range chatTimes.m[playerId] {
+		if now.Sub(t) < chatWindow {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= limit {
+		chatTimes.m[playerId] = recent
+		return false
+	}
+	chatTimes.m[playerId] = append(recent, now)
+	return true
+}
+
+// forgets when a player last sent chat, once they've left or their game is gone
+func forgetChat(playerId int) {
+	chatTimes.Lock()
+	defer chatTimes.Unlock()
+	delete(chatTimes.m, playerId)
+}
+
+// checks the player may chat at all right now, telling them why not if they can't
+func canChat(gameId string, playerId int, conn Conn, db *gorp.DbMap) (*ChatSettings, bool, error) {
+	settings, err := getChatSettings(gameId, db)
+	if err != nil {
+		return nil, false, err
+	}
+	switch {
+	case !settings.Enabled:
+		conn.Send(Message{"type": "error", "message": "Chat is turned off for this game"})
+	case settings.isMuted(playerId):
+		conn.Send(Message{"type": "error", "message": "You've been muted"})
+	case !chatAllowed(playerId, settings.RateLimit, time.Now()):
+		conn.Send(Message{"type": "error", "message": "Slow down, you're chatting too fast"})
+	default:
+		return settings, true, nil
+	}
+	return settings, false, nil
+}
+
+// the player says something, which goes to the host to show once it has passed the limits and filters
+func playerChat(msg Message, gameId string, playerId int, gs GameService, conn Conn, db *gorp.DbMap, log *log.Logger) error {
+	text, _ := msg["text"].(string)
+	text = strings.TrimSpace(text)
+	if text == "" {
+		conn.Send(Message{"type": "error", "message": "Provide some `text` to say"})
+		return nil
+	}
+	settings, ok, err := canChat(gameId, playerId, conn, db)
+	if err != nil || !ok {
+		return err
+	}
+	if utf8.RuneCountInString(text) > settings.MaxLength {
+		conn.Send(Message{"type": "error", "message": "That message is too long", "max_length": settings.MaxLength})
+		return nil
+	}
+	for _, filter := range chatFilters {
+		text, ok = filter(gameId, playerId, text)
+		if !ok {
+			conn.Send(Message{"type": "error", "message": "That message isn't allowed"})
+			return nil
+		}
+	}
+
+	obj, err := db.Get(Player{}, playerId)
+	if err != nil || obj == nil {
+		return err
+	}
+	gs.SendHost(gameId, Message{"type": "chat", "player": playerId, "name": obj.(*Player).Name, "text": text})
+	return nil
+}
+
+// the player reacts with one of the chatReactions
+func playerReact(msg Message, gameId string, playerId int, gs GameService, conn Conn, db *gorp.DbMap, log *log.Logger) error {
+	emoji, _ := msg["emoji"].(string)
+	allowed := false
+	for _, r := range chatReactions {
+		allowed = allowed || r == emoji
+	}
+	if !allowed {
+		conn.Send(Message{"type": "error", "message": "`emoji` must be one of the reactions", "reactions": chatReactions})
+		return nil
+	}
+	_, ok, err := canChat(gameId, playerId, conn, db)
+	if err != nil || !ok {
+		return err
+	}
+
+	obj, err := db.Get(Player{}, playerId)
+	if err != nil || obj == nil {
+		return err
+	}
+	gs.SendHost(gameId, Message{"type": "react", "player": playerId, "name": obj.(*Player).Name, "emoji": emoji})
+	return nil
+}
+
+// shows chat from a player on the TV, and the phones if the host lets them see it
+func hostChat(msg Message, gameId string, playerId int, gs GameService, conn Conn, db *gorp.DbMap, log *log.Logger) error {
+	settings, err := getChatSettings(gameId, db)
+	if err != nil {
+		return err
+	}
+	// the player may have been muted while their message was on its way
+	if pid, ok := toInt(msg["player"]); ok && settings.isMuted(pid) {
+		return nil
+	}
+	conn.Send(msg)
+	if settings.Phones {
+		sendPhones(gameId, gs, msg)
+	}
+	return nil
+}
+
+// shows the phones what the host was sent, in the order it was sent
+func sendPhones(gameId string, gs GameService, msg Message) {
+	gs.Broadcast(gameId, msg)
+}
+
+// the host mutes or unmutes a player, and the host's player list is updated to show it
+func hostMute(msg Message, gameId string, playerId int, gs GameService, conn Conn, db *gorp.DbMap, log *log.Logger) error {
+	pid, ok := msg["player"].(float64)
+	if !ok {
+		conn.Send(Message{"type": "error", "message": "Provide the `player` to mute"})
+		return nil
+	}
+	settings, err := getChatSettings(gameId, db)
+	if err != nil {
+		return err
+	}
+	muted, err := settings.getMuted()
+	if err != nil {
+		return err
+	}
+
+	kept := []int{}
+	for _, m := range muted {
+		if m != int(pid) {
+			kept = append(kept, m)
+		}
+	}
+	if msg["type"] == "mute" {
+		kept = append(kept, int(pid))
+	}
+	if err = settings.setMuted(kept); err != nil {
+		return err
+	}
+	if err = saveChatSettings(settings, db); err != nil {
+		log.Printf("Unable to save chat settings: %#v", err)
+		return err
+	}
+	return sendPlayers(gameId, gs, conn, db)
+}
+
+// the host wipes the chat off the TV, and the phones
+func hostClearChat(msg Message, gameId string, playerId int, gs GameService, conn Conn, db *gorp.DbMap, log *log.Logger) error {
+	clear := Message{"type": "clear_chat"}
+	conn.Send(clear)
+	sendPhones(gameId, gs, clear)
+	return nil
+}
+
+// the host changes any of enabled, max_length, rate_limit and phones
+func hostChatSettings(msg Message, gameId string, playerId int, gs GameService, conn Conn, db *gorp.DbMap, log *log.Logger) error {
+	settings, err := getChatSettings(gameId, db)
+	if err != nil {
+		return err
+	}
+	if v, ok := msg["enabled"].(bool); ok {
+		settings.Enabled = v
+	}
+	if v, ok := msg["phones"].(bool); ok {
+		settings.Phones = v
+	}
+	if v, ok := msg["max_length"].(float64); ok {
+		if v < 1 || v > 500 {
+			conn.Send(Message{"type": "error", "message": "`max_length` must be from 1 to 500"})
+			return nil
+		}
+		settings.MaxLength = int(v)
+	}
+	if v, ok := msg["rate_limit"].(float64); ok {
+		if v < 1 {
+			conn.Send(Message{"type": "error", "message": "`rate_limit` must be at least 1"})
+			return nil
+		}
+		settings.RateLimit = int(v)
+	}
+	if err = saveChatSettings(settings, db); err != nil {
+		log.Printf("Unable to save chat settings: %#v", err)
+		return err
+	}
+
+	update := settings.toMessage()
+	conn.Send(update)
+	sendPhones(gameId, gs, update)
+	return nil
+}
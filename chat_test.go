@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_BlockWords(t *testing.T) {
+	filter := BlockWords("darn", "heck")
+	text, ok := filter("game", 1, "Darn it, what the HECK")
+	if !ok || text != "**** it, what the ****" {
+		t.Errorf("Words weren't starred out: %q", text)
+	}
+}
+
+func Test_ChatAllowed(t *testing.T) {
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if !chatAllowed(-1, 3, now) {
+			t.Fatalf("Message %v should be under the limit", i)
+		}
+	}
+	if chatAllowed(-1, 3, now) {
+		t.Errorf("Fourth message in the window should be over the limit")
+	}
+	if !chatAllowed(-1, 3, now.Add(chatWindow)) {
+		t.Errorf("Limit should reset once the window has passed")
+	}
+}
+
+func Test_ForgetChat(t *testing.T) {
+	now := time.Now()
+	chatAllowed(-2, 1, now)
+	forgetChat(-2)
+	if !chatAllowed(-2, 1, now) {
+		t.Errorf("Player who left was still held to the limit")
+	}
+	forgetChat(-2)
+	chatTimes.Lock()
+	defer chatTimes.Unlock()
+	if _, ok := chatTimes.m[-2]; ok {
+		t.Errorf("Player who left is still in the rate limit")
+	}
+}
+
+func Test_Integration_Chat(t *testing.T) {
+	s := startServer(t)
+	defer s.stop()
+
+	g := s.newGame("tictactoe", 1)
+	defer g.close()
+	phone := g.players[0]
+
+	phone.send(Message{"type": "chat", "text": "  good luck  "})
+	msg := g.host.await("chat", nil)
+	if msg["text"] != "good luck" {
+		t.Errorf("Host got the wrong chat: %#v", msg)
+	}
+
+	phone.send(Message{"type": "react", "emoji": chatReactions[0]})
+	g.host.await("react", nil)
+
+	phone.send(Message{"type": "react", "emoji": "not an emoji"})
+	phone.await("error", nil)
+
+	// once muted the phone is told, and nothing reaches the TV
+	g.host.send(Message{"type": "mute", "player": msg["player"]})
+	g.host.await("players", func(msg Message) bool {
+		players, _ := msg["players"].([]interface{})
+		return len(players) == 1 && players[0].(map[string]interface{})["muted"] == true
+	})
+	phone.send(Message{"type": "chat", "text": "hello?"})
+	if msg = phone.await("error", nil); msg["message"] != "You've been muted" {
+		t.Errorf("Muted phone wasn't told: %#v", msg)
+	}
+}
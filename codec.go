@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/websocket"
+)
+
+// A Codec turns messages into websocket frames and back. Browsers get JSON unless they ask for something else with
+// the websocket's subprotocol, and whatever the codec, numbers come out as float64 as they do from JSON, so actions
+// read messages the same way.
+type Codec interface {
+	Encode(msg Message) ([]byte, error)
+	Decode(data []byte) (Message, error)
+	FrameType() int // the websocket frame type messages go in
+}
+
+// the largest message a client may send, anything bigger closes its websocket before it's read into memory
+const maxMessageSize = 64 << 10
+
+// Codecs by the subprotocol that asks for them.
+var Codecs = map[string]Codec{
+	"json":    jsonCodec{},
+	"msgpack": msgpackCodec{},
+}
+
+// The codec for the first subprotocol the client offers that there's a codec for, and the header to agree to it with.
+// JSON is the default, for clients that don't offer any.
+func negotiateCodec(req *http.Request) (Codec, http.Header) {
+	for _, protocol := range websocket.Subprotocols(req) {
+		if codec, ok := Codecs[protocol]; ok {
+			return codec, http.Header{"Sec-Websocket-Protocol": {protocol}}
+		}
+	}
+	return jsonCodec{}, nil
+}
+
+// reads the next message from the websocket
+func readMessage(ws *websocket.Conn, codec Codec) (Message, error) {
+	_, data, err := ws.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	return codec.Decode(data)
+}
+
+// writes a message to the websocket
+func writeMessage(ws *websocket.Conn, codec Codec, msg Message) error {
+	data, err := codec.Encode(msg)
+	if err != nil {
+		return err
+	}
+	return ws.WriteMessage(codec.FrameType(), data)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(msg Message) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func (jsonCodec) Decode(data []byte) (Message, error) {
+	msg := Message{}
+	err := json.Unmarshal(data, &msg)
+	return msg, err
+}
+
+func (jsonCodec) FrameType() int {
+	return websocket.TextMessage
+}
+
+// MessagePack, which is JSON's data model in a compact binary form. Only the parts of it JSON has are used, so
+// extension types are refused, binary strings are read as strings and map keys have to be strings.
+type msgpackCodec struct{}
+
+var errMsgpackShort = errors.New("msgpack: unexpected end of data")
+
+// how deep arrays and maps may nest in a message, so one made of nothing but nesting can't exhaust the stack
+const maxMsgpackDepth = 64
+
+func (msgpackCodec) FrameType() int {
+	return websocket.BinaryMessage
+}
+
+func (msgpackCodec) Encode(msg Message) ([]byte, error) {
+	return appendMsgpack(nil, map[string]interface{}(msg))
+}
+
+func (msgpackCodec) Decode(data []byte) (Message, error) {
+	v, rest, err := readMsgpack(data, maxMsgpackDepth)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("msgpack: %d bytes after the message", len(rest))
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("msgpack: message isn't a map")
+	}
+	return Message(m), nil
+}
+
+// Appends a value to buf. The types messages are usually made of are written directly, anything else is put through
+// JSON first so structs, times and the like come out as they would in JSON.
+func appendMsgpack(buf []byte, v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(buf, 0xc0), nil
+	case bool:
+		if v {
+			return append(buf, 0xc3), nil
+		}
+		return append(buf, 0xc2), nil
+	case int:
+		return appendMsgpackInt(buf, int64(v)), nil
+	case int64:
+		return appendMsgpackInt(buf, v), nil
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<62 {
+			return appendMsgpackInt(buf, int64(v)), nil
+		}
+		buf = append(buf, 0xcb)
+		return appendMsgpackUint(buf, math.Float64bits(v), 8), nil
+	case string:
+		return appendMsgpackString(buf, v), nil
+	case []interface{}:
+		buf = appendMsgpackHeader(buf, len(v), 0x90, 0xdc)
+		var err error
+		for _, e := range v {
+			if buf, err = appendMsgpack(buf, e); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case []int:
+		buf = appendMsgpackHeader(buf, len(v), 0x90, 0xdc)
+		for _, e := range v {
+			buf = appendMsgpackInt(buf, int64(e))
+		}
+		return buf, nil
+	case Message:
+		return appendMsgpack(buf, map[string]interface{}(v))
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf = appendMsgpackHeader(buf, len(v), 0x80, 0xde)
+		var err error
+		for _, k := range keys {
+			buf = appendMsgpackString(buf, k)
+			if buf, err = appendMsgpack(buf, v[k]); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var generic interface{}
+	if err = json.Unmarshal(data, &generic); err != nil {
+		return nil, err
+	}
+	return appendMsgpack(buf, generic)
+}
+
+func appendMsgpackInt(buf []byte, n int64) []byte {
+	switch {
+	case n >= 0 && n <= 0x7f:
+		return append(buf, byte(n))
+	case n < 0 && n >= -32:
+		return append(buf, byte(n))
+	case n >= math.MinInt8 && n <= math.MaxInt8:
+		return append(buf, 0xd0, byte(n))
+	case n >= math.MinInt16 && n <= math.MaxInt16:
+		return appendMsgpackUint(append(buf, 0xd1), uint64(n), 2)
+	case n >= math.MinInt32 && n <= math.MaxInt32:
+		return appendMsgpackUint(append(buf, 0xd2), uint64(n), 4)
+	}
+	return appendMsgpackUint(append(buf, 0xd3), uint64(n), 8)
+}
+
+func appendMsgpackString(buf []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		buf = append(buf, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		buf = append(buf, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		buf = appendMsgpackUint(append(buf, 0xda), uint64(n), 2)
+	default:
+		buf = appendMsgpackUint(append(buf, 0xdb), uint64(n), 4)
+	}
+	return append(buf, s...)
+}
+
+// the header of an array or map, which have a fix form for up to 15 entries then 16 and 32 bit ones after each other
+func appendMsgpackHeader(buf []byte, n int, fix, code16 byte) []byte {
+	switch {
+	case n < 16:
+		return append(buf, fix|byte(n))
+	case n <= math.MaxUint16:
+		return appendMsgpackUint(append(buf, code16), uint64(n), 2)
+	}
+	return appendMsgpackUint(append(buf, code16+1), uint64(n), 4)
+}
+
+// Reads a value off the front of data, returning what's left after it. Numbers are float64, arrays []interface{} and
+// maps map[string]interface{}, just as from JSON. Depth is how many more levels arrays and maps may nest.
+func readMsgpack(data []byte, depth int) (interface{}, []byte, error) {
+	if len(data) == 0 {
+		return nil, nil, errMsgpackShort
+	}
+	c, data := data[0], data[1:]
+	if depth <= 0 && (c >= 0x80 && c <= 0x9f || c >= 0xdc && c <= 0xdf) {
+		return nil, nil, errors.New("msgpack: nested too deep")
+	}
+	switch {
+	case c <= 0x7f:
+		return float64(c), data, nil
+	case c >= 0xe0:
+		return float64(int8(c)), data, nil
+	case c >= 0xa0 && c <= 0xbf:
+		return readMsgpackString(data, int(c&0x1f))
+	case c >= 0x90 && c <= 0x9f:
+		return readMsgpackArray(data, int(c&0x0f), depth-1)
+	case c >= 0x80 && c <= 0x8f:
+		return readMsgpackMap(data, int(c&0x0f), depth-1)
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, data, nil
+	case 0xc2:
+		return false, data, nil
+	case 0xc3:
+		return true, data, nil
+	case 0xca:
+		n, data, err := readMsgpackUint(data, 4)
+		return float64(math.Float32frombits(uint32(n))), data, err
+	case 0xcb:
+		n, data, err := readMsgpackUint(data, 8)
+		return math.Float64frombits(n), data, err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		n, data, err := readMsgpackUint(data, 1<<(c-0xcc))
+		return float64(n), data, err
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (c - 0xd0)
+		n, data, err := readMsgpackUint(data, size)
+		// sign extend from however many bytes it was
+		shift := uint(64 - 8*size)
+		return float64(int64(n<<shift) >> shift), data, err
+	case 0xd9, 0xda, 0xdb, 0xc4, 0xc5, 0xc6:
+		size := map[byte]int{0xd9: 1, 0xda: 2, 0xdb: 4, 0xc4: 1, 0xc5: 2, 0xc6: 4}[c]
+		n, data, err := readMsgpackUint(data, size)
+		if err != nil {
+			return nil, nil, err
+		}
+		return readMsgpackString(data, int(n))
+	case 0xdc, 0xdd:
+		n, data, err := readMsgpackUint(data, 2<<(c-0xdc))
+		if err != nil {
+			return nil, nil, err
+		}
+		return readMsgpackArray(data, int(n), depth-1)
+	case 0xde, 0xdf:
+		n, data, err := readMsgpackUint(data, 2<<(c-0xde))
+		if err != nil {
+			return nil, nil, err
+		}
+		return readMsgpackMap(data, int(n), depth-1)
+	}
+	return nil, nil, fmt.Errorf("msgpack: unsupported type 0x%02x", c)
+}
+
+// appends n as a big endian number of size bytes
+func appendMsgpackUint(buf []byte, n uint64, size int) []byte {
+	for i := size - 1; i >= 0; i-- {
+		buf = append(buf, byte(n>>(8*uint(i))))
+	}
+	return buf
+}
+
+// reads a big endian unsigned number of size bytes
+func readMsgpackUint(data []byte, size int) (uint64, []byte, error) {
+	if len(data) < size {
+		return 0, nil, errMsgpackShort
+	}
+	var n uint64
+	for _, b := range data[:size] {
+		n = n<<8 | uint64(b)
+	}
+	return n, data[size:], nil
+}
+
+func readMsgpackString(data []byte, n int) (interface{}, []byte, error) {
+	if n < 0 || len(data) < n {
+		return nil, nil, errMsgpackShort
+	}
+	return string(data[:n]), data[n:], nil
+}
+
+func readMsgpackArray(data []byte, n, depth int) (interface{}, []byte, error) {
+	// every element takes at least a byte, which stops a bogus length from making a huge slice
+	if n < 0 || len(data) < n {
+		return nil, nil, errMsgpackShort
+	}
+	a := make([]interface{}, n)
+	var err error
+	for i := range a {
+		if a[i], data, err = readMsgpack(data, depth); err != nil {
+			return nil, nil, err
+		}
+	}
+	return a, data, nil
+}
+
+func readMsgpackMap(data []byte, n, depth int) (interface{}, []byte, error) {
+	if n < 0 || len(data) < 2*n {
+		return nil, nil, errMsgpackShort
+	}
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, rest, err := readMsgpack(data, depth)
+		if err != nil {
+			return nil, nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, nil, fmt.Errorf("msgpack: map key %v isn't a string", k)
+		}
+		if m[key], data, err = readMsgpack(rest, depth); err != nil {
+			return nil, nil, err
+		}
+	}
+	return m, data, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_Msgpack(t *testing.T) {
+	long := string(bytes.Repeat([]byte("x"), 300))
+	msg := Message{
+		"type":    "update",
+		"state":   "start",
+		"board":   []int{0, 1, -1, 200, -200, 70000, -70000, 1 << 40},
+		"cells":   []interface{}{1.5, "a", nil, true, false},
+		"players": []Message{{"id": 3, "name": long}},
+		"score":   map[int]int{7: 2},
+		"moved":   time.Date(2014, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	data, err := msgpackCodec{}.Encode(msg)
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+	got, err := msgpackCodec{}.Decode(data)
+	if err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+
+	// it should come back just as it would have from JSON
+	js, _ := jsonCodec{}.Encode(msg)
+	want, _ := jsonCodec{}.Decode(js)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %#v\nwanted %#v", got, want)
+	}
+	if len(data) >= len(js) {
+		t.Errorf("MessagePack took %v bytes, no smaller than JSON's %v", len(data), len(js))
+	}
+}
+
+func Test_Msgpack_Bytes(t *testing.T) {
+	data, err := msgpackCodec{}.Encode(Message{"move": 4.0, "type": "move"})
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+	want := []byte{0x82, 0xa4, 'm', 'o', 'v', 'e', 0x04, 0xa4, 't', 'y', 'p', 'e', 0xa4, 'm', 'o', 'v', 'e'}
+	if !bytes.Equal(data, want) {
+		t.Errorf("Got % x, wanted % x", data, want)
+	}
+
+	// what other encoders write, including the sizes this one doesn't
+	msg, err := msgpackCodec{}.Decode([]byte{0x83,
+		0xa1, 'a', 0xcc, 0xff,
+		0xa1, 'b', 0xca, 0x3f, 0xc0, 0x00, 0x00,
+		0xa1, 'c', 0xc4, 0x02, 'h', 'i',
+	})
+	if err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+	if !reflect.DeepEqual(msg, Message{"a": 255.0, "b": 1.5, "c": "hi"}) {
+		t.Errorf("Decoded %#v", msg)
+	}
+}
+
+func Test_Msgpack_Bad(t *testing.T) {
+	bad := map[string][]byte{
+		"empty":        {},
+		"not a map":    {0x91, 0x01},
+		"short string": {0x81, 0xa1, 'a', 0xa5, 'b'},
+		"int key":      {0x81, 0x01, 0x01},
+		"extension":    {0x81, 0xa1, 'a', 0xd4, 0x01, 0x01},
+		"left over":    {0x80, 0x80},
+		"huge array":   {0x81, 0xa1, 'a', 0xdd, 0xff, 0xff, 0xff, 0xff},
+	}
+	// a message nested deeper than anybody sends, an array in an array and so on
+	deep := []byte{0x81, 0xa1, 'a'}
+	for i := 0; i < 10000; i++ {
+		deep = append(deep, 0x91)
+	}
+	bad["too deep"] = append(deep, 0x01)
+	for name, data := range bad {
+		if msg, err := (msgpackCodec{}).Decode(data); err == nil {
+			t.Errorf("Decoded %v into %#v", name, msg)
+		}
+	}
+
+	// while the nesting messages really have is fine
+	nested := Message{"a": []interface{}{map[string]interface{}{"b": []interface{}{1.0}}}}
+	data, _ := msgpackCodec{}.Encode(nested)
+	if msg, err := (msgpackCodec{}).Decode(data); err != nil || !reflect.DeepEqual(msg, nested) {
+		t.Errorf("Decoded %#v into %#v: %v", nested, msg, err)
+	}
+}
+
+func Test_NegotiateCodec(t *testing.T) {
+	for protocols, want := range map[string]string{
+		"":              "",
+		"msgpack":       "msgpack",
+		"cbor, msgpack": "msgpack",
+		"json, msgpack": "json",
+		"cbor":          "",
+	} {
+		req, _ := http.NewRequest("GET", "/ws/game", nil)
+		if protocols != "" {
+			req.Header.Set("Sec-WebSocket-Protocol", protocols)
+		}
+		codec, header := negotiateCodec(req)
+		if got := header.Get("Sec-WebSocket-Protocol"); got != want {
+			t.Errorf("Offered %q, agreed to %q, wanted %q", protocols, got, want)
+		}
+		if _, binary := codec.(msgpackCodec); binary != (want == "msgpack") {
+			t.Errorf("Offered %q, got codec %T", protocols, codec)
+		}
+	}
+}
@@ -1,5 +1,7 @@
 package main
 
+import "time"
+
 type Role int
 
 const (
@@ -14,12 +16,27 @@ type Player struct {
 	Color string `json:"color"`  // a hex color to customize the player image
 	Game  string `json:"string"` // current game we are in (foreign key)
 	Role  Role   `json:"role"`
+	Team  int    `json:"team"` // the team the player is on in this game, 0 if they aren't on one
+	Bot   string `json:"bot"`  // how well a computer player plays, empty for people
 }
 
 type Game struct {
-	Id    string `json:"id"` // UUID
-	State string `json:"state"`
-	Type  string `json:"type"` // type of game (tictactoe, trivia, etc)
+	Id       string    `json:"id"` // UUID
+	State    string    `json:"state"`
+	Type     string    `json:"type"`     // type of game (tictactoe, trivia, etc)
+	Teams    int       `json:"teams"`    // number of teams playing, 0 when it's every player for themselves
+	Party    string    `json:"party"`    // games hosted from the same screen share a party, for leaderboards
+	Options  string    `json:"options"`  // JSON object of the options the game was created with, which depend on its type
+	Rounds   int       `json:"rounds"`   // number of rounds played so far
+	Created  time.Time `json:"created"`  // when the host opened the lobby
+	Started  time.Time `json:"started"`  // when the host started the game, zero until then
+	Finished time.Time `json:"finished"` // when the game was decided, zero until then
 }
 
 type Message map[string]interface{}
+
+// Conn is how actions talk back to whoever is on the other end of a game: usually a websocket, but it may be a bot
+// playing in this process.
+type Conn interface {
+	Send(msg Message) error
+}
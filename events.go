@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/coopernurse/gorp"
+)
+
+// An append-only record of everything that happened in a game. Rows are only ever inserted, never updated, so
+// a disputed round can be audited by reading the log back in order.
+type Event struct {
+	Id        int       `json:"id"`
+	Game      string    `json:"game"`      // foreign key to game
+	Player    int       `json:"player"`    // the player whose connection dispatched the message or changed the state
+	Kind      string    `json:"kind"`      // "message" or "state"
+	Direction string    `json:"direction"` // which dispatch map the message went through, empty for state changes
+	Type      string    `json:"type"`      // the message type, or the new state for state changes
+	Payload   string    `json:"payload"`   // the message (or from/to states) serialized as JSON
+	Created   time.Time `json:"created"`
+}
+
+const (
+	MessageEvent = "message"
+	StateEvent   = "state"
+)
+
+// the directions a message may travel in, mostly named after the dispatch maps in tictactoe.go
+const (
+	HostFromWebDir    = "HostFromWeb"
+	HostFromPlayerDir = "HostFromPlayer"
+	PlayerFromWebDir  = "PlayerFromWeb"
+	PlayerFromHostDir = "PlayerFromHost"
+	HostToWebDir      = "HostToWeb" // updates the host writes to its own screen, these are what a replay shows
+)
+
+// the payload is stored as a string, but it's JSON so send it to clients as an object
+func (e Event) toMessage() Message {
+	return Message{
+		"id":        e.Id,
+		"game":      e.Game,
+		"player":    e.Player,
+		"kind":      e.Kind,
+		"direction": e.Direction,
+		"type":      e.Type,
+		"payload":   json.RawMessage(e.Payload),
+		"created":   e.Created,
+	}
+}
+
+// Records a message as it is dispatched to an action.
+func logMessage(db *gorp.DbMap, direction string, gameId string, playerId int, msg Message) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	msgType, _ := msg["type"].(string)
+	return db.Insert(&Event{
+		Game:      gameId,
+		Player:    playerId,
+		Kind:      MessageEvent,
+		Direction: direction,
+		Type:      msgType,
+		Payload:   string(payload),
+		Created:   time.Now().UTC(),
+	})
+}
+
+// Records a game moving from one state to another.
+func logTransition(db *gorp.DbMap, gameId string, playerId int, from, to string) error {
+	payload, err := json.Marshal(Message{"from": from, "to": to})
+	if err != nil {
+		return err
+	}
+	return db.Insert(&Event{
+		Game:    gameId,
+		Player:  playerId,
+		Kind:    StateEvent,
+		Type:    to,
+		Payload: string(payload),
+		Created: time.Now().UTC(),
+	})
+}
+
+// Gets the events of a game in the order they happened. Any of kind, direction and msgType may be empty to not
+// filter on them, and only events after the since id are returned.
+func getEvents(db *gorp.DbMap, gameId string, kind, direction, msgType string, since int) ([]*Event, error) {
+	query := "select * from events where game=? and id>?"
+	args := []interface{}{gameId, since}
+	if kind != "" {
+		query += " and kind=?"
+		args = append(args, kind)
+	}
+	if direction != "" {
+		query += " and direction=?"
+		args = append(args, direction)
+	}
+	if msgType != "" {
+		query += " and type=?"
+		args = append(args, msgType)
+	}
+	query += " order by id"
+
+	var events []*Event
+	_, err := db.Select(&events, query, args...)
+	if err != nil {
+		log.Printf("Failed to select events for game %v: %v", gameId, err)
+		return nil, err
+	}
+	return events, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// A Fabric carries messages between the host of a game and its players. With the in-memory fabric everyone in a
+// game has to be connected to the same process, the broker fabric lets several servers share games.
+type Fabric interface {
+	HostJoin(gameId string) chan Message
+	HostLeave(gameId string)
+	HostConnected(gameId string) bool
+	PlayerJoin(gameId string, playerId int) chan Message
+	// PlayerLeave closes the channel PlayerJoin gave, and returns false if the player has joined again since then.
+	PlayerLeave(gameId string, playerId int, ch chan Message) bool
+	Broadcast(gameId string, msg Message)
+	SendHost(gameId string, msg Message)
+	SendPlayer(gameId string, playerId int, msg Message)
+	GetConnectedPlayers(gameId string) []int
+	// Forget frees everything kept for a game if nobody is connected to it, and returns false if somebody is.
+	Forget(gameId string) bool
+}
+
+type Channels struct {
+	// players' messages wait in a queue like the broker's, so the host never waits on a phone that may be waiting on
+	// the host
+	players map[int]*subscription
+	host    chan Message
+	// the host's channel outlives the host so players sending to it wait for them to reconnect
+	hostConns int
+}
+
+// MemoryFabric routes messages through Go channels within this process.
+type MemoryFabric struct {
+	sync.RWMutex
+	ChannelMap map[string]*Channels
+}
+
+func NewMemoryFabric() *MemoryFabric {
+	return &MemoryFabric{ChannelMap: map[string]*Channels{}}
+}
+
+func (f *MemoryFabric) HostJoin(gameId string) chan Message {
+	f.Lock()
+	defer f.Unlock()
+	// host is usually first to join a game so most of the time this will be called
+	if f.ChannelMap[gameId] == nil {
+		log.Printf("channel map created for game %v", gameId)
+		f.ChannelMap[gameId] = &Channels{players: map[int]*subscription{}}
+	}
+	if f.ChannelMap[gameId].host == nil {
+		log.Printf("Host connecting for first time")
+		f.ChannelMap[gameId].host = make(chan Message)
+	}
+	f.ChannelMap[gameId].hostConns++
+	return f.ChannelMap[gameId].host
+}
+
+func (f *MemoryFabric) HostLeave(gameId string) {
+	f.Lock()
+	defer f.Unlock()
+	// a host that reconnected before the old connection noticed it dropped is still here
+	if c := f.ChannelMap[gameId]; c != nil && c.hostConns > 0 {
+		c.hostConns--
+	}
+}
+
+func (f *MemoryFabric) HostConnected(gameId string) bool {
+	f.RLock()
+	defer f.RUnlock()
+	c := f.ChannelMap[gameId]
+	return c != nil && c.hostConns > 0
+}
+
+func (f *MemoryFabric) PlayerJoin(gameId string, playerId int) chan Message {
+	f.Lock()
+	defer f.Unlock()
+	// if the server restarts and a player rejoins before the host, this will be called
+	if f.ChannelMap[gameId] == nil {
+		log.Printf("First player to connect to game is player %v", playerId)
+		f.ChannelMap[gameId] = &Channels{players: map[int]*subscription{}}
+	}
+	// a phone that reconnects replaces its old connection
+	if old := f.ChannelMap[gameId].players[playerId]; old != nil {
+		close(old.done)
+	}
+	p := newSubscription()
+	f.ChannelMap[gameId].players[playerId] = p
+	return p.ch
+}
+
+func (f *MemoryFabric) PlayerLeave(gameId string, playerId int, ch chan Message) bool {
+	f.Lock()
+	defer f.Unlock()
+	// the old connection of a player who has reconnected was closed when they did
+	c := f.ChannelMap[gameId]
+	if c == nil || c.players[playerId] == nil || c.players[playerId].ch != ch {
+		return false
+	}
+	close(c.players[playerId].done)
+	delete(c.players, playerId)
+	return true
+}
+
+func (f *MemoryFabric) Broadcast(gameId string, msg Message) {
+	f.RLock()
+	defer f.RUnlock()
+
+	for _, p := range f.ChannelMap[gameId].players {
+		p.deliver(msg)
+	}
+}
+
+func (f *MemoryFabric) SendHost(gameId string, msg Message) {
+	f.RLock()
+	var host chan Message
+	if c := f.ChannelMap[gameId]; c != nil {
+		host = c.host
+	}
+	f.RUnlock()
+
+	if host == nil {
+		log.Printf("Host of game %v never connected, dropping %v", gameId, msg["type"])
+		return
+	}
+	// waits for a host that's away to reconnect, without the lock so HostJoin can let them
+	host <- msg
+}
+
+func (f *MemoryFabric) SendPlayer(gameId string, playerId int, msg Message) {
+	f.RLock()
+	defer f.RUnlock()
+
+	if c := f.ChannelMap[gameId]; c != nil {
+		if p, ok := c.players[playerId]; ok {
+			p.deliver(msg)
+		}
+	}
+}
+
+func (f *MemoryFabric) GetConnectedPlayers(gameId string) []int {
+	f.RLock()
+	defer f.RUnlock()
+
+	players := []int{}
+	for pid, _ := range f.ChannelMap[gameId].players {
+		players = append(players, pid)
+	}
+	return players
+}
+
+func (f *MemoryFabric) Forget(gameId string) bool {
+	f.Lock()
+	defer f.Unlock()
+	c := f.ChannelMap[gameId]
+	if c == nil {
+		return true
+	}
+	if c.hostConns > 0 || len(c.players) > 0 {
+		return false
+	}
+	delete(f.ChannelMap, gameId)
+	return true
+}
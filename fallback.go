@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/codegangsta/martini"
+	"github.com/coopernurse/gorp"
+	"github.com/martini-contrib/render"
+	"github.com/martini-contrib/sessions"
+)
+
+const (
+	pollWait   = 25 * time.Second // how long a long-poll waits for something to send before answering with nothing
+	pollIdle   = time.Minute      // how long a browser can go without polling or streaming before it's taken to have left
+	streamPing = 15 * time.Second // how often an event stream with nothing to say writes a comment, to keep proxies from closing it
+)
+
+var errConnClosed = errors.New("connection closed")
+
+// a message waiting in a mailbox, numbered so browsers can say which ones they've got
+type mail struct {
+	id   int
+	data json.RawMessage
+}
+
+// A connection for browsers on networks that block websockets. What the game sends waits in a mailbox until it's
+// streamed as server-sent events or collected by a long-poll, and what the browser sends comes in as POSTs.
+type httpConn struct {
+	sync.Mutex
+	conns   *HTTPConns
+	key     string
+	in      chan Message // POSTed messages, handed on to the game
+	mailbox []mail
+	mail    chan bool // has something in it when there may be new mail
+	done    chan bool // closed once the browser has gone or the game is done with it
+	once    sync.Once
+	streams int       // event streams open on it
+	seen    time.Time // when the last poll or stream ended
+}
+
+// Messages are encoded as they're sent, as a websocket would, so actions are free to change them afterwards.
+func (c *httpConn) Send(msg Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	defer c.Unlock()
+	select {
+	case <-c.done:
+		return errConnClosed
+	default:
+	}
+	c.mailbox = append(c.mailbox, mail{c.conns.nextId(), data})
+	select {
+	case c.mail <- true:
+	default:
+	}
+	return nil
+}
+
+// the mail after the given id, throwing away what came before it as the browser has it already
+func (c *httpConn) since(after int) []mail {
+	c.Lock()
+	defer c.Unlock()
+	i := 0
+	for i < len(c.mailbox) && c.mailbox[i].id <= after {
+		i++
+	}
+	c.mailbox = c.mailbox[i:]
+	return append([]mail{}, c.mailbox...)
+}
+
+// keeps the connection from going idle while an event stream is open, returning the func to call when it closes
+func (c *httpConn) stream() func() {
+	c.Lock()
+	c.streams++
+	c.Unlock()
+	return func() {
+		c.Lock()
+		c.streams--
+		c.seen = time.Now()
+		c.Unlock()
+	}
+}
+
+func (c *httpConn) polled() {
+	c.Lock()
+	c.seen = time.Now()
+	c.Unlock()
+}
+
+func (c *httpConn) idle() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.streams == 0 && time.Since(c.seen) > pollIdle
+}
+
+func (c *httpConn) close() {
+	c.once.Do(func() { close(c.done) })
+}
+
+// HTTPConns are the connections open over server-sent events and long-polls, one for each player of each game.
+type HTTPConns struct {
+	sync.Mutex
+	conns map[string]*httpConn
+	id    int
+}
+
+func NewHTTPConns() *HTTPConns {
+	return &HTTPConns{conns: map[string]*httpConn{}}
+}
+
+// Mail is numbered across every connection, so a browser that's reconnected doesn't mistake its new mail for old.
+func (h *HTTPConns) nextId() int {
+	h.Lock()
+	defer h.Unlock()
+	h.id++
+	return h.id
+}
+
+// The player's connection to the game, opening it if they haven't one. Opening one plays the game for them just as
+// connecting a websocket does, until they stop polling and streaming for long enough to have left.
+func (h *HTTPConns) open(gameId string, playerId int, gs GameService, db *gorp.DbMap, log *log.Logger) *httpConn {
+	key := fmt.Sprint(gameId, "/", playerId)
+	h.Lock()
+	defer h.Unlock()
+	if c, ok := h.conns[key]; ok {
+		return c
+	}
+	c := &httpConn{conns: h, key: key, in: make(chan Message), mail: make(chan bool, 1), done: make(chan bool), seen: time.Now()}
+	h.conns[key] = c
+
+	read := make(chan Message)
+	go func() {
+		defer close(read)
+		for {
+			select {
+			case msg := <-c.in:
+				select {
+				case read <- msg:
+				case <-c.done:
+					return
+				}
+			case <-c.done:
+				return
+			}
+		}
+	}()
+	go func() {
+		ticker := time.NewTicker(pollIdle / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if c.idle() {
+					log.Printf("Player %v stopped polling game %v", playerId, gameId)
+					c.close()
+					return
+				}
+			case <-c.done:
+				return
+			}
+		}
+	}()
+	go func() {
+		playGame(gameId, playerId, c, read, gs, db, log)
+		c.close()
+		h.Lock()
+		if h.conns[key] == c {
+			delete(h.conns, key)
+		}
+		h.Unlock()
+	}()
+	return c
+}
+
+// the player in the session, as the websocket finds them, or 0 when there isn't one, in which case the response has
+// been written
+func sessionPlayer(r render.Render, session sessions.Session) int {
+	p, ok := session.Get("player_id").(int)
+	if !ok {
+		r.JSON(401, Message{"message": "Join the game first"})
+		return 0
+	}
+	return p
+}
+
+// Streams what the game sends the player as server-sent events. Browsers reconnect an EventSource that drops by
+// themselves, giving the id of the last message they got, so nothing is lost in between.
+func StreamHandler(r render.Render, w http.ResponseWriter, req *http.Request, params martini.Params, conns *HTTPConns, db *gorp.DbMap, gs GameService, session sessions.Session, log *log.Logger) {
+	playerId := sessionPlayer(r, session)
+	if playerId == 0 {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		r.JSON(500, Message{"message": "Streaming isn't supported"})
+		return
+	}
+	after, _ := strconv.Atoi(req.Header.Get("Last-Event-ID"))
+
+	c := conns.open(params["id"], playerId, gs, db, log)
+	defer c.stream()()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // or nginx holds the events back
+	w.WriteHeader(200)
+	fmt.Fprint(w, "retry: 2000\n\n")
+
+	ping := time.NewTicker(streamPing)
+	defer ping.Stop()
+	for {
+		for _, m := range c.since(after) {
+			if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", m.id, m.data); err != nil {
+				return
+			}
+			after = m.id
+		}
+		flusher.Flush()
+
+		select {
+		case <-c.mail:
+		case <-ping.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case <-c.done:
+			return
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+// Answers with what the game has sent the player after the cursor, waiting a while for something if there's nothing
+// yet. The cursor in the answer is the one to poll with next.
+func PollHandler(r render.Render, req *http.Request, params martini.Params, conns *HTTPConns, db *gorp.DbMap, gs GameService, session sessions.Session, log *log.Logger) {
+	playerId := sessionPlayer(r, session)
+	if playerId == 0 {
+		return
+	}
+	after := 0
+	if s := req.URL.Query().Get("cursor"); s != "" {
+		var err error
+		after, err = strconv.Atoi(s)
+		if err != nil {
+			r.JSON(400, Message{"message": "`cursor` must be the cursor of the last poll"})
+			return
+		}
+	}
+
+	c := conns.open(params["id"], playerId, gs, db, log)
+	defer c.polled()
+	c.polled()
+
+	mailbox := c.since(after)
+	timeout := time.After(pollWait)
+wait:
+	for len(mailbox) == 0 {
+		select {
+		case <-c.mail:
+			mailbox = c.since(after)
+		case <-timeout:
+			break wait
+		case <-c.done:
+			break wait
+		case <-req.Context().Done():
+			return
+		}
+	}
+
+	msgs := []json.RawMessage{}
+	for _, m := range mailbox {
+		msgs = append(msgs, m.data)
+		after = m.id
+	}
+	r.JSON(200, Message{"messages": msgs, "cursor": after})
+}
+
+// Takes a message from a browser streaming or polling, to be handled as if it came down a websocket.
+func SendHandler(r render.Render, req *http.Request, params martini.Params, conns *HTTPConns, db *gorp.DbMap, gs GameService, session sessions.Session, log *log.Logger) {
+	playerId := sessionPlayer(r, session)
+	if playerId == 0 {
+		return
+	}
+	msg := Message{}
+	if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+		r.JSON(400, Message{"message": "Messages must be JSON objects"})
+		return
+	}
+
+	c := conns.open(params["id"], playerId, gs, db, log)
+	select {
+	case c.in <- msg:
+		r.JSON(200, Message{"type": "sent"})
+	case <-c.done:
+		r.JSON(410, Message{"message": "The connection closed, poll or stream again to reconnect"})
+	}
+}
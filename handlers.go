@@ -1,11 +1,13 @@
 package main
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"runtime/pprof"
+	"strconv"
 
 	"github.com/codegangsta/martini"
 	"github.com/coopernurse/gorp"
@@ -31,15 +33,29 @@ func TicTacToeHandler() string {
 	return string(bytes)
 }
 
-// Creates a new game and player (the host)
-func NewGameHandler(r render.Render, params martini.Params, db *gorp.DbMap, session sessions.Session, gs GameService, log *log.Logger) {
+// Creates a new game and player (the host). The body may be a JSON object of options for the type of game.
+func NewGameHandler(r render.Render, params martini.Params, req *http.Request, db *gorp.DbMap, session sessions.Session, gs GameService, log *log.Logger) {
 	gameType, ok := params["game"]
 	if !ok {
 		log.Printf("Failed to get game type when creating game")
 		r.JSON(400, Message{"message": "Provide a `game`"})
 		return
 	}
-	game, player, err := gs.NewGame(gameType, db)
+	options := Message{}
+	if req.Body != nil && req.ContentLength != 0 {
+		if err := json.NewDecoder(req.Body).Decode(&options); err != nil {
+			r.JSON(400, Message{"message": "Options must be a JSON object"})
+			return
+		}
+	}
+	options, err := checkOptions(gameType, options)
+	if err != nil {
+		r.JSON(400, Message{"message": err.Error()})
+		return
+	}
+	// games hosted from the same screen are part of the same party
+	party, _ := session.Get("party").(string)
+	game, player, err := gs.NewGame(gameType, options, party, db)
 	if err != nil {
 		log.Printf("Failed to create game: %v", err)
 		r.JSON(500, Message{"message": "Failed to create game"})
@@ -50,6 +66,7 @@ func NewGameHandler(r render.Render, params martini.Params, db *gorp.DbMap, sess
 	// TODO: require logins for hosts
 
 	session.Set("player_id", player.Id)
+	session.Set("party", game.Party)
 
 	r.JSON(200, Message{"uuid": game.Id})
 }
@@ -63,6 +80,10 @@ func GetGameHandler(r render.Render, params martini.Params, db *gorp.DbMap, gs G
 	obj := session.Get("player_id")
 
 	_, player, err := gs.ConnectToGame(db, gameId, obj)
+	if err == errGameEnded {
+		r.JSON(410, Message{"type": "ended", "message": "This game has ended"})
+		return
+	}
 	if err != nil {
 		log.Printf("Failed to connect to game: %v", err)
 		r.JSON(500, Message{"message": "Failed to connect to game"})
@@ -80,10 +101,51 @@ func GetGameHandler(r render.Render, params martini.Params, db *gorp.DbMap, gs G
 	}
 }
 
+// lists the event log of a game, optionally filtered with the kind, direction, type and since query parameters
+func EventsHandler(r render.Render, params martini.Params, req *http.Request, db *gorp.DbMap, log *log.Logger) {
+	gameId := params["id"]
+	query := req.URL.Query()
+
+	since := 0
+	if s := query.Get("since"); s != "" {
+		var err error
+		since, err = strconv.Atoi(s)
+		if err != nil {
+			r.JSON(400, Message{"message": "`since` must be an event id"})
+			return
+		}
+	}
+
+	events, err := getEvents(db, gameId, query.Get("kind"), query.Get("direction"), query.Get("type"), since)
+	if err != nil {
+		log.Printf("Failed to get events: %v", err)
+		r.JSON(500, Message{"message": "Failed to get events"})
+		return
+	}
+
+	// angular wants an array of objects
+	msgs := []Message{}
+	for _, e := range events {
+		msgs = append(msgs, e.toMessage())
+	}
+	r.JSON(200, Message{"events": msgs})
+}
+
+// lets actions send messages down a websocket, in whatever encoding was agreed on
+type wsConn struct {
+	ws    *websocket.Conn
+	codec Codec
+}
+
+func (c wsConn) Send(msg Message) error {
+	return writeMessage(c.ws, c.codec, msg)
+}
+
 // handles the websocket connections for the game
 func WebsocketHandler(r render.Render, w http.ResponseWriter, req *http.Request, params martini.Params, db *gorp.DbMap, gs GameService, session sessions.Session, log *log.Logger) {
 	// upgrade to websocket
-	ws, err := websocket.Upgrade(w, req, nil, 1024, 1024)
+	codec, header := negotiateCodec(req)
+	ws, err := websocket.Upgrade(w, req, header, 1024, 1024)
 	if _, ok := err.(websocket.HandshakeError); ok {
 		http.Error(w, "Not a websocket handshake", 400)
 		return
@@ -92,7 +154,9 @@ func WebsocketHandler(r render.Render, w http.ResponseWriter, req *http.Request,
 		return
 	}
 	defer ws.Close()
+	ws.SetReadLimit(maxMessageSize)
 	log.Println("Succesfully upgraded connection")
+	conn := wsConn{ws, codec}
 
 	// get the player and game ids so the handers can get the game and player objects later
 	gameId := params["id"]
@@ -106,10 +170,9 @@ func WebsocketHandler(r render.Render, w http.ResponseWriter, req *http.Request,
 	// start a goroutine dedicated to listening to the websocket
 	wsReadChan := make(chan Message)
 	go func() {
-		msg := Message{}
 		for {
 			// Blocks
-			err := ws.ReadJSON(&msg)
+			msg, err := readMessage(ws, codec)
 			if err != nil {
 				log.Printf("Error message from websocket: %#v", err)
 				close(wsReadChan) // causes all of the goroutines waiting on this to stop
@@ -126,37 +189,75 @@ func WebsocketHandler(r render.Render, w http.ResponseWriter, req *http.Request,
 		}
 	}()
 
+	playGame(gameId, playerId, conn, wsReadChan, gs, db, log)
+}
+
+// Plays a game for the host or a player until read is closed, whatever transport they're connected with. What they
+// send comes in on read and is dispatched with the same actions, and what the game has for them goes out through conn.
+func playGame(gameId string, playerId int, conn Conn, read chan Message, gs GameService, db *gorp.DbMap, log *log.Logger) {
 	_, player, err := gs.GetGame(db, gameId, playerId)
+	if err == errGameEnded {
+		conn.Send(Message{"type": "ended", "message": "This game has ended"})
+		return
+	}
 	if err != nil {
 		log.Printf("Unable to get game here: %#v", err)
 		return
 	}
 
+	// a client is told whether it can play before it's sent any of the game
+	first, ok := awaitHello(read, conn, log)
+	if !ok {
+		return
+	}
+
 	if player.Role == Host {
 		log.Printf("Host (player %v) has connected", playerId)
 
 		hostRead := gs.HostJoin(gameId)
+		defer gs.HostLeave(gameId)
+		requests := takeHostRequests(gameId)
+		defer stopHostRequests(gameId, requests)
 
 		log.Printf("Initializing host")
-		HostInit(playerId, gameId, gs, ws, wsReadChan, db)
+		HostInit(playerId, gameId, gs, conn, read, db)
+
+		web := func(msg Message) bool {
+			handled, err := dispatchMessage(HostFromWeb, HostFromWebDir, msg, gameId, playerId, gs, conn, db, log)
+			if err != nil {
+				log.Printf("Error while handling message from web to host: %#v", err)
+				return false
+			}
+			if !handled {
+				log.Printf("Unknown message from web to host: %#v", msg)
+			}
+			return true
+		}
+		if first != nil && !web(first) {
+			return
+		}
 
 		for {
 			select {
-			case msg, ok := <-wsReadChan: // player website action
+			case msg, ok := <-read: // action from the browser
 				if !ok {
 					log.Printf("Read Channel closed!!11111")
 					return
 				}
-				handled, err := dispatchMessage(HostFromWeb, msg, gameId, playerId, gs, ws, db, log)
-				if err != nil {
-					log.Printf("Error while handling message from web to host: %#v", err)
+				if msg["type"] == "hello" {
+					if !greet(msg, conn, log) {
+						return
+					}
+					continue
+				}
+				if !web(msg) {
 					return
 				}
-				if !handled {
-					log.Printf("Unknown message from web to host: %#v", msg)
+			case msg, ok := <-hostRead: // messages from host
+				if !ok {
+					return
 				}
-			case msg := <-hostRead: // messages from host
-				handled, err := dispatchMessage(HostFromPlayer, msg, gameId, playerId, gs, ws, db, log)
+				handled, err := dispatchMessage(HostFromPlayer, HostFromPlayerDir, msg, gameId, playerId, gs, conn, db, log)
 				if err != nil {
 					log.Printf("Error while handling message from player to host: %#v", err)
 					return
@@ -164,33 +265,66 @@ func WebsocketHandler(r render.Render, w http.ResponseWriter, req *http.Request,
 				if !handled {
 					log.Printf("Unknown message from player to host: %#v", msg)
 				}
+			case request := <-requests: // action from the API, handled as if the browser sent it
+				tee := &teeConn{conn: conn}
+				_, err := dispatchMessage(HostFromWeb, HostFromWebDir, request.msg, gameId, playerId, gs, tee, db, log)
+				if err != nil {
+					log.Printf("Error while handling message from the API to host: %#v", err)
+					request.reply <- nil
+					return
+				}
+				request.reply <- tee.msgs
 			}
 		}
 	} else {
 		log.Printf("Player %v connected", playerId)
 
 		playerRead := gs.PlayerJoin(gameId, playerId)
-		defer gs.PlayerLeave(gameId, playerId)
-		defer PlayerLeave(playerId, gameId, gs, ws, db)
+		defer func() {
+			// stop taking messages before telling the host, so it isn't left sending to a phone that's gone, and
+			// don't tell it at all if the phone has already reconnected
+			if gs.PlayerLeave(gameId, playerId, playerRead) {
+				PlayerLeave(playerId, gameId, gs, conn, db)
+			}
+		}()
 
-		PlayerInit(playerId, gameId, gs, ws, db)
+		PlayerInit(playerId, gameId, gs, conn, db)
+
+		web := func(msg Message) bool {
+			handled, err := dispatchMessage(PlayerFromWeb, PlayerFromWebDir, msg, gameId, playerId, gs, conn, db, log)
+			if err != nil {
+				log.Printf("Error while handling message from web to player: %#v", err)
+				return false
+			}
+			if !handled {
+				log.Printf("Unknown message from web to player: %#v", msg)
+			}
+			return true
+		}
+		if first != nil && !web(first) {
+			return
+		}
 
 		for {
 			select {
-			case msg, ok := <-wsReadChan: // player website action
+			case msg, ok := <-read: // action from the browser
 				if !ok {
 					return
 				}
-				handled, err := dispatchMessage(PlayerFromWeb, msg, gameId, playerId, gs, ws, db, log)
-				if err != nil {
-					log.Printf("Error while handling message from web to player: %#v", err)
+				if msg["type"] == "hello" {
+					if !greet(msg, conn, log) {
+						return
+					}
+					continue
+				}
+				if !web(msg) {
 					return
 				}
-				if !handled {
-					log.Printf("Unknown message from web to player: %#v", msg)
+			case msg, ok := <-playerRead: // server side message from player to host
+				if !ok {
+					return
 				}
-			case msg := <-playerRead: // server side message from player to host
-				handled, err := dispatchMessage(PlayerFromHost, msg, gameId, playerId, gs, ws, db, log)
+				handled, err := dispatchMessage(PlayerFromHost, PlayerFromHostDir, msg, gameId, playerId, gs, conn, db, log)
 				if err != nil {
 					log.Printf("Error while handling message from host to player: %#v", err)
 					return
@@ -203,11 +337,23 @@ func WebsocketHandler(r render.Render, w http.ResponseWriter, req *http.Request,
 	}
 }
 
-func dispatchMessage(handleMap map[string]Action, msg Message, gameId string, playerId int, gs GameService, ws *websocket.Conn, db *gorp.DbMap, log *log.Logger) (bool, error) {
+func dispatchMessage(handleMap map[string]Action, direction string, msg Message, gameId string, playerId int, gs GameService, conn Conn, db *gorp.DbMap, log *log.Logger) (bool, error) {
+	// a missing event shouldn't end the game, so only complain about it
+	if err := logMessage(db, direction, gameId, playerId, msg); err != nil {
+		log.Printf("Failed to record %v message: %v", direction, err)
+	}
+	// what browsers send has to match the game's schema for it before any action sees it
+	if direction == HostFromWebDir || direction == PlayerFromWebDir {
+		if err := checkMessage(gameId, msg, db); err != nil {
+			conn.Send(Message{"type": "error", "message": err.Error()})
+			return true, nil
+		}
+	}
+
 	handled := false
 	for msgType, action := range handleMap {
 		if msgType == msg["type"] {
-			err := action(msg, gameId, playerId, gs, ws, db, log)
+			err := action(msg, gameId, playerId, gs, conn, db, log)
 			if err != nil {
 				return false, err
 			}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"log"
+	"net/http"
 	"os"
 	"testing"
 
@@ -24,7 +25,9 @@ func Test_NewGameHandler(t *testing.T) {
 		Game:   &Game{Id: "Hello"},
 		Player: &Player{Id: 1},
 	}
-	NewGameHandler(renderer, db, session, gameService, log)
+	params := martini.Params{"game": "tictactoe"}
+	req, _ := http.NewRequest("POST", "/new/tictactoe", nil)
+	NewGameHandler(renderer, params, req, db, session, gameService, log)
 
 	response := renderer.data.(Message)
 	if renderer.status != 200 || response["uuid"] != "Hello" {
@@ -54,7 +57,7 @@ func Test_GetGameHandler_Host(t *testing.T) {
 		return
 	}
 	if session.Get("player_id") != 1 {
-		t.Errorf("Didn't put player ID in session", session.Get("player_id"))
+		t.Errorf("Didn't put player ID in session: %#v", session.Get("player_id"))
 		return
 	}
 }
@@ -73,7 +76,7 @@ func Test_GetGameHandler_Player(t *testing.T) {
 		return
 	}
 	if session.Get("player_id") != 7 {
-		t.Errorf("Didn't put player ID in session", session.Get("player_id"))
+		t.Errorf("Didn't put player ID in session: %#v", session.Get("player_id"))
 		return
 	}
 }
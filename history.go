@@ -0,0 +1,169 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/coopernurse/gorp"
+	"github.com/martini-contrib/render"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// Someone who played in a game. For finished games this comes from the results, so it includes how they did.
+type Participant struct {
+	Id      int    `json:"id"`
+	Name    string `json:"name"`
+	Team    int    `json:"team"`
+	Outcome string `json:"outcome,omitempty"`
+}
+
+// the players of a game, as recorded in the results once it's finished or as currently in the lobby before that.
+// After rematches each player has a result for every game played, and is listed with the latest.
+func getParticipants(db *gorp.DbMap, game *Game) ([]*Participant, error) {
+	var participants []*Participant
+	var err error
+	if game.State == "finished" {
+		_, err = db.Select(&participants, `select players.id as id, players.name as name, results.team as team,
+			results.outcome as outcome from results join players on players.id = results.player
+			where results.id in (select max(id) from results where game=? group by player) order by players.id`, game.Id)
+	} else {
+		_, err = db.Select(&participants, "select id, name, team from players where game=? and role<>? order by id",
+			game.Id, Host)
+	}
+	if participants == nil {
+		participants = []*Participant{}
+	}
+	return participants, err
+}
+
+// a time for the UI, or nothing if it hasn't happened yet
+func historyTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+// a game as listed in the history, with who played and how it turned out
+func historyEntry(db *gorp.DbMap, game *Game) (Message, error) {
+	participants, err := getParticipants(db, game)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := Message{
+		"id":           game.Id,
+		"type":         game.Type,
+		"state":        game.State,
+		"teams":        game.Teams,
+		"party":        game.Party,
+		"rounds":       game.Rounds,
+		"created":      historyTime(game.Created),
+		"started":      historyTime(game.Started),
+		"finished":     historyTime(game.Finished),
+		"participants": participants,
+	}
+	if game.State == "finished" {
+		winners := []int{}
+		for _, p := range participants {
+			if p.Outcome == Win {
+				winners = append(winners, p.Id)
+			}
+		}
+		entry["winners"] = winners
+		entry["outcome"] = Draw
+		if len(winners) > 0 {
+			entry["outcome"] = Win
+		}
+	}
+	return entry, nil
+}
+
+// Lists past games, newest first. Filter with the player, type and state query parameters (state defaults to
+// finished, use all for every game) and page through them with page and per_page.
+func HistoryHandler(r render.Render, req *http.Request, db *gorp.DbMap, log *log.Logger) {
+	query := req.URL.Query()
+
+	page, perPage := 1, defaultPageSize
+	var err error
+	if p := query.Get("page"); p != "" {
+		page, err = strconv.Atoi(p)
+		if err != nil || page < 1 {
+			r.JSON(400, Message{"message": "`page` must be a positive number"})
+			return
+		}
+	}
+	if p := query.Get("per_page"); p != "" {
+		perPage, err = strconv.Atoi(p)
+		if err != nil || perPage < 1 || perPage > maxPageSize {
+			r.JSON(400, Message{"message": "`per_page` must be between 1 and 100"})
+			return
+		}
+	}
+
+	where := " where 1=1"
+	args := []interface{}{}
+	switch state := query.Get("state"); state {
+	case "all":
+	case "":
+		where += " and state=?"
+		args = append(args, "finished")
+	default:
+		where += " and state=?"
+		args = append(args, state)
+	}
+	if t := query.Get("type"); t != "" {
+		where += " and type=?"
+		args = append(args, t)
+	}
+	if p := query.Get("player"); p != "" {
+		playerId, err := strconv.Atoi(p)
+		if err != nil {
+			r.JSON(400, Message{"message": "`player` must be a player id"})
+			return
+		}
+		// players move from game to game, so the results are the only record of the games they have left
+		where += " and (id in (select game from results where player=?) or id in (select game from players where id=?))"
+		args = append(args, playerId, playerId)
+	}
+
+	total, err := db.SelectInt("select count(*) from games"+where, args...)
+	if err != nil {
+		log.Printf("Failed to count games: %v", err)
+		r.JSON(500, Message{"message": "Failed to get history"})
+		return
+	}
+
+	var games []*Game
+	_, err = db.Select(&games, "select * from games"+where+" order by created desc limit ? offset ?",
+		append(args, perPage, (page-1)*perPage)...)
+	if err != nil {
+		log.Printf("Failed to select games: %v", err)
+		r.JSON(500, Message{"message": "Failed to get history"})
+		return
+	}
+
+	entries := []Message{}
+	for _, game := range games {
+		entry, err := historyEntry(db, game)
+		if err != nil {
+			log.Printf("Failed to get participants of game %v: %v", game.Id, err)
+			r.JSON(500, Message{"message": "Failed to get history"})
+			return
+		}
+		entries = append(entries, entry)
+	}
+
+	r.JSON(200, Message{
+		"games":    entries,
+		"page":     page,
+		"per_page": perPage,
+		"total":    total,
+	})
+}
@@ -0,0 +1,929 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coopernurse/gorp"
+	"github.com/gorilla/websocket"
+)
+
+// how long a client waits for a message before failing the test
+const awaitTimeout = 5 * time.Second
+
+// A whole server running on a temporary database, for driving with real clients.
+type testServer struct {
+	*httptest.Server
+	t   *testing.T
+	dir string
+	db  *gorp.DbMap
+	gs  *GameServiceImpl
+}
+
+func startServer(t *testing.T) *testServer {
+	dir, err := ioutil.TempDir("", "game-server")
+	if err != nil {
+		t.Fatalf("Failed to make temp dir: %v", err)
+	}
+	return startServerWith(t, dir, NewMemoryFabric())
+}
+
+// starts a server on the database in the dir, which other servers may share, passing messages through the fabric
+func startServerWith(t *testing.T, dir string, fabric Fabric) *testServer {
+	s := &testServer{t: t, dir: dir}
+	s.db = initDb(filepath.Join(dir, "test.db"))
+	s.gs = &GameServiceImpl{Fabric: fabric}
+	s.Server = httptest.NewServer(newServer(s.db, s.gs))
+	return s
+}
+
+// a database of its own for a test, and how to close it and clear it away after
+func tempDb(t *testing.T) (*gorp.DbMap, func()) {
+	dir, err := ioutil.TempDir("", "game-server")
+	if err != nil {
+		t.Fatalf("Failed to make temp dir: %v", err)
+	}
+	db := initDb(filepath.Join(dir, "test.db"))
+	return db, func() {
+		db.Db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func (s *testServer) stop() {
+	s.Close()
+	s.db.Db.Close()
+	os.RemoveAll(s.dir)
+}
+
+// A browser, either the TV or a phone, with its own cookies so the session knows who it is.
+type testClient struct {
+	t      *testing.T
+	server *testServer
+	http   *http.Client
+	jar    http.CookieJar
+	ws     *websocket.Conn
+	codec  Codec // what the websocket speaks, JSON unless it's dialled with another subprotocol
+
+	// for phones without websockets, connected with one of listen or poll instead
+	gameId  string
+	events  chan Message
+	stream  io.Closer
+	polling bool
+	cursor  int
+	mailbox []Message
+}
+
+func (s *testServer) newClient() *testClient {
+	jar, _ := cookiejar.New(nil)
+	return &testClient{t: s.t, server: s, http: &http.Client{Jar: jar}, jar: jar, codec: jsonCodec{}}
+}
+
+// does a request and decodes the JSON response, failing the test if it isn't the status expected
+func (c *testClient) do(method, path string, status int) Message {
+	return c.doJSON(method, path, nil, status)
+}
+
+// does a request with a JSON body, unless the body is nil
+func (c *testClient) doJSON(method, path string, body Message, status int) Message {
+	var reader io.Reader
+	if body != nil {
+		bytes, _ := json.Marshal(body)
+		reader = strings.NewReader(string(bytes))
+	}
+	req, err := http.NewRequest(method, c.server.URL+path, reader)
+	if err != nil {
+		c.t.Fatalf("Bad request %v %v: %v", method, path, err)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		c.t.Fatalf("%v %v failed: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	msg := Message{}
+	err = json.NewDecoder(resp.Body).Decode(&msg)
+	if err != nil {
+		c.t.Fatalf("%v %v didn't return JSON: %v", method, path, err)
+	}
+	if resp.StatusCode != status {
+		c.t.Fatalf("%v %v returned %v, wanted %v: %#v", method, path, resp.StatusCode, status, msg)
+	}
+	return msg
+}
+
+// creates a game with this client as the host, and returns its id
+func (c *testClient) newGame(gameType string) string {
+	return c.newGameWith(gameType, nil)
+}
+
+func (c *testClient) newGameWith(gameType string, options Message) string {
+	msg := c.doJSON("POST", "/new/"+gameType, options, 200)
+	gameId, ok := msg["uuid"].(string)
+	if !ok {
+		c.t.Fatalf("New game has no uuid: %#v", msg)
+	}
+	return gameId
+}
+
+// does the same GET /game/:id the pages do so the session is set, then connects the websocket
+func (c *testClient) join(gameId string) {
+	c.do("GET", "/game/"+gameId, 200)
+	c.dial(gameId)
+}
+
+// connects the websocket with whatever the session already holds
+func (c *testClient) dial(gameId string) {
+	c.dialWith(gameId, "")
+}
+
+// connects the websocket asking for the codec of the subprotocol, unless it's empty
+func (c *testClient) dialWith(gameId, protocol string) {
+	u, _ := url.Parse(c.server.URL + "/ws/" + gameId)
+	header := http.Header{}
+	for _, cookie := range c.jar.Cookies(u) {
+		header.Add("Cookie", cookie.String())
+	}
+	u.Scheme = "ws"
+	dialer := &websocket.Dialer{}
+	if protocol != "" {
+		dialer.Subprotocols = []string{protocol}
+	}
+	ws, _, err := dialer.Dial(u.String(), header)
+	if err != nil {
+		c.t.Fatalf("Failed to connect websocket: %v", err)
+	}
+	if got := ws.Subprotocol(); got != protocol {
+		c.t.Fatalf("Asked for subprotocol %q, got %q", protocol, got)
+	}
+	c.ws = ws
+	if protocol != "" {
+		c.codec = Codecs[protocol]
+	}
+}
+
+// connects with server-sent events, as phones do when websockets are blocked
+func (c *testClient) listen(gameId string) {
+	c.do("GET", "/game/"+gameId, 200)
+	resp, err := c.http.Get(c.server.URL + "/sse/" + gameId)
+	if err != nil {
+		c.t.Fatalf("Failed to open event stream: %v", err)
+	}
+	if ct := resp.Header.Get("Content-Type"); resp.StatusCode != 200 || ct != "text/event-stream" {
+		c.t.Fatalf("Event stream returned %v %v", resp.StatusCode, ct)
+	}
+	c.gameId, c.stream, c.events = gameId, resp.Body, make(chan Message, 100)
+	go func() {
+		defer close(c.events)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if data := strings.TrimPrefix(scanner.Text(), "data: "); data != scanner.Text() {
+				msg := Message{}
+				json.Unmarshal([]byte(data), &msg)
+				c.events <- msg
+			}
+		}
+	}()
+}
+
+// connects by long-polling, as phones without server-sent events do
+func (c *testClient) poll(gameId string) {
+	c.do("GET", "/game/"+gameId, 200)
+	c.gameId, c.polling = gameId, true
+}
+
+func (c *testClient) send(msg Message) {
+	if c.ws == nil {
+		c.doJSON("POST", "/send/"+c.gameId, msg, 200)
+		return
+	}
+	err := writeMessage(c.ws, c.codec, msg)
+	if err != nil {
+		c.t.Fatalf("Failed to send %#v: %v", msg, err)
+	}
+}
+
+// reads messages until one of the given type arrives that also matches, which may be nil to take the first one
+func (c *testClient) await(msgType string, match func(Message) bool) Message {
+	for {
+		msg := c.next(msgType, time.Now().Add(awaitTimeout))
+		if msg["type"] == msgType && (match == nil || match(msg)) {
+			return msg
+		}
+	}
+}
+
+// the next message from the server, however the client is connected
+func (c *testClient) next(msgType string, deadline time.Time) Message {
+	switch {
+	case c.events != nil:
+		select {
+		case msg, ok := <-c.events:
+			if !ok {
+				c.t.Fatalf("Event stream closed waiting for %v message", msgType)
+			}
+			return msg
+		case <-time.After(deadline.Sub(time.Now())):
+			c.t.Fatalf("Timed out waiting for %v message", msgType)
+		}
+	case c.polling:
+		for len(c.mailbox) == 0 {
+			if time.Now().After(deadline) {
+				c.t.Fatalf("Timed out waiting for %v message", msgType)
+			}
+			resp := c.do("GET", fmt.Sprintf("/poll/%v?cursor=%v", c.gameId, c.cursor), 200)
+			msgs, _ := resp["messages"].([]interface{})
+			for _, m := range msgs {
+				c.mailbox = append(c.mailbox, Message(m.(map[string]interface{})))
+			}
+			c.cursor, _ = toInt(resp["cursor"])
+		}
+		msg := c.mailbox[0]
+		c.mailbox = c.mailbox[1:]
+		return msg
+	}
+	c.ws.SetReadDeadline(deadline)
+	msg, err := readMessage(c.ws, c.codec)
+	if err != nil {
+		c.t.Fatalf("Waiting for %v message: %v", msgType, err)
+	}
+	return msg
+}
+
+func (c *testClient) close() {
+	if c.ws != nil {
+		c.ws.Close()
+	}
+	if c.stream != nil {
+		c.stream.Close()
+	}
+}
+
+// a match for the players message with this many players in it
+func playerCount(n int) func(Message) bool {
+	return func(msg Message) bool {
+		players, _ := msg["players"].([]interface{})
+		return len(players) == n
+	}
+}
+
+// a match for the update message in the given state
+func inState(state string) func(Message) bool {
+	return func(msg Message) bool {
+		return msg["state"] == state
+	}
+}
+
+// A host with a lobby full of phones, ready to start.
+type testGame struct {
+	id      string
+	host    *testClient
+	players []*testClient
+}
+
+func (s *testServer) newGame(gameType string, players int) *testGame {
+	return s.newGameWith(gameType, nil, players)
+}
+
+func (s *testServer) newGameWith(gameType string, options Message, players int) *testGame {
+	g := &testGame{host: s.newClient()}
+	g.id = g.host.newGameWith(gameType, options)
+	g.host.join(g.id)
+	g.host.await("state", inState("lobby"))
+
+	for i := 0; i < players; i++ {
+		p := s.newClient()
+		p.join(g.id)
+		p.await("update", inState("lobby"))
+		g.players = append(g.players, p)
+	}
+	g.host.await("players", playerCount(players))
+	return g
+}
+
+// starts the game and waits for every phone to see the empty board
+func (g *testGame) start() {
+	g.host.send(Message{"type": "state", "state": "start"})
+	g.host.await("update", inState("start"))
+	for _, p := range g.players {
+		p.await("update", inState("start"))
+	}
+}
+
+// plays the game again once it's finished and waits for every phone to see the empty board
+func (g *testGame) rematch() {
+	g.host.send(Message{"type": "rematch"})
+	g.host.await("update", inState("start"))
+	for _, p := range g.players {
+		p.await("update", inState("start"))
+	}
+}
+
+// phones have to leave before the host, or they wait forever to tell it they've gone
+func (g *testGame) close() {
+	for _, p := range g.players {
+		p.close()
+	}
+	g.host.close()
+}
+
+func boardOf(t *testing.T, msg Message) []int {
+	board, ok := toInts(msg["board"])
+	if !ok {
+		t.Fatalf("Update has no board: %#v", msg)
+	}
+	return board
+}
+
+func Test_Integration_HostJoin(t *testing.T) {
+	s := startServer(t)
+	defer s.stop()
+
+	host := s.newClient()
+	gameId := host.newGame("tictactoe")
+	msg := host.do("GET", "/game/"+gameId, 200)
+	if msg["host"] != true {
+		t.Errorf("Game creator isn't the host: %#v", msg)
+	}
+
+	phone := s.newClient()
+	msg = phone.do("GET", "/game/"+gameId, 200)
+	if msg["host"] != false {
+		t.Errorf("Phone is the host: %#v", msg)
+	}
+}
+
+func Test_Integration_Join(t *testing.T) {
+	s := startServer(t)
+	defer s.stop()
+
+	host := s.newClient()
+	gameId := host.newGame("tictactoe")
+	msg := host.do("GET", "/game/"+gameId+"/join", 200)
+	if url, _ := msg["url"].(string); !strings.HasPrefix(url, "http://") || !strings.HasSuffix(url, "/tictactoe#/game/"+gameId) {
+		t.Errorf("Bad join link: %#v", msg)
+	}
+	host.do("GET", "/game/nope/join", 404)
+
+	for path, prefix := range map[string]string{"/qr.png": "\x89PNG", "/qr.svg": "<svg"} {
+		resp, err := host.http.Get(s.URL + "/game/" + gameId + path)
+		if err != nil {
+			t.Fatalf("GET %v failed: %v", path, err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != 200 || !strings.HasPrefix(string(body), prefix) {
+			t.Errorf("%v isn't a QR code: %v %q", path, resp.StatusCode, body)
+		}
+	}
+}
+
+// phones that can't use websockets play the same game with server-sent events or long-polling
+func Test_Integration_Fallback(t *testing.T) {
+	s := startServer(t)
+	defer s.stop()
+
+	g := s.newGame("tictactoe", 1)
+	defer g.close()
+	streamed, polled := s.newClient(), s.newClient()
+	streamed.listen(g.id)
+	streamed.await("update", inState("lobby"))
+	polled.poll(g.id)
+	polled.await("update", inState("lobby"))
+	g.players = append(g.players, streamed, polled)
+	g.host.await("players", playerCount(3))
+	g.start()
+
+	for i, p := range g.players {
+		p.send(Message{"type": "move", "move": i * 3})
+	}
+	full := func(msg Message) bool {
+		board, _ := toInts(msg["board"])
+		return len(board) == 9 && board[0] != 0 && board[3] != 0 && board[6] != 0
+	}
+	g.host.await("update", full)
+	for _, p := range g.players {
+		p.await("update", full)
+	}
+
+	// a poll without a session, or with a cursor that isn't one, is turned away
+	s.newClient().do("GET", "/poll/"+g.id, 401)
+	polled.do("GET", "/poll/"+g.id+"?cursor=next", 400)
+	polled.doJSON("POST", "/send/"+g.id, nil, 400)
+}
+
+// scripts play with plain requests, going through the same actions as the websocket
+func Test_Integration_HTTPAPI(t *testing.T) {
+	s := startServer(t)
+	defer s.stop()
+
+	g := s.newGame("tictactoe", 1)
+	defer g.close()
+	script := s.newClient()
+	script.do("GET", "/game/"+g.id, 200)
+	snapshot := script.do("GET", "/games/"+g.id+"/snapshot", 200)
+	if snapshot["state"] != "lobby" || snapshot["host"] != false {
+		t.Fatalf("Wrong snapshot of the lobby: %#v", snapshot)
+	}
+	cursor, _ := toInt(snapshot["cursor"])
+	g.start()
+
+	script.doJSON("POST", "/games/"+g.id+"/state", Message{"state": "finished"}, 403)
+	script.doJSON("POST", "/games/"+g.id+"/moves", Message{"move": 9}, 409)
+	script.doJSON("POST", "/games/"+g.id+"/moves", Message{"move": 4}, 200)
+	g.players[0].send(Message{"type": "move", "move": 0})
+	g.host.await("update", func(msg Message) bool {
+		board, _ := toInts(msg["board"])
+		return len(board) == 9 && board[0] != 0 && board[4] != 0
+	})
+
+	// without the host there's nobody to play the moves or take the changes
+	host := s.newClient()
+	absent := host.newGame("tictactoe")
+	host.doJSON("POST", "/games/"+absent+"/state", Message{"state": "start"}, 409)
+	loner := s.newClient()
+	loner.do("GET", "/game/"+absent, 200)
+	if msg := loner.doJSON("POST", "/games/"+absent+"/moves", Message{"move": 4}, 409); msg["message"] != "The host isn't connected" {
+		t.Errorf("Moving without a host got %#v", msg)
+	}
+
+	updates := script.do("GET", fmt.Sprintf("/games/%v/updates?cursor=%v", g.id, cursor), 200)
+	list, _ := updates["updates"].([]interface{})
+	if len(list) < 2 {
+		t.Fatalf("Wanted the start and the round as updates, got %#v", updates)
+	}
+	if board := boardOf(t, Message(list[len(list)-1].(map[string]interface{}))); board[0] == 0 || board[4] == 0 {
+		t.Errorf("Last update doesn't have the round on it: %v", board)
+	}
+	cursor, _ = toInt(updates["cursor"])
+	updates = script.do("GET", fmt.Sprintf("/games/%v/updates?cursor=%v", g.id, cursor), 200)
+	if list, _ := updates["updates"].([]interface{}); len(list) != 0 {
+		t.Errorf("Got updates again after the cursor: %#v", updates)
+	}
+
+	// the host's screen shows a change made through the API as if it had been made there
+	answer := g.host.doJSON("POST", "/games/"+g.id+"/state", Message{"state": "finished"}, 200)
+	if sent, _ := answer["messages"].([]interface{}); len(sent) == 0 {
+		t.Errorf("Changing the state didn't answer with what the host was sent: %#v", answer)
+	}
+	g.host.await("update", inState("finished"))
+}
+
+// a phone speaking MessagePack plays alongside ones speaking JSON
+func Test_Integration_Msgpack(t *testing.T) {
+	s := startServer(t)
+	defer s.stop()
+
+	g := s.newGame("tictactoe", 1)
+	defer g.close()
+	p := s.newClient()
+	p.do("GET", "/game/"+g.id, 200)
+	p.dialWith(g.id, "msgpack")
+	p.await("update", inState("lobby"))
+	g.players = append(g.players, p)
+	g.host.await("players", playerCount(2))
+	g.start()
+
+	g.players[0].send(Message{"type": "move", "move": 0})
+	p.send(Message{"type": "move", "move": 8})
+	full := func(msg Message) bool {
+		board, _ := toInts(msg["board"])
+		return len(board) == 9 && board[0] != 0 && board[8] != 0
+	}
+	g.host.await("update", full)
+	p.await("update", full)
+}
+
+// pages say which version they speak, and ones the server can't talk to are told to reload
+func Test_Integration_Hello(t *testing.T) {
+	s := startServer(t)
+	defer s.stop()
+
+	g := s.newGame("tictactoe", 2)
+	defer g.close()
+	current, old := g.players[0], g.players[1]
+
+	current.send(Message{"type": "hello", "version": protocolVersion, "capabilities": []string{"sse"}})
+	hello := current.await("hello", nil)
+	games, _ := hello["games"].([]interface{})
+	if v, _ := toInt(hello["version"]); v != protocolVersion || len(games) == 0 || games[0] != "tictactoe" {
+		t.Errorf("Wrong hello: %#v", hello)
+	}
+
+	old.send(Message{"type": "hello", "version": minProtocolVersion - 1})
+	if upgrade := old.await("error", nil); upgrade["upgrade"] != true {
+		t.Errorf("Old page wasn't told to upgrade: %#v", upgrade)
+	}
+	old.ws.SetReadDeadline(time.Now().Add(awaitTimeout))
+	for {
+		if _, _, err := old.ws.ReadMessage(); err != nil {
+			break // disconnected, as it should be
+		}
+	}
+	g.host.await("players", playerCount(1))
+
+	// the page that's up to date plays on
+	current.send(Message{"type": "move", "move": 4})
+
+	// pages that say hello as they connect hear back before they're sent any of the game
+	for _, version := range []int{protocolVersion, minProtocolVersion - 1} {
+		p := s.newClient()
+		p.do("GET", "/game/"+g.id, 200)
+		p.dial(g.id)
+		defer p.close()
+		p.send(Message{"type": "hello", "version": version})
+		msg := p.next("hello", time.Now().Add(awaitTimeout))
+		if version == protocolVersion && msg["type"] != "hello" {
+			t.Errorf("Hello should come before the game: %#v", msg)
+		}
+		if version < minProtocolVersion && (msg["type"] != "error" || msg["upgrade"] != true) {
+			t.Errorf("Upgrade should come before the game: %#v", msg)
+		}
+	}
+}
+
+// messages that don't match the game's schema never reach an action, and the schemas are there for the asking
+func Test_Integration_Schemas(t *testing.T) {
+	s := startServer(t)
+	defer s.stop()
+
+	g := s.newGame("tictactoe", 1)
+	defer g.close()
+	g.host.send(Message{"type": "state", "state": 5})
+	if msg := g.host.await("error", nil); msg["message"] != "`state` must be a string" {
+		t.Errorf("Wrong error for a bad state: %#v", msg)
+	}
+	g.players[0].send(Message{"type": "move"})
+	if msg := g.players[0].await("error", nil); msg["message"] != "Provide `move`" {
+		t.Errorf("Wrong error for a move without one: %#v", msg)
+	}
+	g.start()
+
+	doc := g.host.do("GET", "/schemas/tictactoe", 200)
+	definitions, _ := doc["definitions"].(map[string]interface{})
+	inbound, _ := definitions["inbound"].(map[string]interface{})
+	outbound, _ := definitions["outbound"].(map[string]interface{})
+	if inbound["move"] == nil || inbound["hello"] == nil || outbound["update"] == nil || outbound["error"] == nil {
+		t.Errorf("Schemas are missing messages: %#v", doc)
+	}
+	g.host.do("GET", "/schemas/chess", 404)
+}
+
+func Test_Integration_PlayRound(t *testing.T) {
+	s := startServer(t)
+	defer s.stop()
+
+	g := s.newGame("tictactoe", 3)
+	defer g.close()
+	g.start()
+
+	// three players each take a different corner
+	for i, p := range g.players {
+		p.send(Message{"type": "move", "move": i * 2})
+	}
+	update := g.host.await("update", nil)
+	board := boardOf(t, update)
+	for i := 0; i < 3; i++ {
+		if board[i*2] == 0 {
+			t.Errorf("Move %v didn't make it to the board: %v", i*2, board)
+		}
+	}
+	for _, p := range g.players {
+		if got := boardOf(t, p.await("update", nil)); got[0] != board[0] || got[2] != board[2] || got[4] != board[4] {
+			t.Errorf("Phone got a different board %v to the host %v", got, board)
+		}
+	}
+}
+
+func Test_Integration_Collision(t *testing.T) {
+	s := startServer(t)
+	defer s.stop()
+
+	g := s.newGame("tictactoe", 2)
+	defer g.close()
+	g.start()
+
+	for _, p := range g.players {
+		p.send(Message{"type": "move", "move": 4})
+	}
+	board := boardOf(t, g.host.await("update", nil))
+	if board[4] != 0 {
+		t.Errorf("Two players in the same cell should cancel out: %v", board)
+	}
+	for _, p := range g.players {
+		if msg := p.await("collision", nil); msg["outcome"] != "cancelled" {
+			t.Errorf("Phone wasn't told its move was cancelled: %#v", msg)
+		}
+	}
+}
+
+func Test_Integration_ContestedCollision(t *testing.T) {
+	s := startServer(t)
+	defer s.stop()
+
+	g := s.newGameWith("tictactoe", Message{"collisions": "contested"}, 2)
+	defer g.close()
+	g.start()
+
+	for _, p := range g.players {
+		p.send(Message{"type": "move", "move": 4})
+	}
+	board := boardOf(t, g.host.await("update", nil))
+	if board[4] != blockedCell {
+		t.Errorf("Contested cell should be blocked: %v", board)
+	}
+	for _, p := range g.players {
+		if msg := p.await("collision", nil); msg["outcome"] != "blocked" {
+			t.Errorf("Phone wasn't told the cell is blocked: %#v", msg)
+		}
+	}
+}
+
+func Test_Integration_Undo(t *testing.T) {
+	s := startServer(t)
+	defer s.stop()
+
+	g := s.newGame("tictactoe", 2)
+	defer g.close()
+	g.start()
+
+	g.host.send(Message{"type": "undo"})
+	g.host.await("error", nil)
+
+	g.players[0].send(Message{"type": "move", "move": 0})
+	g.players[1].send(Message{"type": "move", "move": 8})
+	board := boardOf(t, g.host.await("update", nil))
+	if board[0] == 0 || board[8] == 0 {
+		t.Fatalf("Round wasn't played: %v", board)
+	}
+
+	// the mis-tap is taken back, and both players move again before the round is played again
+	g.host.send(Message{"type": "undo"})
+	update := g.host.await("update", nil)
+	if board = boardOf(t, update); board[0] != 0 || board[8] != 0 || update["undone"] != float64(1) {
+		t.Errorf("Round wasn't undone: %#v", update)
+	}
+	g.players[1].send(Message{"type": "move", "move": 4})
+	g.players[0].send(Message{"type": "move", "move": 0})
+	board = boardOf(t, g.host.await("update", nil))
+	if board[0] == 0 || board[4] == 0 || board[8] != 0 {
+		t.Errorf("Round should be played again with the changed move: %v", board)
+	}
+}
+
+func Test_Integration_Pause(t *testing.T) {
+	s := startServer(t)
+	defer s.stop()
+
+	g := s.newGame("tictactoe", 1)
+	defer g.close()
+	g.start()
+	phone := g.players[0]
+
+	g.host.send(Message{"type": "pause"})
+	g.host.await("update", inState("paused"))
+	phone.await("update", inState("paused"))
+	phone.send(Message{"type": "move", "move": 4})
+	if msg := phone.await("error", nil); msg["message"] != "The game is paused" {
+		t.Errorf("Move while paused wasn't refused: %#v", msg)
+	}
+
+	// the pause lasts through the host reconnecting, and a move after resuming is played
+	g.host.close()
+	g.host.join(g.id)
+	g.host.await("update", inState("paused"))
+
+	g.host.send(Message{"type": "resume"})
+	phone.await("update", inState("start"))
+	phone.send(Message{"type": "move", "move": 4})
+	g.host.await("update", func(msg Message) bool {
+		board, _ := toInts(msg["board"])
+		return len(board) == 9 && board[4] != 0
+	})
+}
+
+func Test_Integration_Series(t *testing.T) {
+	s := startServer(t)
+	defer s.stop()
+
+	g := s.newGameWith("tictactoe", Message{"series": 3}, 1)
+	defer g.close()
+	phone := g.players[0]
+
+	// with nobody to stop them the phone wins by taking the top row, twice
+	win := func() Message {
+		for _, move := range []int{0, 1, 2} {
+			phone.send(Message{"type": "move", "move": move})
+			phone.await("update", nil)
+		}
+		g.host.await("update", inState("finished"))
+		return g.host.await("series", nil)
+	}
+	g.start()
+	series := win()
+	if series["over"] != false || len(series["games"].([]interface{})) != 1 {
+		t.Errorf("Series shouldn't be decided after one game: %#v", series)
+	}
+
+	g.rematch()
+	series = win()
+	if series["over"] != true || series["champion"] == float64(0) {
+		t.Errorf("Two wins should take a best of three: %#v", series)
+	}
+
+	// the next rematch starts another series
+	g.rematch()
+	if series = win(); series["series"] != float64(2) {
+		t.Errorf("Another series should have started: %#v", series)
+	}
+}
+
+// after a rematch the history lists each player once, with how the last game went, and the replay is of that game
+func Test_Integration_RematchHistory(t *testing.T) {
+	s := startServer(t)
+	defer s.stop()
+
+	g := s.newGame("tictactoe", 1)
+	defer g.close()
+	phone := g.players[0]
+	win := func() {
+		for _, move := range []int{0, 1, 2} {
+			phone.send(Message{"type": "move", "move": move})
+			phone.await("update", nil)
+		}
+		g.host.await("update", inState("finished"))
+	}
+	g.start()
+	win()
+	first, err := getReplay(s.db, g.id)
+	if err != nil {
+		t.Fatalf("No replay of the first game: %v", err)
+	}
+	g.rematch()
+	win()
+
+	history := g.host.do("GET", "/games", 200)
+	games, _ := history["games"].([]interface{})
+	if len(games) != 1 {
+		t.Fatalf("Expected the one game in the history, got %#v", history)
+	}
+	participants, _ := games[0].(map[string]interface{})["participants"].([]interface{})
+	if len(participants) != 1 || participants[0].(map[string]interface{})["outcome"] != Win {
+		t.Errorf("Expected the phone once, with its win: %#v", participants)
+	}
+
+	frames, err := getReplay(s.db, g.id)
+	if err != nil {
+		t.Fatalf("No replay of the rematch: %v", err)
+	}
+	if len(frames) != len(first) {
+		t.Errorf("The rematch was played the same as the first game, but replays %v frames to its %v", len(frames), len(first))
+	}
+	if board := boardOf(t, frameOf(t, frames[0])); board[0] != 0 {
+		t.Errorf("Replay of the rematch should start on an empty board: %v", board)
+	}
+}
+
+// the message an event recorded
+func frameOf(t *testing.T, e *Event) Message {
+	msg := Message{}
+	if err := json.Unmarshal([]byte(e.Payload), &msg); err != nil {
+		t.Fatalf("Event %v isn't a message: %v", e.Id, err)
+	}
+	return msg
+}
+
+// once a game is decided, moves are turned away rather than playing on and finishing it again
+func Test_Integration_MoveAfterFinish(t *testing.T) {
+	s := startServer(t)
+	defer s.stop()
+
+	g := s.newGame("tictactoe", 1)
+	defer g.close()
+	phone := g.players[0]
+
+	phone.send(Message{"type": "move", "move": 0})
+	if msg := phone.await("error", nil); msg["message"] != "The game isn't in play" {
+		t.Errorf("Move in the lobby got %#v", msg)
+	}
+
+	g.start()
+	for _, move := range []int{0, 1, 2} {
+		phone.send(Message{"type": "move", "move": move})
+		phone.await("update", nil)
+	}
+	g.host.await("update", inState("finished"))
+	results, err := s.db.SelectInt("select count(*) from results where Game=?", g.id)
+	if err != nil || results != 1 {
+		t.Fatalf("Wanted a result for the game, got %v: %v", results, err)
+	}
+
+	phone.send(Message{"type": "move", "move": 3})
+	if msg := phone.await("error", nil); msg["message"] != "The game isn't in play" {
+		t.Errorf("Move after the finish got %#v", msg)
+	}
+	if after, _ := s.db.SelectInt("select count(*) from results where Game=?", g.id); after != results {
+		t.Errorf("Moving after the finish recorded %v more results", after-results)
+	}
+}
+
+func Test_Integration_ClassicGame(t *testing.T) {
+	s := startServer(t)
+	defer s.stop()
+
+	g := s.newGameWith("tictactoe", Message{"mode": "classic"}, 0)
+	defer g.close()
+
+	// phones join one at a time so we know who sits where
+	ids := []float64{}
+	for i := 0; i < 3; i++ {
+		p := s.newClient()
+		p.join(g.id)
+		seats := g.host.await("seats", func(msg Message) bool {
+			queue, _ := msg["queue"].([]interface{})
+			return (i == 0 && msg["x"] != float64(0)) || (i == 1 && msg["o"] != float64(0)) || (i == 2 && len(queue) == 1)
+		})
+		switch i {
+		case 0:
+			ids = append(ids, seats["x"].(float64))
+		case 1:
+			ids = append(ids, seats["o"].(float64))
+		case 2:
+			ids = append(ids, seats["queue"].([]interface{})[0].(float64))
+		}
+		g.players = append(g.players, p)
+	}
+	g.start()
+	x, o, challenger := g.players[0], g.players[1], g.players[2]
+	x.await("turn", nil)
+	if msg := challenger.await("wait", nil); msg["place"] != float64(1) {
+		t.Errorf("Challenger should be first in line: %#v", msg)
+	}
+
+	// a phone that drops out mid-game keeps its seat, and its turn, for when it's back
+	x.close()
+	x.dial(g.id)
+	back := g.host.await("seats", nil)
+	if queue, _ := back["queue"].([]interface{}); back["x"] != ids[0] || back["turn"] != ids[0] || len(queue) != 1 || queue[0] != ids[2] {
+		t.Errorf("X lost their seat by reconnecting: %#v", back)
+	}
+	x.await("turn", nil)
+
+	o.send(Message{"type": "move", "move": 3})
+	if msg := o.await("error", nil); msg["message"] != "It's not your turn" {
+		t.Errorf("O moved out of turn: %#v", msg)
+	}
+
+	// X takes the top row
+	var update Message
+	for i, move := range []int{0, 3, 1, 4, 2} {
+		p := x
+		if i%2 == 1 {
+			p = o
+		}
+		p.send(Message{"type": "move", "move": move})
+		update = g.host.await("update", nil)
+	}
+	if update["state"] != "finished" || update["winner"] != ids[0] {
+		t.Errorf("X should have won: %#v", update)
+	}
+
+	// winner stays on, and the challenger gets the first move of the next game
+	seats := g.host.await("seats", nil)
+	queue, _ := seats["queue"].([]interface{})
+	if seats["x"] != ids[2] || seats["o"] != ids[0] || len(queue) != 1 || queue[0] != ids[1] {
+		t.Errorf("Seats didn't rotate: %#v", seats)
+	}
+	g.start()
+	challenger.await("turn", nil)
+}
+
+func Test_Integration_Events(t *testing.T) {
+	s := startServer(t)
+	defer s.stop()
+
+	g := s.newGame("tictactoe", 1)
+	defer g.close()
+	g.start()
+
+	msg := g.host.do("GET", "/games/"+g.id+"/events?kind=state", 200)
+	events, _ := msg["events"].([]interface{})
+	var states []string
+	for _, e := range events {
+		states = append(states, e.(map[string]interface{})["type"].(string))
+	}
+	if strings.Join(states, ",") != "lobby,start" {
+		t.Errorf("Expected the game to go from lobby to start, got %v", states)
+	}
+}
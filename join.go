@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/codegangsta/martini"
+	"github.com/coopernurse/gorp"
+	"github.com/martini-contrib/render"
+	"rsc.io/qr"
+)
+
+// JoinAddress is the host:port phones on the local network reach this server at.
+type JoinAddress string
+
+// The address to put in join links. It's the one given if there is one, otherwise the first IPv4 address of the
+// machine that isn't loopback, with the port martini listens on.
+func joinAddress(configured string) JoinAddress {
+	if configured != "" {
+		return JoinAddress(configured)
+	}
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "3000"
+	}
+	host := "localhost"
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Printf("Couldn't look up this machine's addresses: %v", err)
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if ok && ipnet.IP.To4() != nil && !ipnet.IP.IsLoopback() && !ipnet.IP.IsLinkLocalUnicast() {
+			host = ipnet.IP.String()
+			break
+		}
+	}
+	return JoinAddress(net.JoinHostPort(host, port))
+}
+
+// the page phones open to join a game
+func joinURL(addr JoinAddress, game *Game) string {
+	return "http://" + string(addr) + "/" + game.Type + "#/game/" + game.Id
+}
+
+// the game a join link is for, or nil if there's no such game, in which case the response has been written
+func joinGame(r render.Render, params martini.Params, db *gorp.DbMap) *Game {
+	obj, err := db.Get(Game{}, params["id"])
+	if err != nil || obj == nil {
+		r.JSON(404, Message{"message": "No such game"})
+		return nil
+	}
+	game := obj.(*Game)
+	if game.State == "expired" {
+		r.JSON(410, Message{"type": "ended", "message": "This game has ended"})
+		return nil
+	}
+	return game
+}
+
+// returns the link phones join a game with, and where to get it as a QR code for the TV to show
+func JoinHandler(r render.Render, params martini.Params, db *gorp.DbMap, addr JoinAddress) {
+	game := joinGame(r, params, db)
+	if game == nil {
+		return
+	}
+	r.JSON(200, Message{
+		"url":    joinURL(addr, game),
+		"qr_png": "/game/" + game.Id + "/qr.png",
+		"qr_svg": "/game/" + game.Id + "/qr.svg",
+	})
+}
+
+// the join link as a QR code, or nil if it couldn't be made, in which case the response has been written
+func joinCode(r render.Render, params martini.Params, db *gorp.DbMap, addr JoinAddress, log *log.Logger) *qr.Code {
+	game := joinGame(r, params, db)
+	if game == nil {
+		return nil
+	}
+	code, err := qr.Encode(joinURL(addr, game), qr.M)
+	if err != nil {
+		log.Printf("Couldn't make QR code for game %v: %v", game.Id, err)
+		r.JSON(500, Message{"message": "Couldn't make QR code"})
+		return nil
+	}
+	return code
+}
+
+func QRPNGHandler(r render.Render, w http.ResponseWriter, params martini.Params, db *gorp.DbMap, addr JoinAddress, log *log.Logger) {
+	if code := joinCode(r, params, db, addr, log); code != nil {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(code.PNG())
+	}
+}
+
+func QRSVGHandler(r render.Render, w http.ResponseWriter, params martini.Params, db *gorp.DbMap, addr JoinAddress, log *log.Logger) {
+	if code := joinCode(r, params, db, addr, log); code != nil {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write(qrSVG(code))
+	}
+}
+
+// draws the code a square per module, with the border of four modules scanners need around it
+func qrSVG(code *qr.Code) []byte {
+	const border = 4
+	size := code.Size + 2*border
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size)
+	fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, size, size)
+	for y := 0; y < code.Size; y++ {
+		for x := 0; x < code.Size; x++ {
+			if code.Black(x, y) {
+				fmt.Fprintf(&b, "M%d %dh1v1h-1z", x+border, y+border)
+			}
+		}
+	}
+	b.WriteString(`"/></svg>`)
+	return b.Bytes()
+}
@@ -0,0 +1,305 @@
+// Command loadtest plays many games of tic-tac-toe against a running server at once, the way a room full of
+// phones would, and reports how long moves took to come back as board updates.
+//
+//	go run ./loadtest -addr localhost:3000 -games 50 -players 4
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type Message map[string]interface{}
+
+var (
+	addr        = flag.String("addr", "localhost:3000", "address of the server to test")
+	games       = flag.Int("games", 10, "number of games to play")
+	players     = flag.Int("players", 3, "number of phones in each game")
+	rounds      = flag.Int("rounds", 9, "most rounds to play in each game, games that finish sooner stop early")
+	concurrency = flag.Int("concurrency", 10, "number of games to play at the same time")
+	script      = flag.String("script", "", "comma separated cells the players try in order, instead of random ones")
+	timeout     = flag.Duration("timeout", 10*time.Second, "how long to wait for any one message before giving up")
+)
+
+// Everything measured while the games were played.
+type results struct {
+	sync.Mutex
+	latencies []time.Duration // from a phone sending a move to it seeing the board update
+	moves     int
+	games     int
+	errors    map[string]int
+}
+
+func (r *results) move(latency time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+	r.latencies = append(r.latencies, latency)
+	r.moves++
+}
+
+func (r *results) fail(err error) {
+	r.Lock()
+	defer r.Unlock()
+	r.errors[err.Error()]++
+}
+
+// a client is one browser: it keeps its own cookies so the server's session knows who it is
+type client struct {
+	http *http.Client
+	jar  http.CookieJar
+	ws   *websocket.Conn
+}
+
+func newClient() *client {
+	jar, _ := cookiejar.New(nil)
+	return &client{http: &http.Client{Jar: jar, Timeout: *timeout}, jar: jar}
+}
+
+// does a request and decodes the JSON response
+func (c *client) do(method, path string) (Message, error) {
+	req, err := http.NewRequest(method, "http://"+*addr+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("%v %v returned %v", method, path, resp.StatusCode)
+	}
+	msg := Message{}
+	err = json.NewDecoder(resp.Body).Decode(&msg)
+	return msg, err
+}
+
+// does the same GET /game/:id the pages do so the session is set, then opens the websocket
+func (c *client) connect(gameId string) error {
+	_, err := c.do("GET", "/game/"+gameId)
+	if err != nil {
+		return err
+	}
+
+	u := &url.URL{Scheme: "http", Host: *addr, Path: "/ws/" + gameId}
+	header := http.Header{}
+	for _, cookie := range c.jar.Cookies(u) {
+		header.Add("Cookie", cookie.String())
+	}
+	u.Scheme = "ws"
+	dialer := &websocket.Dialer{HandshakeTimeout: *timeout}
+	c.ws, _, err = dialer.Dial(u.String(), header)
+	return err
+}
+
+// reads messages until one of the given type arrives
+func (c *client) await(msgType string) (Message, error) {
+	for {
+		c.ws.SetReadDeadline(time.Now().Add(*timeout))
+		msg := Message{}
+		err := c.ws.ReadJSON(&msg)
+		if err != nil {
+			return nil, err
+		}
+		if msg["type"] == "error" {
+			return nil, fmt.Errorf("server error: %v", msg["message"])
+		}
+		if msg["type"] == msgType {
+			return msg, nil
+		}
+	}
+}
+
+func (c *client) close() {
+	if c.ws != nil {
+		c.ws.Close()
+	}
+}
+
+// picks the next cell for a phone to try, from the script or at random
+func pickMove(board []interface{}, tried int, cells []int) int {
+	if len(cells) > 0 {
+		return cells[tried%len(cells)]
+	}
+	empty := []int{}
+	for i, v := range board {
+		if v.(float64) == 0 {
+			empty = append(empty, i)
+		}
+	}
+	if len(empty) == 0 {
+		return 0
+	}
+	return empty[rand.Intn(len(empty))]
+}
+
+// plays a single game from the lobby until it finishes or runs out of rounds
+func play(res *results, cells []int) error {
+	host := newClient()
+	defer host.close()
+
+	msg, err := host.do("POST", "/new/tictactoe")
+	if err != nil {
+		return err
+	}
+	gameId, _ := msg["uuid"].(string)
+	if err = host.connect(gameId); err != nil {
+		return err
+	}
+
+	phones := make([]*client, *players)
+	for i := range phones {
+		phones[i] = newClient()
+		defer phones[i].close()
+		if err = phones[i].connect(gameId); err != nil {
+			return err
+		}
+	}
+
+	// wait for the lobby to show everyone before starting
+	for {
+		msg, err = host.await("players")
+		if err != nil {
+			return err
+		}
+		if list, _ := msg["players"].([]interface{}); len(list) == *players {
+			break
+		}
+	}
+	err = host.ws.WriteJSON(Message{"type": "state", "state": "start"})
+	if err != nil {
+		return err
+	}
+	// nobody is watching the TV, but keep reading so the server never blocks writing to it
+	go func() {
+		for {
+			if _, _, err := host.ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// every phone plays in its own goroutine, the round ends when they've all seen the update
+	var wg sync.WaitGroup
+	errs := make(chan error, len(phones))
+	for _, phone := range phones {
+		wg.Add(1)
+		go func(phone *client) {
+			defer wg.Done()
+			update, err := phone.await("update")
+			for err == nil && update["state"] == "lobby" {
+				update, err = phone.await("update")
+			}
+			for round := 0; err == nil && round < *rounds && update["state"] == "start"; round++ {
+				board, _ := update["board"].([]interface{})
+				sent := time.Now()
+				err = phone.ws.WriteJSON(Message{"type": "move", "move": pickMove(board, round, cells)})
+				if err != nil {
+					break
+				}
+				update, err = phone.await("update")
+				if err == nil {
+					res.move(time.Since(sent))
+				}
+			}
+			if err != nil {
+				errs <- err
+			}
+		}(phone)
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return err
+	}
+	return nil
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted)-1) * p)
+	return sorted[i]
+}
+
+func main() {
+	flag.Parse()
+
+	var cells []int
+	if *script != "" {
+		for _, s := range strings.Split(*script, ",") {
+			cell, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil || cell < 0 {
+				log.Fatalf("Bad cell in script: %q", s)
+			}
+			cells = append(cells, cell)
+		}
+	}
+
+	res := &results{errors: map[string]int{}}
+	work := make(chan bool)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range work {
+				err := play(res, cells)
+				if err != nil {
+					res.fail(err)
+					continue
+				}
+				res.Lock()
+				res.games++
+				res.Unlock()
+			}
+		}()
+	}
+	for i := 0; i < *games; i++ {
+		work <- true
+	}
+	close(work)
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	sort.Sort(durations(res.latencies))
+	roundsPlayed := res.moves / *players
+	fmt.Printf("Played %v of %v games with %v phones each in %v\n", res.games, *games, *players, elapsed)
+	fmt.Printf("Throughput: %.1f moves/s, %.1f rounds/s, %.2f games/s\n",
+		float64(res.moves)/elapsed.Seconds(), float64(roundsPlayed)/elapsed.Seconds(), float64(res.games)/elapsed.Seconds())
+	fmt.Printf("Move latency: p50 %v, p90 %v, p99 %v, max %v\n",
+		percentile(res.latencies, 0.5), percentile(res.latencies, 0.9), percentile(res.latencies, 0.99),
+		percentile(res.latencies, 1))
+
+	failed := 0
+	for msg, count := range res.errors {
+		fmt.Printf("Error (%v times): %v\n", count, msg)
+		failed += count
+	}
+	if failed > 0 {
+		fmt.Printf("%v games failed\n", failed)
+		os.Exit(1)
+	}
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coopernurse/gorp"
+)
+
+// Servers advertise themselves on the local network with multicast DNS service discovery (RFC 6762 and 6763), so
+// apps and other servers can find them without anyone typing in an address.
+const (
+	mdnsAddr       = "224.0.0.251:5353"
+	serviceType    = "_gameserver._tcp.local."
+	servicesLookup = "_services._dns-sd._udp.local."
+	mdnsTTL        = 120 // seconds
+	// the most games listed in a server's TXT record, any more and the answer won't fit in a packet
+	maxAdvertisedGames = 8
+	// the biggest mDNS packet there can be (RFC 6762 section 17), and the longest name in one
+	maxPacket = 9000
+	maxName   = 255
+)
+
+const (
+	typeA   = 1
+	typePTR = 12
+	typeTXT = 16
+	typeSRV = 33
+	typeANY = 255
+
+	classIN    = 1
+	cacheFlush = 0x8000 // set on records only this server answers for
+	unicastQU  = 0x8000 // set on questions that want the answer sent straight back
+)
+
+// Advertiser answers queries for this server from anyone on the network looking for game servers.
+type Advertiser struct {
+	Instance string          // name of this server, which people pick it by
+	Host     string          // the host name of the machine, without .local
+	IP       net.IP          // IPv4 address phones reach the server at
+	Port     int             // port the server listens on
+	Games    func() []string // the games that can be joined right now
+}
+
+func (a *Advertiser) instanceName() string {
+	return escapeLabel(a.Instance) + "." + serviceType
+}
+
+func (a *Advertiser) hostName() string {
+	return a.Host + ".local."
+}
+
+// Serve answers queries that come in on conn until it's closed. Queries from port 5353 are answered to the whole
+// network, others are from simple resolvers waiting for the answer to come straight back (RFC 6762 section 6.7).
+func (a *Advertiser) Serve(conn net.PacketConn) error {
+	group, err := net.ResolveUDPAddr("udp4", mdnsAddr)
+	if err != nil {
+		return err
+	}
+	// a byte more than the biggest packet, so one that's bigger still is seen to be and refused
+	buf := make([]byte, maxPacket+1)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		query, err := parseDNS(buf[:n])
+		if err != nil || query.response {
+			continue
+		}
+		answers, additional := a.answer(query.questions)
+		if len(answers) == 0 {
+			continue
+		}
+
+		to, legacy := from, true
+		if udp, ok := from.(*net.UDPAddr); ok && udp.Port == 5353 {
+			legacy = false
+			if !query.questions[0].unicast {
+				to = group
+			}
+		}
+		reply := dnsMessage{id: query.id, response: true, answers: answers, additional: additional}
+		if legacy {
+			reply.questions = query.questions
+		}
+		if _, err = conn.WriteTo(reply.pack(), to); err != nil {
+			log.Printf("Couldn't answer mDNS query from %v: %v", from, err)
+		}
+	}
+}
+
+// Announce tells everyone listening on the network that this server is here, as it starts up.
+func (a *Advertiser) Announce(conn net.PacketConn) error {
+	group, err := net.ResolveUDPAddr("udp4", mdnsAddr)
+	if err != nil {
+		return err
+	}
+	answers, additional := a.answer([]dnsQuestion{{name: serviceType, rrtype: typePTR}})
+	msg := dnsMessage{response: true, answers: append(answers, additional...)}
+	_, err = conn.WriteTo(msg.pack(), group)
+	return err
+}
+
+// the records answering the questions, and the ones that go along with them so nobody has to ask again
+func (a *Advertiser) answer(questions []dnsQuestion) ([]dnsRecord, []dnsRecord) {
+	instance, host := a.instanceName(), a.hostName()
+	ptr := dnsRecord{name: serviceType, rrtype: typePTR, data: packName(instance)}
+	srv := dnsRecord{name: instance, rrtype: typeSRV, unique: true, data: srvData(a.Port, host)}
+	txt := dnsRecord{name: instance, rrtype: typeTXT, unique: true, data: txtData(a.text())}
+	addrs := []dnsRecord{}
+	if ip := a.IP.To4(); ip != nil {
+		addrs = append(addrs, dnsRecord{name: host, rrtype: typeA, unique: true, data: ip})
+	}
+
+	var answers, additional []dnsRecord
+	for _, q := range questions {
+		wants := func(rrtype uint16) bool { return q.rrtype == rrtype || q.rrtype == typeANY }
+		switch {
+		case sameName(q.name, servicesLookup) && wants(typePTR):
+			answers = append(answers, dnsRecord{name: servicesLookup, rrtype: typePTR, data: packName(serviceType)})
+		case sameName(q.name, serviceType) && wants(typePTR):
+			answers = append(answers, ptr)
+			additional = append(append(additional, srv, txt), addrs...)
+		case sameName(q.name, instance):
+			if wants(typeSRV) {
+				answers = append(answers, srv)
+			}
+			if wants(typeTXT) {
+				answers = append(answers, txt)
+			}
+			additional = append(additional, addrs...)
+		case sameName(q.name, host) && wants(typeA):
+			answers = append(answers, addrs...)
+		}
+	}
+	return answers, additional
+}
+
+// the TXT record: the server's version, how many games there are and the first few of them
+func (a *Advertiser) text() []string {
+	games := []string{}
+	if a.Games != nil {
+		games = a.Games()
+	}
+	text := []string{"version=" + strconv.Itoa(protocolVersion), "games=" + strconv.Itoa(len(games))}
+	for i, g := range games {
+		if i == maxAdvertisedGames {
+			break
+		}
+		text = append(text, fmt.Sprintf("g%v=%v", i+1, g))
+	}
+	return text
+}
+
+// the games that can still be joined, newest first
+func joinableGames(db *gorp.DbMap) func() []string {
+	return func() []string {
+		var games []string
+		_, err := db.Select(&games, "select Id from games where State in ('lobby', 'start', 'paused') order by Created desc")
+		if err != nil {
+			log.Printf("Couldn't list games to advertise: %v", err)
+		}
+		return games
+	}
+}
+
+// Advertises this server on the local network for as long as it runs, reachable at the join address.
+func advertise(db *gorp.DbMap, addr JoinAddress) {
+	host, port, err := net.SplitHostPort(string(addr))
+	if err != nil {
+		log.Printf("Can't advertise at %v: %v", addr, err)
+		return
+	}
+	a := &Advertiser{IP: net.ParseIP(host), Games: joinableGames(db)}
+	a.Port, _ = strconv.Atoi(port)
+	a.Host, err = os.Hostname()
+	if err != nil {
+		a.Host = "game-server"
+	}
+	a.Host = strings.Split(a.Host, ".")[0]
+	a.Instance = "Game server on " + a.Host
+
+	group, err := net.ResolveUDPAddr("udp4", mdnsAddr)
+	if err != nil {
+		log.Printf("Bad mDNS address: %v", err)
+		return
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		log.Printf("Can't advertise on the network: %v", err)
+		return
+	}
+	if err = a.Announce(conn); err != nil {
+		log.Printf("Couldn't announce server: %v", err)
+	}
+	log.Printf("Advertising %q on the network", a.Instance)
+	log.Printf("Stopped advertising: %v", a.Serve(conn))
+}
+
+// Service is a server found on the network.
+type Service struct {
+	Instance string
+	Host     string
+	Port     int
+	IPs      []net.IP
+	Text     map[string]string
+}
+
+// Browse asks for game servers at the given address, the mDNS group to ask the whole network, and returns what
+// answers within the timeout.
+func Browse(conn net.PacketConn, to net.Addr, timeout time.Duration) ([]*Service, error) {
+	query := dnsMessage{id: 1, questions: []dnsQuestion{{name: serviceType, rrtype: typePTR}}}
+	if _, err := conn.WriteTo(query.pack(), to); err != nil {
+		return nil, err
+	}
+
+	found := map[string]*Service{}
+	service := func(name string) *Service {
+		if found[name] == nil {
+			instance := strings.TrimSuffix(name, "."+serviceType)
+			found[name] = &Service{Instance: unescapeLabel(instance), Text: map[string]string{}}
+		}
+		return found[name]
+	}
+	hosts := map[string][]net.IP{}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, maxPacket+1)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		msg, err := parseDNS(buf[:n])
+		if err != nil || !msg.response {
+			continue
+		}
+		for _, r := range append(msg.answers, msg.additional...) {
+			switch r.rrtype {
+			case typePTR:
+				if sameName(r.name, serviceType) {
+					if name, _, err := readName(r.msg, r.off); err == nil {
+						service(name)
+					}
+				}
+			case typeSRV:
+				if len(r.data) > 6 {
+					s := service(r.name)
+					s.Port = int(binary.BigEndian.Uint16(r.data[4:]))
+					s.Host, _, _ = readName(r.msg, r.off+6)
+				}
+			case typeTXT:
+				s := service(r.name)
+				for _, kv := range readText(r.data) {
+					parts := strings.SplitN(kv, "=", 2)
+					if len(parts) == 2 {
+						s.Text[parts[0]] = parts[1]
+					}
+				}
+			case typeA:
+				if len(r.data) == 4 {
+					ip := net.IP(append([]byte{}, r.data...)) // the buffer is read into again
+					hosts[strings.ToLower(r.name)] = append(hosts[strings.ToLower(r.name)], ip)
+				}
+			}
+		}
+	}
+
+	services := []*Service{}
+	for _, s := range found {
+		s.IPs = hosts[strings.ToLower(s.Host)]
+		services = append(services, s)
+	}
+	return services, nil
+}
+
+// DNS messages, just as much of them as service discovery needs
+
+type dnsQuestion struct {
+	name    string
+	rrtype  uint16
+	unicast bool
+}
+
+type dnsRecord struct {
+	name   string
+	rrtype uint16
+	unique bool
+	data   []byte
+	// where the data is in the message it came in, since names in it may point elsewhere in the message
+	msg []byte
+	off int
+}
+
+type dnsMessage struct {
+	id         uint16
+	response   bool
+	questions  []dnsQuestion
+	answers    []dnsRecord
+	additional []dnsRecord
+}
+
+func (m dnsMessage) pack() []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint16(b, m.id)
+	if m.response {
+		binary.BigEndian.PutUint16(b[2:], 0x8400) // a response, with authority
+	}
+	binary.BigEndian.PutUint16(b[4:], uint16(len(m.questions)))
+	binary.BigEndian.PutUint16(b[6:], uint16(len(m.answers)))
+	binary.BigEndian.PutUint16(b[10:], uint16(len(m.additional)))
+	for _, q := range m.questions {
+		class := uint16(classIN)
+		if q.unicast {
+			class |= unicastQU
+		}
+		b = append(b, packName(q.name)...)
+		b = appendUint16(b, q.rrtype, class)
+	}
+	for _, r := range append(m.answers, m.additional...) {
+		class := uint16(classIN)
+		if r.unique {
+			class |= cacheFlush
+		}
+		b = append(b, packName(r.name)...)
+		b = appendUint16(b, r.rrtype, class)
+		b = append(b, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(b[len(b)-4:], mdnsTTL)
+		b = appendUint16(b, uint16(len(r.data)))
+		b = append(b, r.data...)
+	}
+	return b
+}
+
+var errBadDNS = errors.New("malformed DNS message")
+
+func parseDNS(b []byte) (*dnsMessage, error) {
+	if len(b) < 12 || len(b) > maxPacket {
+		return nil, errBadDNS
+	}
+	m := &dnsMessage{id: binary.BigEndian.Uint16(b), response: b[2]&0x80 != 0}
+	counts := []int{
+		int(binary.BigEndian.Uint16(b[4:])),
+		int(binary.BigEndian.Uint16(b[6:])),
+		int(binary.BigEndian.Uint16(b[8:])) + int(binary.BigEndian.Uint16(b[10:])),
+	}
+	off := 12
+	for i := 0; i < counts[0]; i++ {
+		name, next, err := readName(b, off)
+		if err != nil || next+4 > len(b) {
+			return nil, errBadDNS
+		}
+		class := binary.BigEndian.Uint16(b[next+2:])
+		m.questions = append(m.questions, dnsQuestion{
+			name:    name,
+			rrtype:  binary.BigEndian.Uint16(b[next:]),
+			unicast: class&unicastQU != 0,
+		})
+		off = next + 4
+	}
+	for i := 0; i < counts[1]+counts[2]; i++ {
+		name, next, err := readName(b, off)
+		if err != nil || next+10 > len(b) {
+			return nil, errBadDNS
+		}
+		length := int(binary.BigEndian.Uint16(b[next+8:]))
+		start := next + 10
+		if start+length > len(b) {
+			return nil, errBadDNS
+		}
+		r := dnsRecord{
+			name:   name,
+			rrtype: binary.BigEndian.Uint16(b[next:]),
+			unique: binary.BigEndian.Uint16(b[next+2:])&cacheFlush != 0,
+			data:   b[start : start+length],
+			msg:    b,
+			off:    start,
+		}
+		if i < counts[1] {
+			m.answers = append(m.answers, r)
+		} else {
+			m.additional = append(m.additional, r)
+		}
+		off = start + length
+	}
+	return m, nil
+}
+
+// reads the name at off, following pointers to names earlier in the message, and returns where it ends. Pointers
+// have to go back, so following them always ends.
+func readName(b []byte, off int) (string, int, error) {
+	labels := []string{}
+	end, length := -1, 0
+	for {
+		if off >= len(b) {
+			return "", 0, errBadDNS
+		}
+		n := int(b[off])
+		switch {
+		case n == 0:
+			if end == -1 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case n&0xc0 == 0xc0:
+			if off+1 >= len(b) {
+				return "", 0, errBadDNS
+			}
+			to := int(binary.BigEndian.Uint16(b[off:]) & 0x3fff)
+			if to >= off {
+				return "", 0, errBadDNS
+			}
+			if end == -1 {
+				end = off + 2
+			}
+			off = to
+		default:
+			length += 1 + n
+			if off+1+n > len(b) || length > maxName {
+				return "", 0, errBadDNS
+			}
+			labels = append(labels, escapeLabel(string(b[off+1:off+1+n])))
+			off += 1 + n
+		}
+	}
+}
+
+// writes a name as labels, without pointers. Dots escaped with a backslash are part of a label.
+func packName(name string) []byte {
+	b := []byte{}
+	label := []byte{}
+	for i := 0; i < len(name); i++ {
+		switch {
+		case name[i] == '\\' && i+1 < len(name):
+			i++
+			label = append(label, name[i])
+		case name[i] == '.':
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+			label = label[:0]
+		default:
+			label = append(label, name[i])
+		}
+	}
+	if len(label) > 0 {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// escapes the dots and backslashes in a label, so instance names like "Jake's TV v1.0" survive
+func escapeLabel(label string) string {
+	return strings.NewReplacer(`\`, `\\`, ".", `\.`).Replace(label)
+}
+
+func unescapeLabel(label string) string {
+	return strings.NewReplacer(`\\`, `\`, `\.`, ".").Replace(label)
+}
+
+func sameName(a, b string) bool {
+	return strings.EqualFold(a, b)
+}
+
+func srvData(port int, target string) []byte {
+	b := appendUint16(nil, 0, 0, uint16(port)) // priority and weight don't matter with one server
+	return append(b, packName(target)...)
+}
+
+func txtData(text []string) []byte {
+	b := []byte{}
+	for _, s := range text {
+		if len(s) > 255 {
+			s = s[:255]
+		}
+		b = append(b, byte(len(s)))
+		b = append(b, s...)
+	}
+	return b
+}
+
+func readText(b []byte) []string {
+	text := []string{}
+	for len(b) > 0 {
+		n := int(b[0])
+		if 1+n > len(b) {
+			break
+		}
+		text = append(text, string(b[1:1+n]))
+		b = b[1+n:]
+	}
+	return text
+}
+
+func appendUint16(b []byte, values ...uint16) []byte {
+	for _, v := range values {
+		b = append(b, byte(v>>8), byte(v))
+	}
+	return b
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// an advertiser on loopback standing in for one on the network
+func startAdvertiser(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	a := &Advertiser{
+		Instance: "Living room v1.0",
+		Host:     "tv",
+		IP:       net.ParseIP("192.168.1.20"),
+		Port:     3000,
+		Games:    func() []string { return []string{"abc", "def"} },
+	}
+	go a.Serve(conn)
+	return conn
+}
+
+func Test_Advertiser(t *testing.T) {
+	server := startAdvertiser(t)
+	defer server.Close()
+	client, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer client.Close()
+
+	services, err := Browse(client, server.LocalAddr(), 200*time.Millisecond)
+	if err != nil || len(services) != 1 {
+		t.Fatalf("Expected to find the one server, got %v %v", services, err)
+	}
+	s := services[0]
+	if s.Instance != "Living room v1.0" || s.Host != "tv.local." || s.Port != 3000 {
+		t.Errorf("Server found with the wrong name or address: %#v", s)
+	}
+	if len(s.IPs) != 1 || !s.IPs[0].Equal(net.ParseIP("192.168.1.20")) {
+		t.Errorf("Server found at the wrong IP: %v", s.IPs)
+	}
+	if s.Text["version"] != strconv.Itoa(protocolVersion) || s.Text["games"] != "2" || s.Text["g1"] != "abc" || s.Text["g2"] != "def" {
+		t.Errorf("Server's TXT record is wrong: %v", s.Text)
+	}
+}
+
+func Test_Advertiser_OtherServices(t *testing.T) {
+	server := startAdvertiser(t)
+	defer server.Close()
+	client, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer client.Close()
+
+	query := dnsMessage{id: 7, questions: []dnsQuestion{{name: "_http._tcp.local.", rrtype: typePTR}}}
+	client.WriteTo(query.pack(), server.LocalAddr())
+	client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, _, err := client.ReadFrom(make([]byte, 1500)); err == nil {
+		t.Errorf("Server answered a query for some other service with %v bytes", n)
+	}
+}
+
+func Test_ReadName(t *testing.T) {
+	// the second name points back at the end of the first, like answers usually do
+	msg := append(packName("tv.local."), 2, 'm', 'e', 0xc0, 3)
+	name, end, err := readName(msg, 10)
+	if err != nil || name != "me.local." || end != len(msg) {
+		t.Errorf("Pointer wasn't followed: %q %v %v", name, end, err)
+	}
+	if _, _, err = readName([]byte{0xc0, 0}, 0); err == nil {
+		t.Errorf("A pointer to itself should be refused")
+	}
+}
+
+// packets from the network can be anything, and are refused rather than trusted
+func Test_ParseDNS_Malformed(t *testing.T) {
+	header := func(questions, answers byte) []byte {
+		return []byte{0, 1, 0, 0, 0, questions, 0, answers, 0, 0, 0, 0}
+	}
+	question := append(packName("tv.local."), 0, typePTR, 0, classIN)
+	long := []byte{}
+	for i := 0; i < 5; i++ {
+		long = append(long, 63)
+		long = append(long, make([]byte, 63)...)
+	}
+
+	bad := []struct {
+		name   string
+		packet []byte
+	}{
+		{"short header", header(0, 0)[:11]},
+		{"missing question", header(1, 0)},
+		{"truncated name", append(header(1, 0), 3, 't', 'v')},
+		{"name without its end", append(header(1, 0), 2, 't', 'v')},
+		{"question without its type", append(header(1, 0), packName("tv.local.")...)},
+		{"pointer to itself", append(header(1, 0), 0xc0, 12, 0, typePTR, 0, classIN)},
+		{"pointer forwards", append(header(1, 0), 0xc0, 14, 0, typePTR, 0, classIN, 0)},
+		{"pointer past the end", append(header(1, 0), 0xc0, 0xff, 0, typePTR, 0, classIN)},
+		{"truncated pointer", append(header(1, 0), 0xc0)},
+		{"name too long", append(append(header(1, 0), long...), 0, 0, typePTR, 0, classIN)},
+		{"record without its header", append(append(header(1, 1), question...), 0)},
+		{"record longer than the packet", append(append(header(1, 1), question...), 0xc0, 12, 0, typeTXT, 0, classIN, 0, 0, 0, 0, 0, 9, 1, 'a')},
+		{"more records than there are", append(header(1, 0xff), question...)},
+		{"oversized", append(append(header(1, 0), question...), make([]byte, maxPacket)...)},
+	}
+	for _, c := range bad {
+		if m, err := parseDNS(c.packet); err == nil {
+			t.Errorf("Parsed %v into %#v", c.name, m)
+		}
+	}
+
+	// while one that's fine still parses
+	m, err := parseDNS(append(header(1, 0), question...))
+	if err != nil || len(m.questions) != 1 || m.questions[0].name != "tv.local." {
+		t.Errorf("Good question didn't parse: %#v %v", m, err)
+	}
+}
+
+func Test_ReadText(t *testing.T) {
+	cases := []struct {
+		data []byte
+		want []string
+	}{
+		{[]byte{}, []string{}},
+		{[]byte{1, 'a', 0, 2, 'b', 'c'}, []string{"a", "", "bc"}},
+		// a string longer than what's left is dropped, along with the rest
+		{[]byte{1, 'a', 5, 'b'}, []string{"a"}},
+		{[]byte{0xff}, []string{}},
+	}
+	for _, c := range cases {
+		if got := readText(c.data); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Read %v as %q, wanted %q", c.data, got, c.want)
+		}
+	}
+}
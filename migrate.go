@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/coopernurse/gorp"
+)
+
+// Migrations bring a database left by an older server up to date, oldest first. Tables that are new to it are made
+// whole as it's opened, so a migration only changes tables that were already there and has to leave alone what a new
+// table already has. Add to the end, never change one that has been released.
+var Migrations = []func(db *gorp.DbMap) error{
+	// games from before they had teams, parties, options, rounds or times, and players from before teams and bots
+	addColumns("games",
+		"Teams integer not null default 0",
+		"Party varchar(255) not null default ''",
+		"Options varchar(255) not null default ''",
+		"Rounds integer not null default 0",
+		"Created datetime not null default '0001-01-01 00:00:00+00:00'",
+		"Started datetime not null default '0001-01-01 00:00:00+00:00'",
+		"Finished datetime not null default '0001-01-01 00:00:00+00:00'"),
+	addColumns("players",
+		"Team integer not null default 0",
+		"Bot varchar(255) not null default ''"),
+	// tic-tac-toe boards from before they could be other sizes or be undone, and turns from before they were timed
+	addColumns("tictactoe_board",
+		"Width integer not null default 3",
+		"Height integer not null default 3",
+		"Win integer not null default 3",
+		"Round integer not null default 0",
+		"Moves varchar(255) not null default ''",
+		"Seats varchar(255) not null default ''"),
+	addColumns("tictactoe_turn",
+		"Moved datetime not null default '0001-01-01 00:00:00+00:00'"),
+}
+
+// Adds the columns a table is missing, each given as its name followed by its definition. Rows already there get the
+// definition's default, so it needs one.
+func addColumns(table string, columns ...string) func(db *gorp.DbMap) error {
+	return func(db *gorp.DbMap) error {
+		rows, err := db.Db.Query("pragma table_info(" + table + ")")
+		if err != nil {
+			return err
+		}
+		have := map[string]bool{}
+		for rows.Next() {
+			var cid, notNull, pk int
+			var name, kind string
+			var def interface{}
+			if err = rows.Scan(&cid, &name, &kind, &notNull, &def, &pk); err != nil {
+				rows.Close()
+				return err
+			}
+			have[strings.ToLower(name)] = true
+		}
+		rows.Close()
+		if len(have) == 0 {
+			return nil // nothing to migrate if the table was never made
+		}
+
+		for _, column := range columns {
+			name := strings.Fields(column)[0]
+			if have[strings.ToLower(name)] {
+				continue
+			}
+			if _, err = db.Exec("alter table " + table + " add column " + column); err != nil {
+				return fmt.Errorf("adding %v to %v: %v", name, table, err)
+			}
+		}
+		return nil
+	}
+}
+
+// Runs the migrations the database hasn't had yet, recording each in the schema_version table as it goes. A database
+// that has had more than this server knows of was left by a newer one, and isn't opened.
+func migrate(db *gorp.DbMap) error {
+	_, err := db.Exec("create table if not exists schema_version (Version integer not null)")
+	if err != nil {
+		return err
+	}
+	version, err := db.SelectInt("select coalesce(max(Version), 0) from schema_version")
+	if err != nil {
+		return err
+	}
+	if int(version) > len(Migrations) {
+		return fmt.Errorf("the database is at schema version %v but this server only knows up to %v, "+
+			"run a newer server or give it another database with -db", version, len(Migrations))
+	}
+
+	for v := int(version); v < len(Migrations); v++ {
+		log.Printf("Migrating database to schema version %v", v+1)
+		if err = Migrations[v](db); err != nil {
+			return fmt.Errorf("migrating database to schema version %v: %v", v+1, err)
+		}
+		if _, err = db.Exec("insert into schema_version (Version) values (?)", v+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// a database the first server left, before it kept anything but games and players
+func Test_Migrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "game-server")
+	if err != nil {
+		t.Fatalf("Failed to make temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "old.db")
+
+	old, err := sql.Open("sqlite3", name)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	for _, query := range []string{
+		"create table games (Id varchar(255) not null primary key, State varchar(255), Type varchar(255))",
+		"create table players (Id integer not null primary key autoincrement, Name varchar(255), Color varchar(255), Game varchar(255), Role integer)",
+		"insert into games values ('old', 'lobby', 'tictactoe')",
+		"insert into players (Name, Color, Game, Role) values ('', '', 'old', 0)",
+		"create table tictactoe_board (Id integer not null primary key autoincrement, Game varchar(255), Board varchar(255))",
+		"insert into tictactoe_board (Game, Board) values ('old', '[0,0,0,0,0,0,0,0,0]')",
+	} {
+		if _, err = old.Exec(query); err != nil {
+			t.Fatalf("Failed to make the old database: %v", err)
+		}
+	}
+	old.Close()
+
+	db := initDb(name)
+	obj, err := db.Get(Game{}, "old")
+	if err != nil || obj == nil {
+		t.Fatalf("Couldn't get a game from before the migration: %v", err)
+	}
+	if game := obj.(*Game); game.Teams != 0 || game.Options != "" || !game.Started.IsZero() {
+		t.Errorf("Old game should get the defaults: %#v", game)
+	}
+	if _, err = db.Get(Player{}, 1); err != nil {
+		t.Errorf("Couldn't get a player from before the migration: %v", err)
+	}
+	// boards from before they had sizes are the 3x3 they always were
+	board, err := getBoard("old", db)
+	if err != nil {
+		t.Fatalf("Couldn't get a board from before the migration: %v", err)
+	}
+	if g, err := board.getGrid(); err != nil || g.width != 3 || g.height != 3 || g.win != 3 {
+		t.Errorf("Old board should be 3x3 with 3 to win: %#v %v", g, err)
+	}
+	if version, _ := db.SelectInt("select max(Version) from schema_version"); int(version) != len(Migrations) {
+		t.Errorf("Expected schema version %v, got %v", len(Migrations), version)
+	}
+
+	// opening it again has nothing to do, and a server older than the database won't open it
+	db = initDb(name)
+	db.Exec("insert into schema_version (Version) values (?)", len(Migrations)+1)
+	db.Db.Close()
+	defer func() {
+		if recover() == nil {
+			t.Errorf("A database from a newer server was opened")
+		}
+	}()
+	initDb(name)
+}
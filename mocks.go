@@ -69,7 +69,7 @@ type MockGameService struct {
 	Error  error
 }
 
-func (m *MockGameService) NewGame(db *gorp.DbMap) (*Game, *Player, error) {
+func (m *MockGameService) NewGame(gameType string, options Message, party string, db *gorp.DbMap) (*Game, *Player, error) {
 	return m.Game, m.Player, m.Error
 }
 
@@ -93,8 +93,8 @@ func (m *MockGameService) PlayerJoin(gameId string, playerId int) chan Message {
 	return nil
 }
 
-func (m *MockGameService) PlayerLeave(gameId string, playerId int) {
-
+func (m *MockGameService) PlayerLeave(gameId string, playerId int, ch chan Message) bool {
+	return true
 }
 
 func (m *MockGameService) Broadcast(gameId string, msg Message) {
@@ -105,6 +105,18 @@ func (m *MockGameService) SendHost(gameId string, msg Message) {
 
 }
 
+func (m *MockGameService) SendPlayer(gameId string, playerId int, msg Message) {
+
+}
+
 func (m *MockGameService) GetConnectedPlayers(gameId string) []int {
 	return nil
 }
+
+func (m *MockGameService) HostConnected(gameId string) bool {
+	return false
+}
+
+func (m *MockGameService) Forget(gameId string) bool {
+	return true
+}
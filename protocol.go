@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	protocolVersion    = 2 // goes up whenever messages change in a way older pages can't follow
+	minProtocolVersion = 1 // the oldest pages still understood, which is where pages that don't say hello are
+)
+
+// how long a client that has just connected has to say hello before it's taken to be one from before hello
+const helloWait = 500 * time.Millisecond
+
+// what the server can do beyond playing games over a websocket, so clients can check before relying on any of it
+var features = []string{"bots", "chat", "classic", "http", "msgpack", "pause", "poll", "replay", "series", "sse", "teams", "undo"}
+
+// what the server speaks, in answer to a hello
+func helloMessage() Message {
+	games := []string{}
+	for gameType := range GameOptions {
+		games = append(games, gameType)
+	}
+	sort.Strings(games)
+	return Message{
+		"type":        "hello",
+		"version":     protocolVersion,
+		"min_version": minProtocolVersion,
+		"games":       games,
+		"features":    features,
+	}
+}
+
+// Waits for the hello a client opens with, before the game sends it anything, and greets it. Returns false if the
+// client is to be disconnected, either because it can't be talked to or because it went away. A client from before
+// hello that sends something else first has that returned to be handled once the game has been sent, and one that
+// sends nothing in time is played with as it is. A hello that comes later than that is still greeted, but after the
+// game has been sent.
+func awaitHello(read chan Message, conn Conn, log *log.Logger) (Message, bool) {
+	select {
+	case msg, ok := <-read:
+		if !ok {
+			return nil, false
+		}
+		if msg["type"] != "hello" {
+			return msg, true
+		}
+		return nil, greet(msg, conn, log)
+	case <-time.After(helloWait):
+		log.Printf("Client didn't say hello, taking it for one from before hello")
+		return nil, true
+	}
+}
+
+// Answers the hello a client opens with, giving its protocol version and capabilities, with what the server speaks.
+// A client the server can't talk to is told to upgrade, and false is returned so it can be disconnected.
+func greet(msg Message, conn Conn, log *log.Logger) bool {
+	version, ok := toInt(msg["version"])
+	log.Printf("Client says hello with version %v and capabilities %v", msg["version"], msg["capabilities"])
+	upgrade := Message{
+		"type":        "error",
+		"upgrade":     true,
+		"version":     protocolVersion,
+		"min_version": minProtocolVersion,
+	}
+	switch {
+	case !ok:
+		upgrade["message"] = "`version` must be the protocol version the page speaks"
+	case version < minProtocolVersion:
+		upgrade["message"] = "This page is out of date, reload it to keep playing"
+	case version > protocolVersion:
+		upgrade["message"] = "This server is older than the page, it needs upgrading before you can play"
+	default:
+		conn.Send(helloMessage())
+		return true
+	}
+	conn.Send(upgrade)
+	return false
+}
@@ -1,4 +1,4 @@
-var app = angular.module("app", ['ngRoute', 'ngResource', 'monospaced.qrcode'], function($routeProvider){
+var app = angular.module("app", ['ngRoute', 'ngResource'], function($routeProvider){
 	$routeProvider.when("/", {
 		templateUrl: "/tictactoe/home.html",
 		controller: "HomeCtl"
@@ -14,9 +14,15 @@ app.controller("MainCtl", function(){
 
 app.controller("HomeCtl", function($http, $location){
 	console.log("HOME")
+	// options come from the address, like #/?width=15&height=15&win=5 for gomoku or #/?collisions=random
+	var options = {};
+	angular.forEach($location.search(), function(value, key) {
+		options[key] = isNaN(value) ? value : parseInt(value, 10);
+	});
 	$http({
 		method: "post",
-		url: "/new/tictactoe"
+		url: "/new/tictactoe",
+		data: options
 	}).success(function(data) {
 		$location.path("/game/" + data.uuid)
 	}).error(function(err) {
@@ -28,8 +34,18 @@ app.controller('GameCtl', function($scope, $http, $routeParams, $http){
 	$scope.id = $routeParams.id;
 	$scope.state = "waiting";
 	$scope.players = [];
+	$scope.chat = [];
+	$scope.reactions = [];
+	$scope.chatSettings = {enabled: false, reactions: []};
+
+	// the websocket is on the server the page came from, phones are sent to the server's address on the network
+	$scope.url = window.location.host;
 
-	$scope.url = "192.168.1.106:3000"
+	// the version of the messages this page speaks, which the server checks when it says hello
+	var protocolVersion = 2;
+	$scope.hello = function() {
+		$scope.send({type: "hello", version: protocolVersion, capabilities: window.EventSource ? ["sse"] : []});
+	};
 
 	console.log("HERE");
 	// Have to do an initial GET... workaround for martini sessions
@@ -39,8 +55,17 @@ app.controller('GameCtl', function($scope, $http, $routeParams, $http){
 	}).success(function(data) {
 		console.log("Initial GET was successful, trying to connect via websocket.")
 		$scope.isHost = data.host;
+		if($scope.isHost) {
+			$http.get("/game/" + $scope.id + "/join").success(function(data) {
+				$scope.join = data;
+			});
+		}
 		$scope.connectWs();
 	}).error(function(data, status){
+		if(status == 410) {
+			$scope.state = "ended";
+			return;
+		}
 		alert("Failed to get game with status " + status);
 		console.log(data);
 	});
@@ -49,16 +74,161 @@ app.controller('GameCtl', function($scope, $http, $routeParams, $http){
 	$scope.start = function(){
 		$scope.send({type: "state", state: "start"});
 	};
+	$scope.addBot = function(bot) {
+		$scope.send({type: "addbot", bot: bot});
+	};
+	$scope.removeBot = function(player) {
+		$scope.send({type: "removebot", player: player.id});
+	};
 	$scope.move = function(space) {
 		$scope.send({type: "move", move: space});
 	};
+	$scope.say = function() {
+		if(!$scope.chatText) {
+			return;
+		}
+		$scope.send({type: "chat", text: $scope.chatText});
+		$scope.chatText = "";
+	};
+	$scope.react = function(emoji) {
+		$scope.send({type: "react", emoji: emoji});
+	};
+	$scope.mute = function(player) {
+		$scope.send({type: player.muted ? "unmute" : "mute", player: player.id});
+	};
+	$scope.rematch = function() {
+		$scope.send({type: "rematch"});
+	};
+	$scope.pause = function() {
+		$scope.send({type: $scope.state == "paused" ? "resume" : "pause"});
+	};
+	$scope.undo = function() {
+		$scope.send({type: "undo"});
+	};
+	$scope.clearChat = function() {
+		$scope.send({type: "clear_chat"});
+	};
+	$scope.setChat = function(settings) {
+		settings.type = "chat_settings";
+		$scope.send(settings);
+	};
+
+	// handles a message from the server, however it came
+	$scope.receive = function(msg){
+		console.log(msg);
+		switch(msg.type) {
+			case "host":
+				$scope.isHost = msg.host;
+				break;
+			case "ended":
+				$scope.state = "ended";
+				break;
+			case "chat":
+			case "react":
+				// only the last few fit on screen
+				$scope.chat.push(msg);
+				if($scope.chat.length > 10) {
+					$scope.chat.shift();
+				}
+				break;
+			case "collision":
+				var outcomes = {
+					won: "You got there first!",
+					lost: "Someone else got that spot",
+					cancelled: "Someone went in the same spot, so nobody got it",
+					blocked: "Someone went in the same spot, it's blocked for good"
+				};
+				$scope.notice = outcomes[msg.outcome];
+				break;
+			case "series":
+				// the score between games when playing a best of several
+				var name = msg.teams ? "Team " : "Player ";
+				$scope.series = msg;
+				$scope.seriesScore = [];
+				angular.forEach(msg.score, function(wins, owner) {
+					$scope.seriesScore.push({name: name + owner, wins: wins});
+				});
+				$scope.seriesChampion = msg.champion ? name + msg.champion : null;
+				break;
+			case "seats":
+				// classic games, where two take turns and the rest wait to play the winner
+				$scope.seats = msg;
+				break;
+			case "turn":
+				$scope.turnNotice = "Your move";
+				break;
+			case "wait":
+				$scope.turnNotice = msg.place ? "You're number " + msg.place + " in line to play the winner" : "Waiting for Player " + msg.turn;
+				break;
+			case "clear_chat":
+				$scope.chat = [];
+				break;
+			case "chat_settings":
+				$scope.chatSettings = msg;
+				break;
+			case "hello":
+				$scope.server = msg;
+				break;
+			case "error":
+				if(msg.upgrade) {
+					$scope.state = "upgrade";
+					$scope.upgrade = msg.message;
+					break;
+				}
+				$scope.chatError = msg.message;
+				break;
+			case "players":
+				$scope.players = msg.players;
+				break;
+			case "state":
+				$scope.state = msg.state;
+			case "update":
+				$scope.state = msg.state;
+				if(!msg.collisions || msg.collisions.length == 0) {
+					$scope.notice = null;
+				}
+				if(msg.undone) {
+					$scope.notice = "The last round was taken back, make your move again";
+				}
+				var rows = [];
+				var cells = msg.board || [];
+				var width = msg.width || 3;
+				var label = msg.teams ? "Team " : "Player ";
+				for(var i=0; i<cells.length; i++){
+					if(i % width == 0) {
+						rows.push([]);
+					}
+					var text = cells[i] == 0 ? " " : cells[i] == -1 ? "Blocked" : label + cells[i];
+					rows[rows.length-1].push({index: i, label: text});
+				};
+				$scope.rows = rows;
+				$scope.cellStyle = {display: "inline-block", width: (100 / width) + "%", padding: "0 5px"};
+				$scope.winner = msg.winner ? label + msg.winner : null;
+				break;
+			default:
+				console.log("Unknown message type: " + msg.type);
+		}
+	};
 
 	$scope.connectWs = function(){
+		if(!window.WebSocket) {
+			$scope.connectFallback();
+			return;
+		}
 		var conn = new WebSocket("ws://" + $scope.url + "/ws/" + $scope.id);
+		var opened = false;
 
 		conn.onclose = function(e){
 			$scope.$apply(function(){
 				console.log(e);
+				if($scope.state == "ended" || $scope.state == "upgrade") {
+					return;
+				}
+				if(!opened) {
+					// something between here and the server blocks websockets
+					$scope.connectFallback();
+					return;
+				}
 				$scope.state = "closed";
 				$scope.error = e;
 			});
@@ -66,38 +236,15 @@ app.controller('GameCtl', function($scope, $http, $routeParams, $http){
 
 		conn.onopen = function(e){
 			$scope.$apply(function(){
+				opened = true;
 				console.log("CONNECTED");
+				$scope.hello();
 			});
 		};
 
 		conn.onmessage = function(e){
 			$scope.$apply(function(){
-				var msg = JSON.parse(e.data);
-				console.log(msg);
-				switch(msg.type) {
-					case "host":
-						$scope.isHost = msg.host;
-						break;
-					case "players":
-						$scope.players = msg.players;
-						break;
-					case "state":
-						$scope.state = msg.state;
-					case "update":
-						$scope.state = msg.state;
-						var board = [];
-						for(var i=0; i<9; i++){
-							if(msg.board[i] == 0){
-								board.push(" ");
-							} else {
-								board.push("Player " + msg.board[i]);
-							}
-						};
-						$scope.board = board;
-						break;
-					default:
-						console.log("Unknown message type: " + msg.type);
-				}
+				$scope.receive(JSON.parse(e.data));
 			});
 		};
 
@@ -105,4 +252,38 @@ app.controller('GameCtl', function($scope, $http, $routeParams, $http){
 			conn.send(JSON.stringify(msg));
 		}
 	}
+
+	// server-sent events for what the server says and POSTs for the rest, or long-polling without EventSource
+	$scope.connectFallback = function(){
+		console.log("Websockets aren't getting through, falling back to HTTP");
+		$scope.send = function(msg){
+			$http.post("/send/" + $scope.id, msg);
+		};
+		$scope.hello();
+		if(window.EventSource) {
+			var events = new EventSource("/sse/" + $scope.id);
+			events.onmessage = function(e){
+				$scope.$apply(function(){
+					var msg = JSON.parse(e.data);
+					$scope.receive(msg);
+					if(msg.type == "ended") {
+						events.close();
+					}
+				});
+			};
+			return;
+		}
+		var poll = function(cursor){
+			$http.get("/poll/" + $scope.id, {params: {cursor: cursor}}).success(function(data) {
+				angular.forEach(data.messages, $scope.receive);
+				if($scope.state != "ended" && $scope.state != "upgrade") {
+					poll(data.cursor);
+				}
+			}).error(function(data, status) {
+				$scope.state = "closed";
+				$scope.error = data;
+			});
+		};
+		poll(0);
+	};
 });
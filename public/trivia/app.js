@@ -1,4 +1,4 @@
-var app = angular.module("app", ['ngRoute', 'ngResource', 'monospaced.qrcode'], function($routeProvider){
+var app = angular.module("app", ['ngRoute', 'ngResource'], function($routeProvider){
 	$routeProvider.when("/", {
 		templateUrl: "/tictactoe/home.html",
 		controller: "HomeCtl"
@@ -29,7 +29,8 @@ app.controller('GameCtl', function($scope, $http, $routeParams, $http){
 	$scope.state = "waiting";
 	$scope.players = [];
 
-	$scope.url = "192.168.1.106:3000"
+	// the websocket is on the server the page came from, phones are sent to the server's address on the network
+	$scope.url = window.location.host;
 
 	console.log("HERE");
 	// Have to do an initial GET... workaround for martini sessions
@@ -39,6 +40,11 @@ app.controller('GameCtl', function($scope, $http, $routeParams, $http){
 	}).success(function(data) {
 		console.log("Initial GET was successful, trying to connect via websocket.")
 		$scope.isHost = data.host;
+		if($scope.isHost) {
+			$http.get("/game/" + $scope.id + "/join").success(function(data) {
+				$scope.join = data;
+			});
+		}
 		$scope.connectWs();
 	}).error(function(data, status){
 		alert("Failed to get game with status " + status);
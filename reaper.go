@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/coopernurse/gorp"
+)
+
+// the longest the reaper waits between looking for abandoned games
+const maxReapInterval = time.Minute
+
+var errGameEnded = errors.New("game has ended")
+
+// Cleanups delete the rows a type of game keeps for itself when one of its games expires, keyed by game type.
+var Cleanups = map[string]func(db *gorp.DbMap, gameId string) error{}
+
+// Reaper expires unfinished games nobody is connected to once nothing has happened in them for a while. They go to
+// the "expired" state so anyone coming back to one is told it has ended, and their channels are freed. Finished games
+// stay finished for the history, but are freed and cleaned up the same way once they're left.
+type Reaper struct {
+	Idle   time.Duration // how long a game has to go without any activity
+	Delete bool          // also delete the events, players and game type rows of expired and finished games
+}
+
+// Run reaps every so often, forever.
+func (r *Reaper) Run(db *gorp.DbMap, gs GameService) {
+	interval := r.Idle
+	if interval > maxReapInterval {
+		interval = maxReapInterval
+	}
+	for now := range time.Tick(interval) {
+		expired := r.Reap(db, gs, now)
+		if len(expired) > 0 {
+			log.Printf("Reaped %v abandoned games", len(expired))
+		}
+	}
+}
+
+// Reap makes one pass over the games, as if it were now, and returns the ids of those it expired.
+func (r *Reaper) Reap(db *gorp.DbMap, gs GameService, now time.Time) []string {
+	var games []*Game
+	_, err := db.Select(&games, "select * from games where State<>'expired'")
+	if err != nil {
+		log.Printf("Reaper couldn't get games: %v", err)
+		return nil
+	}
+
+	expired := []string{}
+	for _, game := range games {
+		if now.Sub(lastActivity(db, game)) < r.Idle || !abandoned(game.Id, gs, db) {
+			continue
+		}
+		if !gs.Forget(game.Id) {
+			continue // somebody connected since we looked
+		}
+
+		if game.State != "finished" {
+			from := game.State
+			game.State = "expired"
+			_, err = db.Update(game)
+			if err != nil {
+				log.Printf("Reaper couldn't expire game %v: %v", game.Id, err)
+				continue
+			}
+			if err = logTransition(db, game.Id, 0, from, game.State); err != nil {
+				log.Printf("Failed to record expiry of %v: %v", game.Id, err)
+			}
+			expired = append(expired, game.Id)
+		}
+		var players []*Player
+		if _, err = db.Select(&players, "select * from players where Game=?", game.Id); err == nil {
+			for _, p := range players {
+				forgetChat(p.Id)
+			}
+		}
+		if r.Delete {
+			deleteGame(db, game)
+		}
+	}
+	return expired
+}
+
+// the last time anything was sent in the game, or the game changed state
+func lastActivity(db *gorp.DbMap, game *Game) time.Time {
+	last := game.Created
+	for _, t := range []time.Time{game.Started, game.Finished} {
+		if t.After(last) {
+			last = t
+		}
+	}
+	var event Event
+	err := db.SelectOne(&event, "select * from events where Game=? order by Id desc limit 1", game.Id)
+	if err == nil && event.Created.After(last) {
+		last = event.Created
+	}
+	return last
+}
+
+// whether the only ones left in the game are bots. Bots on this server are told to leave so the next pass can
+// reap the game once they have.
+func abandoned(gameId string, gs GameService, db *gorp.DbMap) bool {
+	if gs.HostConnected(gameId) {
+		return false
+	}
+	connected := gs.GetConnectedPlayers(gameId)
+	for _, pid := range connected {
+		obj, err := db.Get(Player{}, pid)
+		if err != nil || obj == nil || obj.(*Player).Bot == "" {
+			return false
+		}
+		detachBot(gameId, pid)
+	}
+	return len(connected) == 0
+}
+
+// deletes everything about a reaped game except the game itself, which stays so late rejoiners can be told, and the
+// players with results from rounds they finished, which stats and the history still show
+func deleteGame(db *gorp.DbMap, game *Game) {
+	if cleanup, ok := Cleanups[game.Type]; ok {
+		if err := cleanup(db, game.Id); err != nil {
+			log.Printf("Couldn't clean up %v game %v: %v", game.Type, game.Id, err)
+		}
+	}
+	for _, query := range []string{
+		"delete from events where Game=?",
+		"delete from players where Game=? and Id not in (select Player from results)",
+		"delete from chat_settings where Game=?",
+	} {
+		if _, err := db.Exec(query, game.Id); err != nil {
+			log.Printf("Couldn't delete rows of game %v: %v", game.Id, err)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_Reaper(t *testing.T) {
+	s := startServer(t)
+	defer s.stop()
+	reaper := &Reaper{Idle: time.Hour, Delete: true}
+
+	// one game everybody walked away from, and one the host is still watching
+	gone := s.newClient()
+	goneId := gone.newGame("tictactoe")
+	gone.do("GET", "/game/"+goneId, 200)
+
+	g := s.newGame("tictactoe", 1)
+	defer g.close()
+
+	// and one that was played to the end and left there, with a result to keep
+	done := s.newClient()
+	doneId := done.newGame("tictactoe")
+	done.do("GET", "/game/"+doneId, 200)
+	phone := s.newClient()
+	phone.do("GET", "/game/"+doneId, 200)
+	phoneId, _ := s.db.SelectInt("select Id from players where Game=? and Role<>?", doneId, Host)
+	s.db.Insert(&Result{Game: doneId, Player: int(phoneId), Type: "tictactoe", Outcome: Win, Finished: time.Now()})
+	s.db.Exec("update games set State='finished' where Id=?", doneId)
+	read := s.gs.PlayerJoin(doneId, int(phoneId))
+	s.gs.PlayerLeave(doneId, int(phoneId), read)
+
+	if expired := reaper.Reap(s.db, s.gs, time.Now()); len(expired) != 0 {
+		t.Errorf("Games were reaped before they were idle: %v", expired)
+	}
+	expired := reaper.Reap(s.db, s.gs, time.Now().Add(2*time.Hour))
+	if len(expired) != 1 || expired[0] != goneId {
+		t.Fatalf("Expected only %v to be reaped, got %v", goneId, expired)
+	}
+
+	obj, err := s.db.Get(Game{}, goneId)
+	if err != nil || obj.(*Game).State != "expired" {
+		t.Errorf("Reaped game should be expired: %#v %v", obj, err)
+	}
+	count, _ := s.db.SelectInt("select count(*) from events where Game=?", goneId)
+	if count != 0 {
+		t.Errorf("Events of the reaped game weren't deleted, %v left", count)
+	}
+
+	// the finished game stays finished, but is freed and cleaned up like the expired one
+	obj, err = s.db.Get(Game{}, doneId)
+	if err != nil || obj.(*Game).State != "finished" {
+		t.Errorf("Finished game should still be finished: %#v %v", obj, err)
+	}
+	if _, ok := s.gs.Fabric.(*MemoryFabric).ChannelMap[doneId]; ok {
+		t.Errorf("Channels of the finished game weren't freed")
+	}
+	if count, _ := s.db.SelectInt("select count(*) from players where Game=?", doneId); count != 1 {
+		t.Errorf("Expected just the player with a result to be kept, got %v players", count)
+	}
+
+	// a game that expires after a round was finished still keeps the players who have results
+	s.db.Exec("update games set State='start' where Id=?", doneId)
+	if expired := reaper.Reap(s.db, s.gs, time.Now().Add(2*time.Hour)); len(expired) != 1 || expired[0] != doneId {
+		t.Fatalf("Expected %v to be reaped, got %v", doneId, expired)
+	}
+	if obj, err := s.db.Get(Player{}, int(phoneId)); err != nil || obj == nil {
+		t.Errorf("Player with a result was deleted: %v", err)
+	}
+	if count, _ := s.db.SelectInt("select count(*) from players where Game=?", doneId); count != 1 {
+		t.Errorf("Expected just the player with a result to be kept, got %v players", count)
+	}
+
+	// whoever comes back is told the game is over, over HTTP and the websocket
+	msg := gone.do("GET", "/game/"+goneId, 410)
+	if msg["type"] != "ended" {
+		t.Errorf("Expected to be told the game ended: %#v", msg)
+	}
+	gone.dial(goneId)
+	defer gone.close()
+	gone.await("ended", nil)
+	s.newClient().do("GET", "/game/"+goneId, 410)
+
+	// the game still being played carries on
+	g.start()
+}
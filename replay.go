@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/codegangsta/martini"
+	"github.com/coopernurse/gorp"
+	"github.com/gorilla/websocket"
+	"github.com/martini-contrib/render"
+)
+
+// the longest a replay will sit on one frame when playing at normal speed, so nobody has to re-watch the
+// minute everyone spent arguing over a move
+const maxReplayGap = 3 * time.Second
+
+var errNotFinished = errors.New("Game is not finished")
+
+// A replay plays back the updates the host's screen showed during a finished game.
+type replay struct {
+	frames  []*Event
+	pos     int     // index of the next frame to show
+	speed   float64 // 2 plays twice as fast, 0.5 half as fast
+	playing bool
+}
+
+// gets the recorded board updates of a finished game. After rematches only the last game is replayed, from the
+// start that began it, either leaving the lobby or a rematch. Resumes and undone finishes carry on the game before.
+func getReplay(db *gorp.DbMap, gameId string) ([]*Event, error) {
+	obj, err := db.Get(Game{}, gameId)
+	if err != nil {
+		return nil, err
+	}
+	if obj == nil {
+		return nil, errors.New("Game not found")
+	}
+	if obj.(*Game).State != "finished" {
+		return nil, errNotFinished
+	}
+	events, err := getEvents(db, gameId, "", "", "", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	frames := []*Event{}
+	started := false
+	for _, e := range events {
+		if e.Kind == StateEvent && e.Type == "start" {
+			transition := Message{}
+			json.Unmarshal([]byte(e.Payload), &transition)
+			started = transition["from"] != "paused"
+		}
+		if e.Kind != MessageEvent || e.Direction != HostToWebDir || e.Type != "update" {
+			continue
+		}
+		// the update straight after a start says whether it began a game or took back the finish of one
+		if started {
+			update := Message{}
+			json.Unmarshal([]byte(e.Payload), &update)
+			if _, undone := update["undone"]; !undone {
+				frames = frames[:0]
+			}
+			started = false
+		}
+		frames = append(frames, e)
+	}
+	return frames, nil
+}
+
+// the update message for frame i, with where it is in the replay so the screen can show progress
+func (r *replay) frame(i int) (Message, error) {
+	msg := Message{}
+	err := json.Unmarshal([]byte(r.frames[i].Payload), &msg)
+	if err != nil {
+		return nil, err
+	}
+	msg["frame"] = i
+	msg["frames"] = len(r.frames)
+	return msg, nil
+}
+
+// how long to wait before showing the next frame
+func (r *replay) delay() time.Duration {
+	if r.pos == 0 || r.pos >= len(r.frames) {
+		return 0
+	}
+	gap := r.frames[r.pos].Created.Sub(r.frames[r.pos-1].Created)
+	if gap > maxReplayGap {
+		gap = maxReplayGap
+	}
+	return time.Duration(float64(gap) / r.speed)
+}
+
+func (r *replay) status() Message {
+	state := "paused"
+	if r.pos >= len(r.frames) {
+		state = "done"
+	} else if r.playing {
+		state = "playing"
+	}
+	return Message{
+		"type":   "replay",
+		"state":  state,
+		"frame":  r.pos,
+		"frames": len(r.frames),
+		"speed":  r.speed,
+	}
+}
+
+// lists every frame of a finished game's replay at once
+func ReplayHandler(r render.Render, params martini.Params, db *gorp.DbMap, log *log.Logger) {
+	gameId := params["id"]
+	frames, err := getReplay(db, gameId)
+	if err == errNotFinished {
+		r.JSON(409, Message{"message": "Only finished games can be replayed"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to get replay for game %v: %v", gameId, err)
+		r.JSON(500, Message{"message": "Failed to get replay"})
+		return
+	}
+
+	rep := &replay{frames: frames}
+	msgs := []Message{}
+	for i := range frames {
+		msg, err := rep.frame(i)
+		if err != nil {
+			log.Printf("Failed to read frame %v: %v", i, err)
+			r.JSON(500, Message{"message": "Failed to get replay"})
+			return
+		}
+		msg["created"] = frames[i].Created
+		msgs = append(msgs, msg)
+	}
+	r.JSON(200, Message{"frames": msgs})
+}
+
+// Plays a finished game back to a host screen over a websocket. The speed query parameter sets the playback speed,
+// and the screen can send pause, play, step, seek (with a frame) and speed (with a speed) messages to control it.
+func ReplayWebsocketHandler(w http.ResponseWriter, req *http.Request, params martini.Params, db *gorp.DbMap, log *log.Logger) {
+	gameId := params["id"]
+	frames, err := getReplay(db, gameId)
+	if err == errNotFinished {
+		http.Error(w, "Only finished games can be replayed", 409)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to get replay for game %v: %v", gameId, err)
+		http.Error(w, "Failed to get replay", 500)
+		return
+	}
+
+	rep := &replay{frames: frames, speed: 1, playing: true}
+	if s := req.URL.Query().Get("speed"); s != "" {
+		rep.speed, err = strconv.ParseFloat(s, 64)
+		if err != nil || rep.speed <= 0 {
+			http.Error(w, "`speed` must be a positive number", 400)
+			return
+		}
+	}
+
+	codec, header := negotiateCodec(req)
+	ws, err := websocket.Upgrade(w, req, header, 1024, 1024)
+	if _, ok := err.(websocket.HandshakeError); ok {
+		http.Error(w, "Not a websocket handshake", 400)
+		return
+	} else if err != nil {
+		log.Println(err)
+		return
+	}
+	defer ws.Close()
+	ws.SetReadLimit(maxMessageSize)
+	conn := wsConn{ws, codec}
+	log.Printf("Replaying game %v with %v frames", gameId, len(frames))
+
+	// start a goroutine dedicated to listening to the websocket for controls
+	controls := make(chan Message)
+	go func() {
+		defer close(controls)
+		for {
+			msg, err := readMessage(ws, codec)
+			if err != nil {
+				log.Printf("Replay websocket closed: %v", err)
+				return
+			}
+			controls <- msg
+		}
+	}()
+
+	// shows the frame at i and moves the replay on to the one after it
+	show := func(i int) error {
+		msg, err := rep.frame(i)
+		if err != nil {
+			return err
+		}
+		rep.pos = i + 1
+		return conn.Send(msg)
+	}
+
+	var next <-chan time.Time
+	schedule := func() {
+		next = nil
+		if rep.playing && rep.pos < len(rep.frames) {
+			next = time.After(rep.delay())
+		}
+	}
+
+	conn.Send(rep.status())
+	schedule()
+	for {
+		select {
+		case <-next:
+			if err := show(rep.pos); err != nil {
+				log.Printf("Failed to show frame: %v", err)
+				return
+			}
+			if rep.pos >= len(rep.frames) {
+				conn.Send(rep.status())
+			}
+			schedule()
+		case msg, ok := <-controls:
+			if !ok {
+				return
+			}
+			switch msg["type"] {
+			case "pause":
+				rep.playing = false
+			case "play":
+				rep.playing = true
+			case "step":
+				rep.playing = false
+				if rep.pos < len(rep.frames) {
+					if err := show(rep.pos); err != nil {
+						log.Printf("Failed to show frame: %v", err)
+						return
+					}
+				}
+			case "seek":
+				f, ok := msg["frame"].(float64)
+				if !ok || int(f) < 0 || int(f) >= len(rep.frames) {
+					conn.Send(Message{"type": "error", "message": "`frame` is out of range"})
+					continue
+				}
+				if err := show(int(f)); err != nil {
+					log.Printf("Failed to show frame: %v", err)
+					return
+				}
+			case "speed":
+				s, ok := msg["speed"].(float64)
+				if !ok || s <= 0 {
+					conn.Send(Message{"type": "error", "message": "`speed` must be a positive number"})
+					continue
+				}
+				rep.speed = s
+			default:
+				log.Printf("Unknown replay control: %#v", msg)
+				continue
+			}
+			conn.Send(rep.status())
+			schedule()
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/codegangsta/martini"
+	"github.com/coopernurse/gorp"
+	"github.com/martini-contrib/render"
+)
+
+// GameSchemas are the JSON Schemas of the messages a type of game takes and sends, keyed by message type.
+type GameSchemas struct {
+	Inbound  map[string]Message // from the host's screen and the phones
+	Outbound map[string]Message // to them
+}
+
+// Schemas of each type of game's messages, keyed by game type. Messages from browsers are checked against them
+// before any action sees them, and they're served so clients and docs can be made from them.
+var Schemas = map[string]GameSchemas{}
+
+// the messages every type of game has, whatever else it takes and sends
+var commonSchemas = GameSchemas{
+	Inbound: map[string]Message{
+		"hello": messageSchema("hello", Message{
+			"version":      Message{"type": "integer", "description": "the protocol version the page speaks"},
+			"capabilities": Message{"type": "array", "items": Message{"type": "string"}},
+		}, "version"),
+	},
+	Outbound: map[string]Message{
+		"hello": messageSchema("hello", Message{
+			"version":     Message{"type": "integer"},
+			"min_version": Message{"type": "integer", "description": "the oldest protocol version still understood"},
+			"games":       Message{"type": "array", "items": Message{"type": "string"}},
+			"features":    Message{"type": "array", "items": Message{"type": "string"}},
+		}, "version", "min_version", "games", "features"),
+		"error": messageSchema("error", Message{
+			"message": Message{"type": "string"},
+			"upgrade": Message{"type": "boolean", "description": "set when the page has to be reloaded to carry on"},
+		}, "message"),
+		"ended": messageSchema("ended", Message{
+			"message": Message{"type": "string"},
+		}),
+	},
+}
+
+// The schema of an object message of the given type, with properties and the ones of them that are required.
+func messageSchema(msgType string, properties Message, required ...string) Message {
+	props := Message{"type": Message{"const": msgType}}
+	for name, p := range properties {
+		props[name] = p
+	}
+	return Message{
+		"type":       "object",
+		"title":      msgType,
+		"properties": props,
+		"required":   append([]string{"type"}, required...),
+	}
+}
+
+// Checks a message from a browser against the game's schema for its type. Types without a schema aren't checked.
+func checkMessage(gameId string, msg Message, db *gorp.DbMap) error {
+	obj, err := db.Get(Game{}, gameId)
+	if err != nil || obj == nil {
+		return nil // the action will have more to say about a missing game
+	}
+	msgType, _ := msg["type"].(string)
+	schema, ok := Schemas[obj.(*Game).Type].Inbound[msgType]
+	if !ok {
+		schema, ok = commonSchemas.Inbound[msgType]
+	}
+	if !ok {
+		return nil
+	}
+	return validate(schema, map[string]interface{}(msg), "")
+}
+
+// Validates a value against a schema, using only what messages need of JSON Schema: type, const, enum, the bounds of
+// numbers and strings, and the properties and items of objects and arrays. The error says where the value went wrong.
+func validate(schema Message, v interface{}, path string) error {
+	name := "`" + path + "`"
+	if path == "" {
+		name = "The message"
+	}
+
+	if t, ok := schema["type"]; ok {
+		matched := false
+		for _, want := range schemaList(t) {
+			matched = matched || isSchemaType(v, want.(string))
+		}
+		if !matched {
+			return fmt.Errorf("%v must be %v", name, typeNames(schemaList(t)))
+		}
+	}
+	if c, ok := schema["const"]; ok && !schemaEqual(v, c) {
+		return fmt.Errorf("%v must be %v", name, c)
+	}
+	if e, ok := schema["enum"]; ok {
+		found, options := false, []string{}
+		for _, option := range schemaList(e) {
+			found = found || schemaEqual(v, option)
+			options = append(options, fmt.Sprint(option))
+		}
+		if !found {
+			return fmt.Errorf("%v must be one of %v", name, strings.Join(options, ", "))
+		}
+	}
+
+	if n, ok := schemaNumber(v); ok {
+		if min, ok := schemaNumber(schema["minimum"]); ok && n < min {
+			return fmt.Errorf("%v must be at least %v", name, min)
+		}
+		if max, ok := schemaNumber(schema["maximum"]); ok && n > max {
+			return fmt.Errorf("%v must be at most %v", name, max)
+		}
+	}
+	if s, ok := v.(string); ok {
+		length := float64(utf8.RuneCountInString(s))
+		if min, ok := schemaNumber(schema["minLength"]); ok && length < min {
+			return fmt.Errorf("%v must be at least %v characters", name, min)
+		}
+		if max, ok := schemaNumber(schema["maxLength"]); ok && length > max {
+			return fmt.Errorf("%v must be at most %v characters", name, max)
+		}
+	}
+
+	if obj, ok := schemaObject(v); ok {
+		for _, r := range schemaList(schema["required"]) {
+			if _, ok := obj[r.(string)]; !ok {
+				return fmt.Errorf("Provide `%v`", schemaPath(path, r.(string)))
+			}
+		}
+		props, _ := schemaObject(schema["properties"])
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			p, ok := schemaObject(props[k])
+			if !ok {
+				if schema["additionalProperties"] == false {
+					return fmt.Errorf("%v doesn't take `%v`", name, k)
+				}
+				continue
+			}
+			if err := validate(Message(p), obj[k], schemaPath(path, k)); err != nil {
+				return err
+			}
+		}
+	}
+	if items, ok := schemaObject(schema["items"]); ok && isSchemaType(v, "array") {
+		for i, item := range schemaList(v) {
+			if err := validate(Message(items), item, fmt.Sprintf("%v[%v]", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func schemaPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func isSchemaType(v interface{}, t string) bool {
+	switch t {
+	case "null":
+		return v == nil
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "number":
+		_, ok := schemaNumber(v)
+		return ok
+	case "integer":
+		n, ok := schemaNumber(v)
+		return ok && n == math.Trunc(n)
+	case "array":
+		return v != nil && reflect.TypeOf(v).Kind() == reflect.Slice
+	case "object":
+		_, ok := schemaObject(v)
+		return ok
+	}
+	return false
+}
+
+// "a string", or "a string or null"
+func typeNames(types []interface{}) string {
+	names := []string{}
+	for _, t := range types {
+		switch t {
+		case "null":
+			names = append(names, "null")
+		case "integer", "object", "array":
+			names = append(names, "an "+t.(string))
+		default:
+			names = append(names, "a "+t.(string))
+		}
+	}
+	return strings.Join(names, " or ")
+}
+
+// a schema keyword that may be a single value or a list of them, as a list
+func schemaList(v interface{}) []interface{} {
+	if v == nil {
+		return nil
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice {
+		return []interface{}{v}
+	}
+	list := make([]interface{}, rv.Len())
+	for i := range list {
+		list[i] = rv.Index(i).Interface()
+	}
+	return list
+}
+
+// numbers come from JSON as float64, and from schemas and bots as whatever Go number they were written as
+func schemaNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+func schemaObject(v interface{}) (map[string]interface{}, bool) {
+	switch o := v.(type) {
+	case Message:
+		return o, true
+	case map[string]interface{}:
+		return o, true
+	}
+	return nil, false
+}
+
+func schemaEqual(a, b interface{}) bool {
+	if x, ok := schemaNumber(a); ok {
+		y, ok := schemaNumber(b)
+		return ok && x == y
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// the schema of every message a type of game takes and sends, as one JSON Schema document
+func schemaDocument(gameType string, schemas GameSchemas) Message {
+	merge := func(game, common map[string]Message) Message {
+		all := Message{}
+		for k, s := range common {
+			all[k] = s
+		}
+		for k, s := range game {
+			all[k] = s
+		}
+		return all
+	}
+	return Message{
+		"$schema": "http://json-schema.org/draft-07/schema#",
+		"$id":     "/schemas/" + gameType,
+		"title":   "Messages of " + gameType + " games",
+		"definitions": Message{
+			"inbound":  merge(schemas.Inbound, commonSchemas.Inbound),
+			"outbound": merge(schemas.Outbound, commonSchemas.Outbound),
+		},
+	}
+}
+
+// lists the game types there are schemas for
+func SchemasHandler(r render.Render) {
+	games := []string{}
+	for gameType := range Schemas {
+		games = append(games, gameType)
+	}
+	sort.Strings(games)
+	r.JSON(200, Message{"games": games})
+}
+
+// serves the schemas of a type of game's messages, those it takes under definitions/inbound and those it sends under
+// definitions/outbound
+func SchemaHandler(r render.Render, params martini.Params) {
+	schemas, ok := Schemas[params["game"]]
+	if !ok {
+		r.JSON(404, Message{"message": "No such game type"})
+		return
+	}
+	r.JSON(200, schemaDocument(params["game"], schemas))
+}
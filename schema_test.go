@@ -0,0 +1,119 @@
+package main
+
+import (
+	"testing"
+)
+
+func Test_Validate(t *testing.T) {
+	schema := ticTacToeSchemas.Inbound["move"]
+	good := []Message{
+		{"type": "move", "move": 4.0},
+		{"type": "move", "move": 0},
+		{"type": "move", "move": 4.0, "extra": "ignored"},
+	}
+	for _, msg := range good {
+		if err := validate(schema, map[string]interface{}(msg), ""); err != nil {
+			t.Errorf("%#v didn't validate: %v", msg, err)
+		}
+	}
+
+	move, state := ticTacToeSchemas.Inbound["move"], ticTacToeSchemas.Inbound["state"]
+	bad := []struct {
+		schema Message
+		msg    Message
+		want   string
+	}{
+		{move, Message{"type": "move"}, "Provide `move`"},
+		{move, Message{"type": "move", "move": "4"}, "`move` must be an integer"},
+		{move, Message{"type": "move", "move": 4.5}, "`move` must be an integer"},
+		{move, Message{"type": "move", "move": -1.0}, "`move` must be at least 0"},
+		{move, Message{"type": "moves", "move": 4.0}, "`type` must be move"},
+		{state, Message{"type": "state", "state": "over"}, "`state` must be one of lobby, start, finished"},
+	}
+	for _, c := range bad {
+		if err := validate(c.schema, map[string]interface{}(c.msg), ""); err == nil || err.Error() != c.want {
+			t.Errorf("%#v gave %v, wanted %v", c.msg, err, c.want)
+		}
+	}
+
+	nested := Message{"type": "object", "properties": Message{
+		"players": Message{"type": "array", "items": Message{"type": "object", "required": []string{"id"}}},
+	}}
+	err := validate(nested, map[string]interface{}{"players": []interface{}{map[string]interface{}{"id": 1.0}, map[string]interface{}{}}}, "")
+	if err == nil || err.Error() != "Provide `players[1].id`" {
+		t.Errorf("Nested error was %v", err)
+	}
+	strict := Message{"type": "object", "additionalProperties": false, "properties": Message{"a": Message{}}}
+	if err := validate(strict, map[string]interface{}{"a": 1, "b": 2}, ""); err == nil {
+		t.Errorf("Extra property got through additionalProperties false")
+	}
+	if err := validate(Message{"type": []string{"string", "null"}}, nil, "x"); err != nil {
+		t.Errorf("Null wasn't allowed by a list of types: %v", err)
+	}
+}
+
+// what the game really sends should match the schemas it says it sends
+func Test_TicTacToeSchemas(t *testing.T) {
+	g := grid{cells: []int{1, 0, 2, 0, 1, 0, 0, 0, 1}, width: 3, height: 3, win: 3}
+	seats := TicTacToe_Seats{Game: "g", X: 1, O: 2}
+	seats.setQueue([]int{3, 4})
+	sent := []Message{
+		boardUpdate(&Game{State: "finished", Options: `{"mode":"classic"}`}, g),
+		seats.toMessage(),
+		ChatSettings{Enabled: true, MaxLength: 100, RateLimit: 3}.toMessage(),
+		{"type": "wait", "turn": 1, "place": 2},
+	}
+	checkSent(t, sent)
+
+	// and every message the browsers can send is described
+	for _, actions := range []map[string]Action{HostFromWeb, PlayerFromWeb} {
+		for msgType := range actions {
+			if _, ok := ticTacToeSchemas.Inbound[msgType]; !ok {
+				t.Errorf("No schema for %v", msgType)
+			}
+		}
+	}
+}
+
+// the list of players as the host's screen is sent it, made from real players, people and bots
+func Test_TicTacToeSchemas_Players(t *testing.T) {
+	db, done := tempDb(t)
+	defer done()
+
+	gs := &GameServiceImpl{Fabric: NewMemoryFabric()}
+	game, _, err := gs.NewGame("tictactoe", nil, "", db)
+	if err != nil {
+		t.Fatalf("New game error: %v", err)
+	}
+	for _, p := range []*Player{{Game: game.Id, Name: "Ann", Team: 1}, {Game: game.Id, Bot: "easy"}} {
+		if err = db.Insert(p); err != nil {
+			t.Fatalf("Couldn't add player: %v", err)
+		}
+		gs.PlayerJoin(game.Id, p.Id)
+	}
+
+	conn := &recordConn{}
+	if err = sendPlayers(game.Id, gs, conn, db); err != nil {
+		t.Fatalf("Couldn't send players: %v", err)
+	}
+	if players, _ := conn.msgs[0]["players"].([]Message); len(players) != 2 {
+		t.Fatalf("Expected both players to be listed: %#v", conn.msgs)
+	}
+	checkSent(t, conn.msgs)
+}
+
+// checks messages against the schemas of what they say they are, as the browser gets them
+func checkSent(t *testing.T, sent []Message) {
+	for _, msg := range sent {
+		data, _ := jsonCodec{}.Encode(msg)
+		msg, _ = jsonCodec{}.Decode(data)
+		schema, ok := ticTacToeSchemas.Outbound[msg["type"].(string)]
+		if !ok {
+			t.Errorf("No schema for %v", msg["type"])
+			continue
+		}
+		if err := validate(schema, map[string]interface{}(msg), ""); err != nil {
+			t.Errorf("%v doesn't match its schema: %v", msg["type"], err)
+		}
+	}
+}
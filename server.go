@@ -2,7 +2,11 @@ package main
 
 import (
 	"database/sql"
+	"flag"
 	"fmt"
+	"log"
+	"net"
+	"time"
 
 	"github.com/codegangsta/martini"
 	"github.com/coopernurse/gorp"
@@ -11,7 +15,53 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
+var (
+	brokerAddr  = flag.String("broker", "", "address of a broker to share games with other servers, games stay in this server without one")
+	dbPath      = flag.String("db", "dev.db", "SQLite database to keep games in, servers sharing games through a broker have to share it too")
+	serveBroker = flag.String("serve-broker", "", "run a broker on this address for other servers to share, instead of serving games")
+	reapAfter   = flag.Duration("reap-after", 30*time.Minute, "expire games nobody has been connected to or played in for this long")
+	reapDelete  = flag.Bool("reap-delete", false, "delete the events, players and boards of expired games")
+	advertiseOn = flag.Bool("advertise", true, "advertise the server and its games on the local network with mDNS")
+	discover    = flag.Bool("discover", false, "list the servers advertising on the local network, instead of serving games")
+	joinAddr    = flag.String("join-addr", "", "host:port phones reach this server at, for join links and QR codes, found from the network interfaces if not given")
+)
+
 func main() {
+	flag.Parse()
+
+	if *discover {
+		listServers()
+		return
+	}
+	if *serveBroker != "" {
+		l, err := net.Listen("tcp", *serveBroker)
+		nilOrPanic(err)
+		log.Printf("Broker listening on %v", l.Addr())
+		log.Fatal(NewBroker().Serve(l))
+	}
+
+	fmt.Printf("Creating game service")
+	var fabric Fabric = NewMemoryFabric()
+	if *brokerAddr != "" {
+		bf, err := NewBrokerFabric(*brokerAddr)
+		nilOrPanic(err)
+		fabric = bf
+	}
+	gs := &GameServiceImpl{Fabric: fabric}
+
+	db := initDb(*dbPath)
+	reaper := &Reaper{Idle: *reapAfter, Delete: *reapDelete}
+	go reaper.Run(db, gs)
+	if *advertiseOn {
+		go advertise(db, joinAddress(*joinAddr))
+	}
+
+	m := newServer(db, gs)
+	m.Run()
+}
+
+// sets up the routes and services of the app, separate from main so tests can run the whole thing
+func newServer(db *gorp.DbMap, gs GameService) *martini.ClassicMartini {
 	m := martini.Classic()
 
 	store := sessions.NewCookieStore([]byte("secret123"))
@@ -23,33 +73,81 @@ func main() {
 	m.Get("/tictactoe", TicTacToeHandler)
 	m.Post("/new/:game", NewGameHandler)
 	m.Get("/game/:id", GetGameHandler)
+	m.Get("/game/:id/join", JoinHandler)
+	m.Get("/game/:id/qr.png", QRPNGHandler)
+	m.Get("/game/:id/qr.svg", QRSVGHandler)
 	m.Get("/ws/:id", WebsocketHandler)
+	m.Get("/ws/:id/replay", ReplayWebsocketHandler)
+	m.Get("/sse/:id", StreamHandler)
+	m.Get("/poll/:id", PollHandler)
+	m.Post("/send/:id", SendHandler)
+	m.Get("/games", HistoryHandler)
+	m.Get("/games/:id/events", EventsHandler)
+	m.Get("/games/:id/replay", ReplayHandler)
+	m.Get("/games/:id/snapshot", SnapshotHandler)
+	m.Get("/games/:id/updates", UpdatesHandler)
+	m.Post("/games/:id/moves", MoveHandler)
+	m.Post("/games/:id/state", StateHandler)
+	m.Get("/players/:id/stats", PlayerStatsHandler)
+	m.Get("/leaderboard", LeaderboardHandler)
+	m.Get("/schemas", SchemasHandler)
+	m.Get("/schemas/:game", SchemaHandler)
 
-	m.Map(initDb("dev.db"))
-	fmt.Printf("Creating game service")
-	m.MapTo(&GameServiceImpl{ChannelMap: map[string]*Channels{}}, (*GameService)(nil))
+	m.Map(db)
+	m.MapTo(gs, (*GameService)(nil))
+	m.Map(joinAddress(*joinAddr))
+	m.Map(NewHTTPConns())
 
-	m.Run()
+	return m
 }
 
+// Tables add the tables a type of game keeps for itself to the database, keyed by game type. They're added with
+// everyone else's as the database is opened, since the first to play a game may be a phone on a server its host
+// isn't on.
+var Tables = map[string]func(db *gorp.DbMap){}
+
 func initDb(name string) *gorp.DbMap {
 	db, err := sql.Open("sqlite3", name)
 	nilOrPanic(err)
+	// sqlite only lets one connection write at a time, so share one rather than fail with "database is locked"
+	db.SetMaxOpenConns(1)
 
-	dbmap := &gorp.DbMap{Db: db, Dialect: gorp.SqliteDialect{}}
-
-	err = dbmap.DropTables()
+	// other servers may be writing to it too, so wait for them rather than fail
+	_, err = db.Exec("pragma busy_timeout = 5000")
 	nilOrPanic(err)
+
+	dbmap := &gorp.DbMap{Db: db, Dialect: gorp.SqliteDialect{}}
 	dbmap.AddTableWithName(Game{}, "games").SetKeys(false, "Id")
 	dbmap.AddTableWithName(Player{}, "players").SetKeys(true, "Id")
+	dbmap.AddTableWithName(Event{}, "events").SetKeys(true, "Id")
+	dbmap.AddTableWithName(Result{}, "results").SetKeys(true, "Id")
+	dbmap.AddTableWithName(ChatSettings{}, "chat_settings").SetKeys(false, "Game")
+	for _, add := range Tables {
+		add(dbmap)
+	}
 
-	// TODO: Use DB migration tool
 	err = dbmap.CreateTablesIfNotExists()
 	nilOrPanic(err)
+	// the tables that were already there may be from an older server
+	err = migrate(dbmap)
+	nilOrPanic(err)
 
 	return dbmap
 }
 
+// prints the servers found on the local network
+func listServers() {
+	conn, err := net.ListenPacket("udp4", ":0")
+	nilOrPanic(err)
+	group, err := net.ResolveUDPAddr("udp4", mdnsAddr)
+	nilOrPanic(err)
+	services, err := Browse(conn, group, 2*time.Second)
+	nilOrPanic(err)
+	for _, s := range services {
+		fmt.Printf("%v\t%v %v:%v\tversion %v, %v games\n", s.Instance, s.Host, s.IPs, s.Port, s.Text["version"], s.Text["games"])
+	}
+}
+
 func nilOrPanic(err error) {
 	if err != nil {
 		panic(err)
@@ -1,110 +1,71 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"log"
-	"sync"
+	"time"
 
 	"github.com/coopernurse/gorp"
 	"github.com/nu7hatch/gouuid"
 )
 
 type GameService interface {
-	NewGame(gameType string, db *gorp.DbMap) (*Game, *Player, error)
+	Fabric
+	NewGame(gameType string, options Message, party string, db *gorp.DbMap) (*Game, *Player, error)
 	ConnectToGame(db *gorp.DbMap, gameId string, playerObj interface{}) (*Game, *Player, error)
 	GetGame(db *gorp.DbMap, gameId string, playerId int) (*Game, *Player, error)
-	HostJoin(gameId string) chan Message
-	PlayerJoin(gameId string, playerId int) chan Message
-	PlayerLeave(gameId string, playerId int)
-	Broadcast(gameId string, msg Message)
-	SendHost(gameId string, msg Message)
-	GetConnectedPlayers(gameId string) []int
-}
-
-type Channels struct {
-	players map[int]chan Message
-	host    chan Message
 }
 
 // TODO: this all needs to be in a different package
 type GameServiceImpl struct {
-	sync.RWMutex
-	ChannelMap map[string]*Channels
+	Fabric // how messages get between the host and players
 }
 
-func (gs *GameServiceImpl) HostJoin(gameId string) chan Message {
-	gs.Lock()
-	defer gs.Unlock()
-	log.Printf("HERE")
-	// host is usually first to join a game so most of the time this will be called
-	if gs.ChannelMap[gameId] == nil {
-		log.Printf("channel map created for game %v", gameId)
-		gs.ChannelMap[gameId] = &Channels{players: map[int]chan Message{}}
-	}
-	if gs.ChannelMap[gameId].host == nil {
-		log.Printf("Host connecting for first time")
-		gs.ChannelMap[gameId].host = make(chan Message)
-	}
-	return gs.ChannelMap[gameId].host
-}
+// GameOptions check the options a type of game is created with and fill in the defaults, keyed by game type. Types
+// without an entry take no options.
+var GameOptions = map[string]func(options Message) (Message, error){}
 
-func (gs *GameServiceImpl) PlayerJoin(gameId string, playerId int) chan Message {
-	gs.Lock()
-	defer gs.Unlock()
-	// if the server restarts and a player rejoins before the host, this will be called
-	if gs.ChannelMap[gameId] == nil {
-		log.Printf("First player to connect to game is player %v", playerId)
-		gs.ChannelMap[gameId] = &Channels{players: map[int]chan Message{}}
+// checks the options for a new game, returning them with the defaults filled in
+func checkOptions(gameType string, options Message) (Message, error) {
+	if options == nil {
+		options = Message{}
 	}
-	gs.ChannelMap[gameId].players[playerId] = make(chan Message)
-	return gs.ChannelMap[gameId].players[playerId]
-}
-
-func (gs *GameServiceImpl) PlayerLeave(gameId string, playerId int) {
-	gs.Lock()
-	defer gs.Unlock()
-
-	close(gs.ChannelMap[gameId].players[playerId])
-	delete(gs.ChannelMap[gameId].players, playerId)
-}
-
-func (gs *GameServiceImpl) Broadcast(gameId string, msg Message) {
-	gs.RLock()
-	defer gs.RUnlock()
-
-	for _, p := range gs.ChannelMap[gameId].players {
-		p <- msg
-	}
-}
-
-func (gs *GameServiceImpl) SendHost(gameId string, msg Message) {
-	gs.RLock()
-	defer gs.RUnlock()
-
-	if gs.ChannelMap[gameId].host == nil {
-		log.Printf("HOST NOT CONNECTED?!")
+	check, ok := GameOptions[gameType]
+	if !ok {
+		if len(options) > 0 {
+			return nil, errors.New(gameType + " doesn't take any options")
+		}
+		return options, nil
 	}
-
-	gs.ChannelMap[gameId].host <- msg
+	return check(options)
 }
 
-func (gs *GameServiceImpl) GetConnectedPlayers(gameId string) []int {
-	gs.RLock()
-	defer gs.RUnlock()
-
-	players := []int{}
-	for pid, _ := range gs.ChannelMap[gameId].players {
-		players = append(players, pid)
+func (g Game) getOptions() (Message, error) {
+	options := Message{}
+	if g.Options == "" {
+		return options, nil
 	}
-	return players
+	err := json.Unmarshal([]byte(g.Options), &options)
+	return options, err
 }
 
-func (gs *GameServiceImpl) NewGame(gameType string, db *gorp.DbMap) (*Game, *Player, error) {
+// Creates a game hosted by a new player, with options already checked by checkOptions. Pass the party of the host's
+// previous game to keep the games together on the party leaderboard, or an empty party to start a new one.
+func (gs *GameServiceImpl) NewGame(gameType string, options Message, party string, db *gorp.DbMap) (*Game, *Player, error) {
 	u, err := uuid.NewV4()
 	if err != nil {
 		return nil, nil, err
 	}
-	game := &Game{Id: u.String(), State: "lobby", Type: gameType}
+	game := &Game{Id: u.String(), State: "lobby", Type: gameType, Party: party, Created: time.Now().UTC()}
+	if game.Party == "" {
+		game.Party = game.Id
+	}
+	bytes, err := json.Marshal(options)
+	if err != nil {
+		return nil, nil, err
+	}
+	game.Options = string(bytes)
 
 	err = db.Insert(game)
 	if err != nil {
@@ -121,6 +82,10 @@ func (gs *GameServiceImpl) NewGame(gameType string, db *gorp.DbMap) (*Game, *Pla
 		return nil, nil, err
 	}
 
+	if err = logTransition(db, game.Id, player.Id, "", game.State); err != nil {
+		log.Printf("Failed to record new game %v: %v", game.Id, err)
+	}
+
 	return game, player, nil
 }
 
@@ -133,8 +98,18 @@ func (gs *GameServiceImpl) ConnectToGame(db *gorp.DbMap, gameId string, playerOb
 		return nil, nil, errors.New("Player not saved to session")
 	}
 	game := obj.(*Game)
+	// don't let anyone new into a game the reaper has expired
+	if game.State == "expired" {
+		return game, nil, errGameEnded
+	}
 
 	var player *Player
+	if playerObj != nil {
+		// the player may have been deleted along with an expired game, in which case they're new again
+		if obj, err := db.Get(Player{}, playerObj); err == nil && obj == nil {
+			playerObj = nil
+		}
+	}
 	if playerObj == nil { // no, it's a new player
 		player = &Player{
 			Game: game.Id,
@@ -154,6 +129,7 @@ func (gs *GameServiceImpl) ConnectToGame(db *gorp.DbMap, gameId string, playerOb
 		// TODO: this would screw with any games they are currently already in?
 		if player.Game != game.Id {
 			player.Game = game.Id
+			player.Team = 0 // teams don't carry over between games
 			count, err := db.Update(player)
 			if count == 0 {
 				return nil, nil, errors.New("Player update effected 0 rows")
@@ -170,18 +146,28 @@ func (gs *GameServiceImpl) ConnectToGame(db *gorp.DbMap, gameId string, playerOb
 	return game, player, nil
 }
 
+// Gets a game and one of its players, or errGameEnded if the game has expired (its players may be gone with it).
 func (gs *GameServiceImpl) GetGame(db *gorp.DbMap, gameId string, playerId int) (*Game, *Player, error) {
-	obj, err := db.Get(Player{}, playerId)
+	// get the game from the db to load the state, other info
+	g, err := db.Get(Game{}, gameId)
 	if err != nil {
 		return nil, nil, err
 	}
-	player := obj.(*Player)
+	if g == nil {
+		return nil, nil, errors.New("No such game")
+	}
+	game := g.(*Game)
+	if game.State == "expired" {
+		return game, nil, errGameEnded
+	}
 
-	// get the game from the db to load the state, other info
-	g, err := db.Get(Game{}, gameId)
+	obj, err := db.Get(Player{}, playerId)
 	if err != nil {
 		return nil, nil, err
 	}
-	game := g.(*Game)
+	if obj == nil {
+		return nil, nil, errors.New("No such player")
+	}
+	player := obj.(*Player)
 	return game, player, nil
 }
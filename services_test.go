@@ -2,6 +2,7 @@ package main
 
 import (
 	"testing"
+	"time"
 )
 
 func Test_GameService(t *testing.T) {
@@ -9,8 +10,8 @@ func Test_GameService(t *testing.T) {
 	db.DropTables()
 	db = initDb("services_test.db")
 
-	gs := GameServiceImpl{ChannelMap: map[string]*Channels{}}
-	game, player, err := gs.NewGame(db)
+	gs := GameServiceImpl{Fabric: NewMemoryFabric()}
+	game, player, err := gs.NewGame("tictactoe", nil, "", db)
 	if err != nil {
 		t.Errorf("New game error: %#v", err)
 		return
@@ -23,7 +24,7 @@ func Test_GameService(t *testing.T) {
 	}
 
 	playerRead := gs.PlayerJoin(game.Id, player.Id)
-	defer gs.PlayerLeave(game.Id, player.Id)
+	defer gs.PlayerLeave(game.Id, player.Id, playerRead)
 
 	if playerRead == nil {
 		t.Errorf("Failed to initialize player channels")
@@ -42,14 +43,78 @@ func Test_GameService(t *testing.T) {
 		return
 	}
 
-	var actual2 Message
-	go func() {
-		actual2 = <-playerRead
-	}()
 	gs.Broadcast(game.Id, expected)
+	actual2 := <-playerRead
 
 	if actual2["hi"] != expected["hi"] {
 		t.Errorf("Couldn't send from host to player")
 		return
 	}
 }
+
+// sending to a host that never came is dropped, and one waiting for a host that left doesn't stop them coming back
+func Test_MemoryFabric_SendHost(t *testing.T) {
+	f := NewMemoryFabric()
+	f.SendHost("nobody", Message{"type": "join"})
+
+	f.HostJoin("g")
+	f.HostLeave("g")
+	sent := make(chan bool)
+	go func() {
+		f.SendHost("g", Message{"type": "join"})
+		close(sent)
+	}()
+
+	joined := make(chan chan Message)
+	go func() { joined <- f.HostJoin("g") }()
+	select {
+	case host := <-joined:
+		if msg := <-host; msg["type"] != "join" {
+			t.Errorf("Host got %#v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Host couldn't rejoin while a message waited for them")
+	}
+	<-sent
+}
+
+// a phone that reconnects before its old connection notices it dropped keeps the new one when the old one leaves
+func Test_MemoryFabric_Reconnect(t *testing.T) {
+	f := NewMemoryFabric()
+	f.HostJoin("g")
+	f.HostJoin("g")
+	f.HostLeave("g")
+	if !f.HostConnected("g") {
+		t.Errorf("Host's old connection leaving disconnected the new one")
+	}
+
+	old := f.PlayerJoin("g", 1)
+	current := f.PlayerJoin("g", 1)
+	if _, ok := <-old; ok {
+		t.Errorf("Old connection should close when the player reconnects")
+	}
+	if f.PlayerLeave("g", 1, old) {
+		t.Errorf("Old connection leaving should say the player is still here")
+	}
+
+	f.Broadcast("g", Message{"type": "update"})
+	select {
+	case msg := <-current:
+		if msg["type"] != "update" {
+			t.Errorf("Reconnected player got %#v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Reconnected player stopped getting broadcasts after the old connection left")
+	}
+	if players := f.GetConnectedPlayers("g"); len(players) != 1 {
+		t.Errorf("Expected the reconnected player, got %v", players)
+	}
+
+	if !f.PlayerLeave("g", 1, current) {
+		t.Errorf("Player's current connection should leave")
+	}
+	f.HostLeave("g")
+	if f.HostConnected("g") {
+		t.Errorf("Host is still connected after both connections left")
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/codegangsta/martini"
+	"github.com/coopernurse/gorp"
+	"github.com/martini-contrib/render"
+)
+
+// How a player did in a finished game. A player keeps the same row (and id) across games for as long as their
+// phone keeps its session, so these add up to statistics per device.
+type Result struct {
+	Id       int       `json:"id"`
+	Game     string    `json:"game"`    // foreign key to game
+	Player   int       `json:"player"`  // foreign key to player
+	Type     string    `json:"type"`    // type of game, copied from the game so stats don't need a join
+	Party    string    `json:"party"`   // party of the game, copied for the same reason
+	Team     int       `json:"team"`    // the team the player was on, 0 if they weren't on one
+	Outcome  string    `json:"outcome"` // "win", "loss" or "draw"
+	Finished time.Time `json:"finished"`
+}
+
+const (
+	Win  = "win"
+	Loss = "loss"
+	Draw = "draw"
+)
+
+// Totals of a player's results, either per game type or across all of them.
+type Stats struct {
+	Player int    `json:"player"`
+	Name   string `json:"name"`
+	Type   string `json:"type,omitempty"`
+	Played int    `json:"played"`
+	Wins   int    `json:"wins"`
+	Losses int    `json:"losses"`
+	Draws  int    `json:"draws"`
+}
+
+// the columns of Stats summed up from the results table
+const statsColumns = `results.player as player, players.name as name, count(*) as played,
+	sum(case when outcome='win' then 1 else 0 end) as wins,
+	sum(case when outcome='loss' then 1 else 0 end) as losses,
+	sum(case when outcome='draw' then 1 else 0 end) as draws`
+
+// Records the outcome of a finished game for everyone that played in it. The winner is a player id, or a team
+// number when playing in teams, or 0 for a draw. When only some of the players sat at the board, seated is who
+// they were, otherwise it's nil.
+func recordResults(game *Game, winner int, seated []int, db *gorp.DbMap) error {
+	var players []*Player
+	_, err := db.Select(&players, "select * from players where game=?", game.Id)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range players {
+		if p.Role == Host || (game.Teams > 0 && p.Team == 0) || (seated != nil && !containsInt(seated, p.Id)) {
+			continue
+		}
+		owner := p.Id
+		if game.Teams > 0 {
+			owner = p.Team
+		}
+		outcome := Loss
+		if winner == 0 {
+			outcome = Draw
+		} else if winner == owner {
+			outcome = Win
+		}
+		err = db.Insert(&Result{
+			Game:     game.Id,
+			Player:   p.Id,
+			Type:     game.Type,
+			Party:    game.Party,
+			Team:     p.Team,
+			Outcome:  outcome,
+			Finished: game.Finished,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// a player's totals for each type of game they've played
+func getPlayerStats(db *gorp.DbMap, playerId int) ([]*Stats, error) {
+	var stats []*Stats
+	_, err := db.Select(&stats, "select "+statsColumns+`, results.type as type
+		from results join players on players.id = results.player
+		where results.player=? group by results.player, results.type order by results.type`, playerId)
+	return stats, err
+}
+
+// The best players by wins, then draws, then fewest games played. Leave gameType or party empty to not filter by
+// them, and pass a zero since to count every result.
+func getLeaderboard(db *gorp.DbMap, gameType, party string, since time.Time, limit int) ([]*Stats, error) {
+	query := "select " + statsColumns + " from results join players on players.id = results.player where 1=1"
+	args := []interface{}{}
+	if gameType != "" {
+		query += " and results.type=?"
+		args = append(args, gameType)
+	}
+	if party != "" {
+		query += " and results.party=?"
+		args = append(args, party)
+	}
+	if !since.IsZero() {
+		query += " and results.finished>=?"
+		args = append(args, since.UTC())
+	}
+	query += " group by results.player order by wins desc, draws desc, played asc limit ?"
+	args = append(args, limit)
+
+	var stats []*Stats
+	_, err := db.Select(&stats, query, args...)
+	return stats, err
+}
+
+// shows how a player has done in every type of game
+func PlayerStatsHandler(r render.Render, params martini.Params, db *gorp.DbMap, log *log.Logger) {
+	playerId, err := strconv.Atoi(params["id"])
+	if err != nil {
+		r.JSON(400, Message{"message": "Player id must be a number"})
+		return
+	}
+	obj, err := db.Get(Player{}, playerId)
+	if err != nil {
+		log.Printf("Failed to get player %v: %v", playerId, err)
+		r.JSON(500, Message{"message": "Failed to get player"})
+		return
+	}
+	if obj == nil {
+		r.JSON(404, Message{"message": "No such player"})
+		return
+	}
+	stats, err := getPlayerStats(db, playerId)
+	if err != nil {
+		log.Printf("Failed to get stats for player %v: %v", playerId, err)
+		r.JSON(500, Message{"message": "Failed to get stats"})
+		return
+	}
+	if stats == nil {
+		stats = []*Stats{}
+	}
+	r.JSON(200, Message{"player": playerId, "name": obj.(*Player).Name, "stats": stats})
+}
+
+// Ranks players for all time, or just the past week with period=week. Filter with the type and party query
+// parameters, and show more or fewer players with limit.
+func LeaderboardHandler(r render.Render, req *http.Request, db *gorp.DbMap, log *log.Logger) {
+	query := req.URL.Query()
+
+	var since time.Time
+	switch query.Get("period") {
+	case "", "all":
+	case "week":
+		since = time.Now().AddDate(0, 0, -7)
+	default:
+		r.JSON(400, Message{"message": "`period` must be all or week"})
+		return
+	}
+
+	limit := 10
+	if l := query.Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 {
+			r.JSON(400, Message{"message": "`limit` must be a positive number"})
+			return
+		}
+	}
+
+	stats, err := getLeaderboard(db, query.Get("type"), query.Get("party"), since, limit)
+	if err != nil {
+		log.Printf("Failed to get leaderboard: %v", err)
+		r.JSON(500, Message{"message": "Failed to get leaderboard"})
+		return
+	}
+	if stats == nil {
+		stats = []*Stats{}
+	}
+	r.JSON(200, Message{"leaderboard": stats})
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"log"
+	"sort"
+
+	"github.com/coopernurse/gorp"
+)
+
+// Gets the connected players of a game in a form the UI can list, ordered by when they first joined.
+func getPlayerList(gameId string, gs GameService, db *gorp.DbMap) ([]Message, error) {
+	pids := gs.GetConnectedPlayers(gameId)
+	sort.Ints(pids)
+	chat, err := getChatSettings(gameId, db)
+	if err != nil {
+		return nil, err
+	}
+
+	// angular wants an array of objects, it can't handle an array of ints
+	players := []Message{}
+	for _, pid := range pids {
+		obj, err := db.Get(Player{}, pid)
+		if err != nil {
+			return nil, err
+		}
+		if obj == nil {
+			continue
+		}
+		p := obj.(*Player)
+		players = append(players, Message{"id": p.Id, "name": p.Name, "team": p.Team, "bot": p.Bot, "muted": chat.isMuted(p.Id)})
+	}
+	return players, nil
+}
+
+// sends a fresh list of players to the host's screen
+func sendPlayers(gameId string, gs GameService, conn Conn, db *gorp.DbMap) error {
+	players, err := getPlayerList(gameId, gs, db)
+	if err != nil {
+		return err
+	}
+	conn.Send(Message{
+		"type":    "players",
+		"players": players,
+	})
+	return nil
+}
+
+// the team with the fewest players in it, so new players keep the teams even
+func smallestTeam(gameId string, teams int, db *gorp.DbMap) (int, error) {
+	smallest, fewest := 1, -1
+	for team := 1; team <= teams; team++ {
+		count, err := db.SelectInt("select count(*) from players where game=? and team=?", gameId, team)
+		if err != nil {
+			return 0, err
+		}
+		if fewest == -1 || int(count) < fewest {
+			smallest, fewest = team, int(count)
+		}
+	}
+	return smallest, nil
+}
+
+// puts a player that joins a team game onto the smallest team
+func joinTeam(game *Game, player *Player, db *gorp.DbMap) error {
+	if game.Teams == 0 || (player.Team > 0 && player.Team <= game.Teams) {
+		return nil
+	}
+	team, err := smallestTeam(game.Id, game.Teams, db)
+	if err != nil {
+		return err
+	}
+	player.Team = team
+	_, err = db.Update(player)
+	return err
+}
+
+// the host splits the connected players evenly into the number of teams given, or back into individuals with 0
+func hostBalance(msg Message, gameId string, playerId int, gs GameService, conn Conn, db *gorp.DbMap, log *log.Logger) error {
+	game, _, err := gs.GetGame(db, gameId, playerId)
+	if err != nil {
+		log.Printf("Couldn't get game to balance teams: %#v", err)
+		return err
+	}
+	if game.State != "lobby" {
+		conn.Send(Message{"type": "error", "message": "Teams can only be changed in the lobby"})
+		return nil
+	}
+	if gameMode(game) == ClassicMode {
+		conn.Send(Message{"type": "error", "message": "Classic games are played one on one"})
+		return nil
+	}
+	teams, ok := msg["teams"].(float64)
+	if !ok || teams < 0 {
+		conn.Send(Message{"type": "error", "message": "Provide a number of `teams`"})
+		return nil
+	}
+
+	game.Teams = int(teams)
+	_, err = db.Update(game)
+	if err != nil {
+		log.Printf("Unable to save number of teams: %#v", err)
+		return err
+	}
+
+	pids := gs.GetConnectedPlayers(gameId)
+	sort.Ints(pids)
+	for i, pid := range pids {
+		obj, err := db.Get(Player{}, pid)
+		if err != nil {
+			log.Printf("Couldn't get player %v to balance: %#v", pid, err)
+			return err
+		}
+		if obj == nil {
+			continue
+		}
+		p := obj.(*Player)
+		p.Team = 0
+		if game.Teams > 0 {
+			p.Team = i%game.Teams + 1
+		}
+		_, err = db.Update(p)
+		if err != nil {
+			log.Printf("Unable to put player %v on team: %#v", pid, err)
+			return err
+		}
+	}
+	log.Printf("Balanced %v players into %v teams", len(pids), game.Teams)
+	return sendPlayers(gameId, gs, conn, db)
+}
+
+// the host moves a single player onto a team
+func hostTeam(msg Message, gameId string, playerId int, gs GameService, conn Conn, db *gorp.DbMap, log *log.Logger) error {
+	game, _, err := gs.GetGame(db, gameId, playerId)
+	if err != nil {
+		log.Printf("Couldn't get game to change team: %#v", err)
+		return err
+	}
+	if game.State != "lobby" {
+		conn.Send(Message{"type": "error", "message": "Teams can only be changed in the lobby"})
+		return nil
+	}
+	pid, ok := msg["player"].(float64)
+	team, ok2 := msg["team"].(float64)
+	if !ok || !ok2 || team < 1 {
+		conn.Send(Message{"type": "error", "message": "Provide a `player` and a `team`"})
+		return nil
+	}
+
+	obj, err := db.Get(Player{}, int(pid))
+	if err != nil {
+		log.Printf("Couldn't get player %v: %#v", pid, err)
+		return err
+	}
+	if obj == nil || obj.(*Player).Game != gameId || obj.(*Player).Role == Host {
+		conn.Send(Message{"type": "error", "message": "That player isn't in this game"})
+		return nil
+	}
+	p := obj.(*Player)
+	p.Team = int(team)
+	_, err = db.Update(p)
+	if err != nil {
+		log.Printf("Unable to put player %v on team: %#v", p.Id, err)
+		return err
+	}
+
+	// assigning a player to a team that doesn't exist yet adds it
+	if p.Team > game.Teams {
+		game.Teams = p.Team
+		_, err = db.Update(game)
+		if err != nil {
+			log.Printf("Unable to save number of teams: %#v", err)
+			return err
+		}
+	}
+	return sendPlayers(gameId, gs, conn, db)
+}
@@ -2,24 +2,36 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"math/rand"
+	"sync"
+	"time"
 
 	"github.com/coopernurse/gorp"
-	"github.com/gorilla/websocket"
 )
 
 // tictactoe domain objects
 type TicTacToe_Turn struct {
 	Id     int
-	Player int    // foreign key to player
-	Game   string // foreign key to game (do we need this?)
-	Move   int    // the last move the player entered
+	Player int       // foreign key to player
+	Game   string    // foreign key to game (do we need this?)
+	Move   int       // the last move the player entered
+	Moved  time.Time // when they entered it, for settling collisions by who was first
 }
 
+// A game keeps a board for every round played so far, the latest of which is the one in play.
 type TicTacToe_Board struct {
-	Id    int
-	Game  string // foreign key to game
-	Board string // the board represented as a string
+	Id     int
+	Game   string // foreign key to game
+	Board  string // the board represented as a string, a row at a time
+	Width  int    // number of columns
+	Height int    // number of rows
+	Win    int    // how many in a row it takes to win
+	Round  int    // the round that left the board like this, 0 for the empty board a game starts with
+	Moves  string // the moves made that round, as JSON, so it can be undone
+	Seats  string // the seats of a classic game before the round, as JSON
 }
 
 func (g TicTacToe_Board) getBoard() ([]int, error) {
@@ -40,7 +52,86 @@ func (g *TicTacToe_Board) setBoard(v []int) error {
 	return nil
 }
 
-type Action func(msg Message, gameId string, playerId int, gs GameService, ws *websocket.Conn, db *gorp.DbMap, log *log.Logger) error
+// the board along with its dimensions
+func (g TicTacToe_Board) getGrid() (grid, error) {
+	cells, err := g.getBoard()
+	if err != nil {
+		return grid{}, err
+	}
+	return grid{cells: cells, width: g.Width, height: g.Height, win: g.Win}, nil
+}
+
+// the largest board a game can be created with, big enough for go-sized gomoku
+const maxBoardSize = 19
+
+// Checks the width, height and win options of a new game, which default to regular 3x3 tic-tac-toe. A 15x15 board
+// with 5 to win plays like gomoku. The collisions option picks how cells more than one player goes in are settled,
+// and games settled at random are given a seed unless they bring their own. The mode option picks between
+// everyone moving at once and classic games of two players taking turns, and series makes rematches a best of
+// that many games.
+func ticTacToeOptions(options Message) (Message, error) {
+	checked := Message{}
+	for _, name := range []string{"width", "height", "win"} {
+		checked[name] = 3
+		v, ok := options[name]
+		if !ok {
+			continue
+		}
+		n, ok := v.(float64)
+		if !ok || n != float64(int(n)) || n < 3 || n > maxBoardSize {
+			return nil, errors.New("`" + name + "` must be a whole number from 3 to 19")
+		}
+		checked[name] = int(n)
+	}
+	checked["collisions"] = CancelCollisions
+	if v, ok := options["collisions"]; ok {
+		rule, _ := v.(string)
+		known := false
+		for _, r := range collisionRules {
+			known = known || r == rule
+		}
+		if !known {
+			return nil, errors.New("`collisions` must be one of cancel, first, random or contested")
+		}
+		checked["collisions"] = rule
+	}
+	checked["series"] = 1
+	if v, ok := options["series"]; ok {
+		n, ok := v.(float64)
+		if !ok || n != float64(int(n)) || n < 1 || n > maxSeries {
+			return nil, errors.New("`series` must be a whole number from 1 to 99")
+		}
+		checked["series"] = int(n)
+	}
+	checked["mode"] = FreeMode
+	if v, ok := options["mode"]; ok {
+		mode, _ := v.(string)
+		if mode != FreeMode && mode != ClassicMode {
+			return nil, errors.New("`mode` must be free or classic")
+		}
+		checked["mode"] = mode
+	}
+	if v, ok := options["seed"]; ok {
+		n, ok := v.(float64)
+		if !ok || n != float64(int32(n)) {
+			return nil, errors.New("`seed` must be a whole number")
+		}
+		checked["seed"] = int(n)
+	} else if checked["collisions"] == RandomCollisions {
+		checked["seed"] = int(rand.Int31())
+	}
+	for name := range options {
+		if _, ok := checked[name]; !ok {
+			return nil, errors.New("tictactoe has no `" + name + "` option")
+		}
+	}
+	if win := checked["win"].(int); win > checked["width"].(int) && win > checked["height"].(int) {
+		return nil, errors.New("`win` can't be longer than the board")
+	}
+	return checked, nil
+}
+
+type Action func(msg Message, gameId string, playerId int, gs GameService, conn Conn, db *gorp.DbMap, log *log.Logger) error
 
 // To define a game, all you need is to insert key-value pairs of message types to actions (handlers), and
 // provide PlayerInit and HostInit functions.
@@ -51,98 +142,123 @@ var PlayerFromHost map[string]Action
 
 func init() {
 	PlayerFromWeb = map[string]Action{
-		"move": playerMove,
+		"move":  playerMove,
+		"chat":  playerChat,
+		"react": playerReact,
 	}
 	PlayerFromHost = map[string]Action{
-		"update": playerForward,
+		"update":        playerForward,
+		"chat":          playerForward,
+		"react":         playerForward,
+		"clear_chat":    playerForward,
+		"chat_settings": playerForward,
+		"collision":     playerForward,
+		"series":        playerForward,
+		"seats":         playerSeats,
 	}
 	HostFromWeb = map[string]Action{
-		"state": hostState,
+		"state":         hostState,
+		"balance":       hostBalance,
+		"team":          hostTeam,
+		"addbot":        hostAddBot,
+		"removebot":     hostRemoveBot,
+		"mute":          hostMute,
+		"unmute":        hostMute,
+		"clear_chat":    hostClearChat,
+		"chat_settings": hostChatSettings,
+		"undo":          hostUndo,
+		"pause":         hostPause,
+		"resume":        hostPause,
+		"rematch":       hostRematch,
 	}
 	HostFromPlayer = map[string]Action{
 		"join":  hostJoinLeave,
 		"leave": hostJoinLeave,
 		"move":  hostMove,
+		"chat":  hostChat,
+		"react": hostChat,
 	}
+	Tables["tictactoe"] = addTicTacToeTables
+	Cleanups["tictactoe"] = cleanupGame
+	GameOptions["tictactoe"] = ticTacToeOptions
+	Schemas["tictactoe"] = ticTacToeSchemas
 }
 
-func PlayerInit(playerId int, gameId string, gs GameService, ws *websocket.Conn, db *gorp.DbMap) error {
+func PlayerInit(playerId int, gameId string, gs GameService, conn Conn, db *gorp.DbMap) error {
 	log.Printf("Player is connected: %#v", playerId)
 
-	game, _, err := gs.GetGame(db, gameId, playerId)
+	game, player, err := gs.GetGame(db, gameId, playerId)
 	if err != nil {
 		log.Printf("Couldn't get player and/or game")
 		return err
 	}
 
-	if game.State == "start" {
-		log.Printf("Player %#v rejoining game in play", playerId)
-		board, err := getBoard(gameId, db)
+	if game.State == "lobby" {
+		err = joinTeam(game, player, db)
 		if err != nil {
-			log.Printf("Can't get TTT board: %#v", err)
+			log.Printf("Unable to put player on a team: %#v", err)
 			return err
 		}
+	}
 
-		log.Printf("Got board, getting nicer one: %#v", board)
-		niceBoard, err := board.getBoard()
-		if err != nil {
-			log.Printf("Unable to get nice board: %#v", err)
-			return err
-		}
-		log.Printf("Got board for player %#v: %#v", playerId, board)
+	if game.State != "lobby" {
+		log.Printf("Player %#v rejoining game in play", playerId)
+	}
+	update, err := currentUpdate(game, db)
+	if err != nil {
+		return err
+	}
+	conn.Send(update)
 
-		// There may not be a board yet so just try and send it
-		ws.WriteJSON(Message{
-			"type":  "update",
-			"state": game.State,
-			"board": niceBoard,
-		})
-	} else {
-		ws.WriteJSON(Message{
-			"type":  "update",
-			"state": game.State,
-			"board": nil,
-		})
+	err = ensureTurn(gameId, playerId, db)
+	if err != nil {
+		log.Printf("Unable to insert initial turn row: %#v", err)
+		return err
 	}
 
-	// check to make sure this player has a turn row
-	turn := TicTacToe_Turn{}
-	err = db.SelectOne(&turn, "select * from tictactoe_turn where game=? and player=?", gameId, playerId)
+	chat, err := getChatSettings(gameId, db)
 	if err != nil {
-		turn.Game = gameId
-		turn.Player = playerId
-		turn.Move = -1
-		err = db.Insert(&turn)
-		if err != nil {
-			log.Printf("Unable to insert initial turn row: %#v", err)
-			return err
-		}
+		log.Printf("Unable to get chat settings: %#v", err)
+		return err
 	}
+	conn.Send(chat.toMessage())
 
-	gs.SendHost(gameId, Message{"type": "join"})
+	gs.SendHost(gameId, Message{"type": "join", "player": playerId})
 	return nil
 }
 
-func PlayerLeave(playerId int, gameId string, gs GameService, ws *websocket.Conn, db *gorp.DbMap) {
-	gs.SendHost(gameId, Message{"type": "leave"})
+// the update a player needs to catch up with the game as it is now, with no board before it's started
+func currentUpdate(game *Game, db *gorp.DbMap) (Message, error) {
+	if game.State == "lobby" {
+		return Message{
+			"type":  "update",
+			"state": game.State,
+			"board": nil,
+		}, nil
+	}
+	board, err := getBoard(game.Id, db)
+	if err != nil {
+		log.Printf("Can't get TTT board: %#v", err)
+		return nil, err
+	}
+	niceBoard, err := board.getGrid()
+	if err != nil {
+		log.Printf("Unable to get nice board: %#v", err)
+		return nil, err
+	}
+	return boardUpdate(game, niceBoard), nil
+}
+
+func PlayerLeave(playerId int, gameId string, gs GameService, conn Conn, db *gorp.DbMap) {
+	forgetChat(playerId)
+	gs.SendHost(gameId, Message{"type": "leave", "player": playerId})
 }
 
 // Called first when a host connects.
 // NOTE that this may be called multiple times as a host may drop and reconnect.
-func HostInit(playerId int, gameId string, gs GameService, ws *websocket.Conn, wsReadChan chan Message, db *gorp.DbMap) error {
+func HostInit(playerId int, gameId string, gs GameService, conn Conn, wsReadChan chan Message, db *gorp.DbMap) error {
 	log.Printf("Host initing")
 
-	// since host is always the first to connect, setup tables if they don't already exist
-	db.AddTableWithName(TicTacToe_Board{}, "tictactoe_board").SetKeys(true, "Id")
-	db.AddTableWithName(TicTacToe_Turn{}, "tictactoe_turn").SetKeys(true, "Id")
-	err := db.CreateTablesIfNotExists()
-	if err != nil {
-		log.Printf("Unable to create TTT tables: %#v", err)
-		return err
-	}
-
-	log.Printf("Tables created")
-
 	// get the game so we know what state we should be in
 	game, _, err := gs.GetGame(db, gameId, playerId)
 	if err != nil {
@@ -156,18 +272,12 @@ func HostInit(playerId int, gameId string, gs GameService, ws *websocket.Conn, w
 		log.Printf("Game is still in lobby")
 
 		// update the lobby based on players that are currently connected
-		pids := gs.GetConnectedPlayers(gameId)
-		// angular wants an array of objects, it can't handle an array of ints
-		players := []Message{}
-		for _, pid := range pids {
-			players = append(players, Message{"id": pid})
+		err = sendPlayers(gameId, gs, conn, db)
+		if err != nil {
+			log.Printf("Unable to send players: %#v", err)
+			return err
 		}
-
-		ws.WriteJSON(Message{
-			"type":    "players",
-			"players": players,
-		})
-		ws.WriteJSON(Message{
+		conn.Send(Message{
 			"type":  "state",
 			"state": game.State,
 		})
@@ -181,21 +291,41 @@ func HostInit(playerId int, gameId string, gs GameService, ws *websocket.Conn, w
 		}
 
 		log.Printf("Getting nicer board: %#v", board)
-		niceBoard, err := board.getBoard()
+		niceBoard, err := board.getGrid()
 		if err != nil {
 			log.Printf("Can't init with board: %#v", err)
 			return err
 		}
-		ws.WriteJSON(Message{
-			"type":  "update",
-			"board": niceBoard,
-			"state": "start",
-		})
+		conn.Send(boardUpdate(game, niceBoard))
+	}
+
+	if gameMode(game) == ClassicMode {
+		seats, err := getSeats(gameId, db)
+		if err != nil {
+			log.Printf("Unable to get seats: %#v", err)
+			return err
+		}
+		conn.Send(seats.toMessage())
+	}
+	if game.State == "finished" {
+		series, err := seriesMessage(game, db)
+		if err != nil {
+			log.Printf("Unable to get series: %#v", err)
+			return err
+		}
+		conn.Send(series)
+	}
+
+	chat, err := getChatSettings(gameId, db)
+	if err != nil {
+		log.Printf("Unable to get chat settings: %#v", err)
+		return err
 	}
+	conn.Send(chat.toMessage())
 	return nil
 }
 
-func playerMove(msg Message, gameId string, playerId int, gs GameService, ws *websocket.Conn, db *gorp.DbMap, log *log.Logger) error {
+func playerMove(msg Message, gameId string, playerId int, gs GameService, conn Conn, db *gorp.DbMap, log *log.Logger) error {
 	log.Printf("Sending move to host")
 	turn := TicTacToe_Turn{}
 	err := db.SelectOne(&turn, "select * from tictactoe_turn where game=? and player=?", gameId, playerId)
@@ -204,9 +334,55 @@ func playerMove(msg Message, gameId string, playerId int, gs GameService, ws *we
 		return err
 	}
 
-	// the player move comes as an integer from [0-8] representing the location of the move
-	// TODO: assert this is the case before saving
-	turn.Move = int(msg["move"].(float64))
+	game, _, err := gs.GetGame(db, gameId, playerId)
+	if err != nil {
+		log.Printf("Unable to get game in move: %#v", err)
+		return err
+	}
+	if game.State == "paused" {
+		conn.Send(Message{"type": "error", "message": "The game is paused"})
+		return nil
+	}
+	if game.State != "start" {
+		conn.Send(Message{"type": "error", "message": "The game isn't in play"})
+		return nil
+	}
+
+	// the player move comes as an integer representing the location of the move, counting across each row in turn
+	move, ok := msg["move"].(float64)
+	var cells []int
+	if ok {
+		board, err := getBoard(gameId, db)
+		if err != nil {
+			log.Printf("Unable to get board in move: %#v", err)
+			return err
+		}
+		cells, _ = board.getBoard()
+		ok = move >= 0 && int(move) < len(cells)
+	}
+	if !ok {
+		conn.Send(Message{"type": "error", "message": "`move` must be a cell on the board"})
+		return nil
+	}
+
+	// in classic games only the player whose turn it is can move, and only somewhere empty
+	if gameMode(game) == ClassicMode {
+		seats, err := getSeats(gameId, db)
+		if err != nil {
+			log.Printf("Unable to get seats in move: %#v", err)
+			return err
+		}
+		if seats.Turn != playerId {
+			conn.Send(Message{"type": "error", "message": "It's not your turn"})
+			return nil
+		}
+		if cells[int(move)] != 0 {
+			conn.Send(Message{"type": "error", "message": "That cell is taken"})
+			return nil
+		}
+	}
+	turn.Move = int(move)
+	turn.Moved = time.Now().UTC()
 	_, err = db.Update(&turn)
 	if err != nil {
 		log.Printf("Failed to update moving player: %#v", err)
@@ -218,13 +394,22 @@ func playerMove(msg Message, gameId string, playerId int, gs GameService, ws *we
 	return nil
 }
 
-func playerForward(msg Message, gameId string, playerId int, gs GameService, ws *websocket.Conn, db *gorp.DbMap, log *log.Logger) error {
+func playerForward(msg Message, gameId string, playerId int, gs GameService, conn Conn, db *gorp.DbMap, log *log.Logger) error {
 	log.Printf("Sending %v to player %v", msg["type"], playerId)
-	ws.WriteJSON(msg)
+	conn.Send(msg)
 	return nil
 }
 
-func hostState(msg Message, gameId string, playerId int, gs GameService, ws *websocket.Conn, db *gorp.DbMap, log *log.Logger) error {
+// The states the host can change a game to from each state. A game leaves the lobby to start, one in play or paused
+// can be ended early, and a finished one can be played again or taken back to the lobby.
+var hostTransitions = map[string][]string{
+	"lobby":    {"start"},
+	"start":    {"finished"},
+	"paused":   {"finished"},
+	"finished": {"start", "lobby"},
+}
+
+func hostState(msg Message, gameId string, playerId int, gs GameService, conn Conn, db *gorp.DbMap, log *log.Logger) error {
 	log.Printf("Got state change request from host: %v", msg["state"])
 
 	game, _, err := gs.GetGame(db, gameId, playerId)
@@ -233,14 +418,51 @@ func hostState(msg Message, gameId string, playerId int, gs GameService, ws *web
 		return err
 	}
 
-	// TODO: check to make sure this is a valid state
-	game.State = msg["state"].(string)
+	// the schema has made sure it's a state the host can ask for, but not that the game can get there from here
+	from := game.State
+	to := msg["state"].(string)
+	allowed := false
+	for _, state := range hostTransitions[from] {
+		allowed = allowed || state == to
+	}
+	if !allowed {
+		conn.Send(Message{"type": "error", "message": fmt.Sprintf("A game that's %v can't be changed to %v", from, to)})
+		return nil
+	}
+	game.State = to
 	var board *TicTacToe_Board
+	var seats *TicTacToe_Seats
 	if game.State == "start" {
-		board = &TicTacToe_Board{Game: gameId}
+		options, err := game.getOptions()
+		if err != nil {
+			log.Printf("Unable to read game options: %#v", err)
+			return err
+		}
+		if gameMode(game) == ClassicMode {
+			seats, err = getSeats(gameId, db)
+			if err != nil {
+				log.Printf("Unable to get seats: %#v", err)
+				return err
+			}
+			if seats.Turn == 0 {
+				conn.Send(Message{"type": "error", "message": "Classic games need two players"})
+				return nil
+			}
+		}
+		game.Started = time.Now().UTC()
+		game.Finished = time.Time{}
+		game.Rounds = 0
+
+		g := newGrid(options)
 		log.Printf("Setting up starting objects")
-		// we are starting a game, so insert a new board
-		err = board.setBoard([]int{0, 0, 0, 0, 0, 0, 0, 0, 0})
+		// a game being played again starts its rounds over
+		_, err = db.Exec("delete from tictactoe_board where Game=?", gameId)
+		if err != nil {
+			log.Printf("Couldn't clear old boards: %#v", err)
+			return err
+		}
+		board = &TicTacToe_Board{Game: gameId, Width: g.width, Height: g.height, Win: g.win}
+		err = board.setBoard(g.cells)
 		if err != nil {
 			log.Printf("Unable to set game board: %#v", err)
 			return err
@@ -251,6 +473,12 @@ func hostState(msg Message, gameId string, playerId int, gs GameService, ws *web
 			log.Printf("Couldn't insert board: %#v", err)
 			return err
 		}
+		// and nobody's moves from the last game carry over
+		_, err = db.Exec("update tictactoe_turn set Move=-1 where Game=?", gameId)
+		if err != nil {
+			log.Printf("Couldn't reset turns: %#v", err)
+			return err
+		}
 	} else {
 		board, err = getBoard(gameId, db)
 		if err != nil {
@@ -264,73 +492,134 @@ func hostState(msg Message, gameId string, playerId int, gs GameService, ws *web
 		log.Printf("Unable to change game state: %v", err)
 		return err
 	}
-	niceBoard, err := board.getBoard()
+	if err = logTransition(db, gameId, playerId, from, game.State); err != nil {
+		log.Printf("Failed to record state change: %v", err)
+	}
+	niceBoard, err := board.getGrid()
 	if err != nil {
 		log.Printf("Error getting board: %#v", board)
 		return err
 	}
 	log.Printf("Sending state %v to all players", msg["state"])
-	gs.Broadcast(gameId, Message{
-		"type":  "update",
-		"board": niceBoard,
-		"state": "start",
-	})
-	log.Printf("Updating UI")
-	ws.WriteJSON(Message{
-		"type":  "update",
-		"board": niceBoard,
-		"state": "start",
-	})
+	sendUpdate(gameId, playerId, gs, conn, db, boardUpdate(game, niceBoard))
+	if seats != nil {
+		sendSeats(gameId, seats, gs, conn)
+	}
 	return nil
 }
 
-func hostJoinLeave(msg Message, gameId string, playerId int, gs GameService, ws *websocket.Conn, db *gorp.DbMap, log *log.Logger) error {
-	log.Printf("player %v", msg["type"])
-	// send a fresh list of players to the UI
+// The host pauses a game in play, say while somebody gets snacks, and resumes it when they're back. Moves are
+// refused while it's paused and everyone is shown the paused board. The pause is kept in the game's state so it
+// lasts through the host reconnecting.
+func hostPause(msg Message, gameId string, playerId int, gs GameService, conn Conn, db *gorp.DbMap, log *log.Logger) error {
+	game, _, err := gs.GetGame(db, gameId, playerId)
+	if err != nil {
+		log.Printf("Couldn't get game to %v: %#v", msg["type"], err)
+		return err
+	}
+	from, to := "start", "paused"
+	if msg["type"] == "resume" {
+		from, to = to, from
+	}
+	if game.State != from {
+		conn.Send(Message{"type": "error", "message": "Only a game in play can be paused, and only a paused game resumed"})
+		return nil
+	}
 
-	pids := gs.GetConnectedPlayers(gameId)
-	// angular wants an array of objects, it can't handle an array of ints
-	players := []Message{}
-	for _, pid := range pids {
-		players = append(players, Message{"id": pid})
+	game.State = to
+	_, err = db.Update(game)
+	if err != nil {
+		log.Printf("Unable to %v game: %#v", msg["type"], err)
+		return err
+	}
+	if err = logTransition(db, gameId, playerId, from, to); err != nil {
+		log.Printf("Failed to record %v: %v", msg["type"], err)
 	}
 
-	ws.WriteJSON(Message{
-		"type":    "players",
-		"players": players,
-	})
+	board, err := getBoard(gameId, db)
+	if err != nil {
+		log.Printf("Unable to get board: %#v", err)
+		return err
+	}
+	niceBoard, err := board.getGrid()
+	if err != nil {
+		log.Printf("Error getting board: %#v", err)
+		return err
+	}
+	sendUpdate(gameId, playerId, gs, conn, db, boardUpdate(game, niceBoard))
+	// bots in classic games only move once they're told it's their turn again
+	if to == "start" && gameMode(game) == ClassicMode {
+		seats, err := getSeats(gameId, db)
+		if err != nil {
+			log.Printf("Unable to get seats: %#v", err)
+			return err
+		}
+		sendSeats(gameId, seats, gs, conn)
+	}
+	if to == "start" {
+		// the last move of a round may have come in just as the game was paused
+		return hostMove(msg, gameId, playerId, gs, conn, db, log)
+	}
 	return nil
 }
 
-func hostMove(msg Message, gameId string, playerId int, gs GameService, ws *websocket.Conn, db *gorp.DbMap, log *log.Logger) error {
+func hostJoinLeave(msg Message, gameId string, playerId int, gs GameService, conn Conn, db *gorp.DbMap, log *log.Logger) error {
+	log.Printf("player %v", msg["type"])
+	game, _, err := gs.GetGame(db, gameId, playerId)
+	if err != nil {
+		log.Printf("Couldn't get game on %v: %#v", msg["type"], err)
+		return err
+	}
+	if gameMode(game) == ClassicMode {
+		if err = seatPlayer(msg, game, gs, conn, db); err != nil {
+			return err
+		}
+	}
+	// send a fresh list of players to the UI
+	return sendPlayers(gameId, gs, conn, db)
+}
+
+func hostMove(msg Message, gameId string, playerId int, gs GameService, conn Conn, db *gorp.DbMap, log *log.Logger) error {
 	log.Printf("Checking player move")
 
+	game, _, err := gs.GetGame(db, gameId, playerId)
+	if err != nil {
+		log.Printf("Couldn't get game during move: %#v", err)
+		return err
+	}
+	// rounds are only played in a game in play, a paused one waits and a finished or unstarted one has none
+	if game.State != "start" {
+		log.Printf("Game is %v, no round to resolve", game.State)
+		return nil
+	}
+	if gameMode(game) == ClassicMode {
+		return classicMove(game, gameId, playerId, gs, conn, db, log)
+	}
+
 	var players []*Player
-	_, err := db.Select(&players, "select * from players where game=?", gameId)
+	_, err = db.Select(&players, "select * from players where game=?", gameId)
 	if err != nil {
 		log.Printf("Failed to select players during move for game %v", gameId)
 		return err
 	}
 
-	resolveRound := true
+	turns := map[int]*TicTacToe_Turn{}
 	for _, p := range players {
-		if p.Role == Host {
+		if p.Role == Host || (game.Teams > 0 && p.Team == 0) {
 			continue
 		}
-		turn := TicTacToe_Turn{}
-		err = db.SelectOne(&turn, "select * from tictactoe_turn where game=? and player=?", gameId, p.Id)
+		turn := &TicTacToe_Turn{}
+		err = db.SelectOne(turn, "select * from tictactoe_turn where game=? and player=?", gameId, p.Id)
 		if err != nil {
 			log.Printf("Couldn't get turn %#v", err)
 			return err
 		}
 
 		if turn.Move == -1 {
-			resolveRound = false
+			log.Printf("Round cannot be resolved")
+			return nil // not an error, just nothing to do
 		}
-	}
-	if !resolveRound {
-		log.Printf("Round cannot be resolved")
-		return nil // not an error, just nothing to do
+		turns[p.Id] = turn
 	}
 
 	board, err := getBoard(gameId, db)
@@ -339,75 +628,290 @@ func hostMove(msg Message, gameId string, playerId int, gs GameService, ws *webs
 		return err
 	}
 
-	// all players have set their moves, update the board
-	thisRound := []int{0, 0, 0, 0, 0, 0, 0, 0, 0}
-	for _, p := range players {
-		if p.Role == Host {
-			continue
-		}
-		turn := TicTacToe_Turn{}
-		err = db.SelectOne(&turn, "select * from tictactoe_turn where game=? and player=?", gameId, p.Id)
-		if err != nil {
-			log.Printf("Couldn't get turn %#v", err)
-			return err
-		}
-		if thisRound[turn.Move] == 0 {
-			thisRound[turn.Move] = p.Id
-		} else {
-			thisRound[turn.Move] = 0 // two players went in the same spot
-		}
-	}
-	niceBoard, err := board.getBoard()
+	niceBoard, err := board.getGrid()
 	if err != nil {
 		log.Printf("Error getting board: %#v", err)
 		return err
 	}
-	for i, v := range niceBoard {
-		if v == 0 {
-			niceBoard[i] = thisRound[i]
-		}
+
+	options, err := game.getOptions()
+	if err != nil {
+		log.Printf("Unable to read game options: %#v", err)
+		return err
 	}
+	rule, _ := options["collisions"].(string)
 
-	board.setBoard(niceBoard)
-	count, err := db.Update(board)
-	if err != nil || count == 0 {
+	// all players have set their moves, update the board
+	claims := roundMoves(players, turns, game.Teams > 0)
+	placed, collisions := settleRound(niceBoard.cells, claims, rule, roundRand(options, game.Rounds))
+	for cell, owner := range placed {
+		niceBoard.cells[cell] = owner
+	}
+	report, notices := reportCollisions(collisions, rule, players, turns, game.Teams > 0)
+
+	err = saveRound(board, niceBoard.cells, game.Rounds+1, turns, nil, db)
+	if err != nil {
 		log.Printf("Unable to save board after move: %v", err)
 		return err
 	}
-	for _, p := range players {
-		if p.Role == Host {
-			continue
-		}
-		turn := TicTacToe_Turn{}
-		err = db.SelectOne(&turn, "select * from tictactoe_turn where game=? and player=?", gameId, p.Id)
+
+	game.Rounds++
+	_, err = db.Update(game)
+	if err != nil {
+		log.Printf("Unable to count round: %v", err)
+		return err
+	}
+
+	if winner := niceBoard.winner(); winner != 0 || niceBoard.full() {
+		log.Printf("Game %v is over, winner is %v", gameId, winner)
+		err = finishGame(game, winner, nil, playerId, db)
 		if err != nil {
-			log.Printf("Couldn't get turn %#v", err)
+			log.Printf("Unable to finish game: %#v", err)
 			return err
 		}
+	}
+	for pid, turn := range turns {
 		turn.Move = -1
-		log.Printf("Resetting player %v turn", p.Id)
-		count, err := db.Update(&turn)
+		log.Printf("Resetting player %v turn", pid)
+		count, err := db.Update(turn)
 		if count == 0 || err != nil {
-			log.Printf("Failed to update player turn: %#v -- %#v", err, p.Id)
+			log.Printf("Failed to update player turn: %#v -- %#v", err, pid)
 			return err
 		}
 	}
-	gs.Broadcast(gameId, Message{
-		"type":  "update",
-		"board": niceBoard,
-		"state": "start",
-	})
-	ws.WriteJSON(Message{
-		"type":  "update",
-		"board": niceBoard,
-		"state": "start",
-	})
+	update := boardUpdate(game, niceBoard)
+	update["collisions"] = report
+	sendUpdate(gameId, playerId, gs, conn, db, update)
+	for pid, notice := range notices {
+		gs.SendPlayer(gameId, pid, notice)
+	}
+	if game.State == "finished" {
+		return sendSeries(game, gs, conn, db)
+	}
 	return nil
 }
 
+// Works out the cell each owner (a player, or a team when playing in teams) claims this round. Team members vote
+// on their team's cell and the most popular one wins, with ties going to the lowest numbered cell. A team claimed
+// its cell when the first member to vote for it did.
+func roundMoves(players []*Player, turns map[int]*TicTacToe_Turn, teams bool) map[int]claim {
+	votes := map[int]map[int]int{} // owner -> cell -> votes
+	for _, p := range players {
+		turn, ok := turns[p.Id]
+		if !ok {
+			continue
+		}
+		owner := p.Id
+		if teams {
+			owner = p.Team
+		}
+		if votes[owner] == nil {
+			votes[owner] = map[int]int{}
+		}
+		votes[owner][turn.Move]++
+	}
+
+	moves := map[int]claim{}
+	for owner, cells := range votes {
+		best := -1
+		for cell, n := range cells {
+			if best == -1 || n > cells[best] || (n == cells[best] && cell < best) {
+				best = cell
+			}
+		}
+		moves[owner] = claim{cell: best}
+	}
+	for _, p := range players {
+		turn, ok := turns[p.Id]
+		owner := p.Id
+		if teams {
+			owner = p.Team
+		}
+		if c, voted := moves[owner]; ok && voted && turn.Move == c.cell && (c.moved.IsZero() || turn.Moved.Before(c.moved)) {
+			c.moved = turn.Moved
+			moves[owner] = c
+		}
+	}
+	return moves
+}
+
 // helpers
+
+// check to make sure this player has a turn row
+func ensureTurn(gameId string, playerId int, db *gorp.DbMap) error {
+	turn := TicTacToe_Turn{}
+	err := db.SelectOne(&turn, "select * from tictactoe_turn where game=? and player=?", gameId, playerId)
+	if err != nil {
+		turn.Game = gameId
+		turn.Player = playerId
+		turn.Move = -1
+		return db.Insert(&turn)
+	}
+	return nil
+}
+
 func getBoard(gameId string, db *gorp.DbMap) (*TicTacToe_Board, error) {
 	board := &TicTacToe_Board{}
-	err := db.SelectOne(board, "select * from tictactoe_board where game=?", gameId)
+	err := db.SelectOne(board, "select * from tictactoe_board where game=? order by Id desc limit 1", gameId)
 	return board, err
 }
+
+func addTicTacToeTables(db *gorp.DbMap) {
+	db.AddTableWithName(TicTacToe_Board{}, "tictactoe_board").SetKeys(true, "Id")
+	db.AddTableWithName(TicTacToe_Turn{}, "tictactoe_turn").SetKeys(true, "Id")
+	db.AddTableWithName(TicTacToe_Seats{}, "tictactoe_seats").SetKeys(false, "Game")
+	db.AddTableWithName(TicTacToe_Series{}, "tictactoe_series").SetKeys(true, "Id")
+}
+
+// deletes the boards, turns, seats and series of an expired game
+func cleanupGame(db *gorp.DbMap, gameId string) error {
+	for _, table := range []string{"tictactoe_board", "tictactoe_turn", "tictactoe_seats", "tictactoe_series"} {
+		_, err := db.Exec("delete from "+table+" where Game=?", gameId)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A board of cells, a row at a time, with what's needed to make sense of them. Cells hold the player (or team)
+// in them, or 0 when empty.
+type grid struct {
+	cells  []int
+	width  int
+	height int
+	win    int // how many in a row it takes to win
+}
+
+// an empty board made to the game's options
+func newGrid(options Message) grid {
+	g := grid{width: 3, height: 3, win: 3}
+	if n, ok := toInt(options["width"]); ok {
+		g.width = n
+	}
+	if n, ok := toInt(options["height"]); ok {
+		g.height = n
+	}
+	if n, ok := toInt(options["win"]); ok {
+		g.win = n
+	}
+	g.cells = make([]int, g.width*g.height)
+	return g
+}
+
+// lines are worked out once for each size of board, since bots ask for them a lot
+var gridLines = struct {
+	sync.Mutex
+	m map[[3]int][][]int
+}{m: map[[3]int][][]int{}}
+
+// every run of win cells along a row, column or diagonal, any of which wins the game for whoever holds all of it
+func (g grid) lines() [][]int {
+	gridLines.Lock()
+	defer gridLines.Unlock()
+	key := [3]int{g.width, g.height, g.win}
+	if lines, ok := gridLines.m[key]; ok {
+		return lines
+	}
+
+	lines := [][]int{}
+	directions := [][2]int{{1, 0}, {0, 1}, {1, 1}, {-1, 1}} // across, down and both diagonals
+	for y := 0; y < g.height; y++ {
+		for x := 0; x < g.width; x++ {
+			for _, d := range directions {
+				endX, endY := x+d[0]*(g.win-1), y+d[1]*(g.win-1)
+				if endX < 0 || endX >= g.width || endY >= g.height {
+					continue
+				}
+				line := make([]int, g.win)
+				for i := range line {
+					line[i] = (y+d[1]*i)*g.width + x + d[0]*i
+				}
+				lines = append(lines, line)
+			}
+		}
+	}
+	gridLines.m[key] = lines
+	return lines
+}
+
+// returns the player holding a winning line, or 0 if nobody has won (yet)
+func (g grid) winner() int {
+	for _, line := range g.lines() {
+		owner := g.cells[line[0]]
+		won := owner > 0 // blocked cells don't win anything
+		for _, cell := range line[1:] {
+			won = won && g.cells[cell] == owner
+		}
+		if won {
+			return owner
+		}
+	}
+	return 0
+}
+
+func (g grid) full() bool {
+	for _, v := range g.cells {
+		if v == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// counts the cells each player (or team) holds
+func (g grid) scores() map[int]int {
+	scores := map[int]int{}
+	for _, v := range g.cells {
+		if v > 0 {
+			scores[v]++
+		}
+	}
+	return scores
+}
+
+// the update message that shows the board to the phones and the host's screen. When playing in teams the cells
+// hold team numbers instead of player ids.
+func boardUpdate(game *Game, board grid) Message {
+	return Message{
+		"type":   "update",
+		"board":  board.cells,
+		"width":  board.width,
+		"height": board.height,
+		"win":    board.win,
+		"state":  game.State,
+		"winner": board.winner(),
+		"teams":  game.Teams,
+		"scores": board.scores(),
+		"mode":   gameMode(game),
+	}
+}
+
+// moves the game into the finished state once the board has been decided, and records how each player did. The
+// winner is a player id, or a team number when playing in teams, or 0 for a draw. Seated is who played in classic
+// games, and nil when everyone did.
+func finishGame(game *Game, winner int, seated []int, playerId int, db *gorp.DbMap) error {
+	from := game.State
+	game.State = "finished"
+	game.Finished = time.Now().UTC()
+	_, err := db.Update(game)
+	if err != nil {
+		return err
+	}
+	if err = logTransition(db, game.Id, playerId, from, game.State); err != nil {
+		log.Printf("Failed to record finished game: %v", err)
+	}
+	if err = recordSeries(game, winner, db); err != nil {
+		return err
+	}
+	return recordResults(game, winner, seated, db)
+}
+
+// sends a board update to every player and to the host's screen, recording it so the game can be replayed later
+func sendUpdate(gameId string, playerId int, gs GameService, conn Conn, db *gorp.DbMap, update Message) {
+	gs.Broadcast(gameId, update)
+	conn.Send(update)
+	if err := logMessage(db, HostToWebDir, gameId, playerId, update); err != nil {
+		log.Printf("Failed to record update: %v", err)
+	}
+}
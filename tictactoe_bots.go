@@ -0,0 +1,236 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+
+	"github.com/coopernurse/gorp"
+)
+
+// A strategy picks the cell a computer player moves in. Cells it holds are `me`, empty cells are 0, blocked cells
+// are blockedCell and anything else belongs to someone else.
+type strategy func(board grid, me int) int
+
+// the most empty cells minimax will search, any more and it takes too long so it plays greedily instead
+const maxMinimaxCells = 9
+
+func init() {
+	RegisterBot("tictactoe", "random", newTicTacToeBot(randomMove))
+	RegisterBot("tictactoe", "greedy", newTicTacToeBot(greedyMove))
+	RegisterBot("tictactoe", "minimax", newTicTacToeBot(minimaxMove))
+}
+
+// A computer player for tic-tac-toe, which moves whenever it's shown a board in play. In classic games it keeps
+// the board until it's told it's their turn.
+type ticTacToeBot struct {
+	player   *Player
+	db       *gorp.DbMap
+	strategy strategy
+	last     Message // the last board of a classic game
+}
+
+func newTicTacToeBot(s strategy) BotFactory {
+	return func(player *Player, db *gorp.DbMap) Bot {
+		return &ticTacToeBot{player: player, db: db, strategy: s}
+	}
+}
+
+func (b *ticTacToeBot) Receive(msg Message) []Message {
+	if msg["type"] == "update" && msg["mode"] == ClassicMode {
+		b.last = msg
+		return nil
+	}
+	if msg["type"] == "turn" && b.last != nil {
+		msg = b.last
+	}
+	if msg["type"] != "update" || msg["state"] != "start" {
+		return nil
+	}
+	cells, ok := toInts(msg["board"])
+	if !ok {
+		log.Printf("Bot %v got an update without a board", b.player.Id)
+		return nil
+	}
+	board := newGrid(msg)
+	if len(cells) != len(board.cells) {
+		log.Printf("Bot %v got a board that doesn't fit its size", b.player.Id)
+		return nil
+	}
+	board.cells = cells
+
+	// play for the team when there are teams
+	me := b.player.Id
+	if teams, _ := toInt(msg["teams"]); teams > 0 {
+		obj, err := b.db.Get(Player{}, b.player.Id)
+		if err != nil || obj == nil {
+			log.Printf("Bot %v couldn't find its team: %#v", b.player.Id, err)
+			return nil
+		}
+		me = obj.(*Player).Team
+	}
+
+	move := b.strategy(board, me)
+	if move == -1 {
+		return nil
+	}
+	log.Printf("Bot %v moving to %v", b.player.Id, move)
+	return []Message{{"type": "move", "move": float64(move)}}
+}
+
+// Messages sent within this process keep their Go types, but ones that went through JSON have float64s instead of
+// ints, so bots read numbers with these.
+func toInt(v interface{}) (int, bool) {
+	switch n := v.(type) {
+	case int:
+		return n, true
+	case float64:
+		return int(n), true
+	}
+	return 0, false
+}
+
+func toInts(v interface{}) ([]int, bool) {
+	switch s := v.(type) {
+	case []int:
+		return s, true
+	case []interface{}:
+		ints := make([]int, len(s))
+		for i, e := range s {
+			n, ok := toInt(e)
+			if !ok {
+				return nil, false
+			}
+			ints[i] = n
+		}
+		return ints, true
+	}
+	return nil, false
+}
+
+func emptyCells(board []int) []int {
+	cells := []int{}
+	for i, v := range board {
+		if v == 0 {
+			cells = append(cells, i)
+		}
+	}
+	return cells
+}
+
+// picks any empty cell, or -1 if there are none
+func randomMove(board grid, me int) int {
+	cells := emptyCells(board.cells)
+	if len(cells) == 0 {
+		return -1
+	}
+	return cells[rand.Intn(len(cells))]
+}
+
+// Wins if it can, otherwise blocks anyone about to win, otherwise takes the center, then a corner, then anything.
+func greedyMove(board grid, me int) int {
+	var block = -1
+	for _, line := range board.lines() {
+		empty, mine, owner, theirs, blocked := -1, 0, 0, 0, false
+		for _, cell := range line {
+			switch v := board.cells[cell]; {
+			case v == blockedCell:
+				blocked = true
+			case v == 0:
+				empty = cell
+			case v == me:
+				mine++
+			case owner == 0 || v == owner:
+				owner = v
+				theirs++
+			}
+		}
+		if empty == -1 || blocked {
+			continue
+		}
+		if mine == board.win-1 {
+			return empty
+		}
+		if theirs == board.win-1 {
+			block = empty
+		}
+	}
+	if block != -1 {
+		return block
+	}
+
+	center := board.height/2*board.width + board.width/2
+	if board.cells[center] == 0 {
+		return center
+	}
+	corners := []int{}
+	for _, cell := range []int{0, board.width - 1, (board.height - 1) * board.width, len(board.cells) - 1} {
+		if board.cells[cell] == 0 {
+			corners = append(corners, cell)
+		}
+	}
+	if len(corners) > 0 {
+		return corners[rand.Intn(len(corners))]
+	}
+	return randomMove(board, me)
+}
+
+// Plays perfectly against a single opponent by searching every game. Everyone else is treated as that one
+// opponent, which is as close to perfect as it gets when several people move at once. Bigger boards have far too
+// many games to search until they've mostly filled up, so until then it plays greedily.
+func minimaxMove(board grid, me int) int {
+	if len(emptyCells(board.cells)) > maxMinimaxCells {
+		return greedyMove(board, me)
+	}
+
+	// 1 is the bot, 2 is everyone else
+	b := board
+	b.cells = make([]int, len(board.cells))
+	for i, v := range board.cells {
+		if v == me {
+			b.cells[i] = 1
+		} else if v == blockedCell {
+			b.cells[i] = blockedCell
+		} else if v != 0 {
+			b.cells[i] = 2
+		}
+	}
+
+	best, bestScore := -1, -2
+	for _, cell := range emptyCells(b.cells) {
+		b.cells[cell] = 1
+		score := minimax(b, 2)
+		b.cells[cell] = 0
+		if score > bestScore {
+			best, bestScore = cell, score
+		}
+	}
+	return best
+}
+
+// scores the board from the bot's point of view: 1 for a win, -1 for a loss and 0 for a draw
+func minimax(b grid, next int) int {
+	switch b.winner() {
+	case 1:
+		return 1
+	case 2:
+		return -1
+	}
+	cells := emptyCells(b.cells)
+	if len(cells) == 0 {
+		return 0
+	}
+
+	best := 2
+	if next == 1 {
+		best = -2
+	}
+	for _, cell := range cells {
+		b.cells[cell] = next
+		score := minimax(b, 3-next)
+		b.cells[cell] = 0
+		if (next == 1 && score > best) || (next == 2 && score < best) {
+			best = score
+		}
+	}
+	return best
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+
+	"github.com/coopernurse/gorp"
+)
+
+// The ways tic-tac-toe can be played, chosen with the mode option when the game is created.
+const (
+	FreeMode    = "free"    // everyone moves at once each round
+	ClassicMode = "classic" // two players take turns and everyone else queues to play the winner
+)
+
+// Who sits at a classic game. X moves first and is the challenger, O is whoever won the last game.
+type TicTacToe_Seats struct {
+	Game  string // foreign key to game
+	X     int    // player in each seat, 0 while it's empty
+	O     int
+	Turn  int    // player whose move it is, 0 until both seats are taken
+	Queue string // the players waiting for a seat, in order, as a JSON list
+}
+
+func (s TicTacToe_Seats) getQueue() []int {
+	queue := []int{}
+	if s.Queue != "" {
+		if err := json.Unmarshal([]byte(s.Queue), &queue); err != nil {
+			log.Printf("Bad queue for game %v: %v", s.Game, err)
+		}
+	}
+	return queue
+}
+
+func (s *TicTacToe_Seats) setQueue(queue []int) {
+	b, _ := json.Marshal(queue)
+	s.Queue = string(b)
+}
+
+// takes the player at the front of the queue, or 0 if nobody is waiting
+func (s *TicTacToe_Seats) next() int {
+	queue := s.getQueue()
+	if len(queue) == 0 {
+		return 0
+	}
+	s.setQueue(queue[1:])
+	return queue[0]
+}
+
+// Sits a player who joined in an empty seat, or at the back of the queue. Players coming back to a seat or a place
+// in the queue keep it.
+func (s *TicTacToe_Seats) sit(playerId int) {
+	queue := s.getQueue()
+	switch {
+	case s.X == playerId || s.O == playerId || containsInt(queue, playerId):
+		return
+	case s.X == 0:
+		s.X = playerId
+	case s.O == 0:
+		s.O = playerId
+	default:
+		s.setQueue(append(queue, playerId))
+	}
+	if s.Turn == 0 && s.X != 0 && s.O != 0 {
+		s.Turn = s.X
+	}
+}
+
+// Gives up the seat or place in the queue of a player who left. The next in line takes over an empty seat,
+// along with the turn if it was theirs.
+func (s *TicTacToe_Seats) stand(playerId int) {
+	queue := s.getQueue()
+	for i, pid := range queue {
+		if pid == playerId {
+			s.setQueue(append(queue[:i], queue[i+1:]...))
+			return
+		}
+	}
+	if s.X == playerId {
+		s.X = s.next()
+	} else if s.O == playerId {
+		s.O = s.next()
+	} else {
+		return
+	}
+	if s.Turn == playerId || s.X == 0 || s.O == 0 {
+		s.Turn = 0
+		if s.X != 0 && s.O != 0 {
+			s.Turn = s.X
+		}
+	}
+}
+
+// Passes the turn to the other seat.
+func (s *TicTacToe_Seats) pass() {
+	if s.Turn == s.X {
+		s.Turn = s.O
+	} else {
+		s.Turn = s.X
+	}
+}
+
+// Winner stays on: the winner takes O, the loser goes to the back of the queue and the next challenger takes X
+// and moves first. After a draw the champion keeps O and the challenger goes to the back, so with nobody waiting
+// the same two play again.
+func (s *TicTacToe_Seats) rotate(winner int) {
+	champion, loser := s.O, s.X
+	if winner == s.X {
+		champion, loser = s.X, s.O
+	}
+	if loser != 0 {
+		s.setQueue(append(s.getQueue(), loser))
+	}
+	s.O = champion
+	s.X = s.next()
+	s.Turn = 0
+	if s.X != 0 && s.O != 0 {
+		s.Turn = s.X
+	}
+}
+
+func (s TicTacToe_Seats) toMessage() Message {
+	return Message{
+		"type":  "seats",
+		"x":     s.X,
+		"o":     s.O,
+		"turn":  s.Turn,
+		"queue": s.getQueue(),
+	}
+}
+
+// the seats of a game, which are all empty before anyone has joined
+func getSeats(gameId string, db *gorp.DbMap) (*TicTacToe_Seats, error) {
+	seats := &TicTacToe_Seats{}
+	err := db.SelectOne(seats, "select * from tictactoe_seats where Game=?", gameId)
+	if err == sql.ErrNoRows {
+		return &TicTacToe_Seats{Game: gameId, Queue: "[]"}, nil
+	}
+	return seats, err
+}
+
+func saveSeats(seats *TicTacToe_Seats, db *gorp.DbMap) error {
+	count, err := db.Update(seats)
+	if err == nil && count == 0 {
+		err = db.Insert(seats)
+	}
+	return err
+}
+
+// the mode a game is played in, which is free for games made before there were modes
+func gameMode(game *Game) string {
+	options, err := game.getOptions()
+	if err != nil {
+		log.Printf("Unable to read options of game %v: %v", game.Id, err)
+	}
+	if mode, ok := options["mode"].(string); ok {
+		return mode
+	}
+	return FreeMode
+}
+
+// shows the seats on the host's screen and tells each phone whether it's their move
+func sendSeats(gameId string, seats *TicTacToe_Seats, gs GameService, conn Conn) {
+	msg := seats.toMessage()
+	conn.Send(msg)
+	gs.Broadcast(gameId, msg)
+}
+
+// seats players in a classic game as they come and go
+func seatPlayer(msg Message, game *Game, gs GameService, conn Conn, db *gorp.DbMap) error {
+	gameId := game.Id
+	pid, ok := toInt(msg["player"])
+	if !ok {
+		return nil
+	}
+	// a phone that drops out of a game in play keeps its seat or place in the queue for when it's back, only a
+	// player taken out of the game gives theirs up
+	if msg["type"] == "leave" && (game.State == "start" || game.State == "paused") {
+		obj, err := db.Get(Player{}, pid)
+		if err != nil {
+			log.Printf("Unable to get player who left: %#v", err)
+			return err
+		}
+		if obj != nil && obj.(*Player).Game == gameId {
+			return nil
+		}
+	}
+	seats, err := getSeats(gameId, db)
+	if err != nil {
+		log.Printf("Unable to get seats: %#v", err)
+		return err
+	}
+	if msg["type"] == "join" {
+		seats.sit(pid)
+	} else {
+		seats.stand(pid)
+	}
+	if err = saveSeats(seats, db); err != nil {
+		log.Printf("Unable to save seats: %#v", err)
+		return err
+	}
+	sendSeats(gameId, seats, gs, conn)
+	return nil
+}
+
+// Each phone works out from the seats whether it's their move, and if not who they're waiting on.
+func playerSeats(msg Message, gameId string, playerId int, gs GameService, conn Conn, db *gorp.DbMap, log *log.Logger) error {
+	turn, _ := toInt(msg["turn"])
+	if turn == playerId {
+		conn.Send(Message{"type": "turn"})
+		return nil
+	}
+	wait := Message{"type": "wait", "turn": turn}
+	queue, _ := toInts(msg["queue"])
+	for i, pid := range queue {
+		if pid == playerId {
+			wait["place"] = i + 1
+		}
+	}
+	conn.Send(wait)
+	return nil
+}
+
+// Plays a classic move: the player whose turn it is takes their cell and the turn passes to the other seat. Once
+// the game is decided the seats rotate for the next one.
+func classicMove(game *Game, gameId string, playerId int, gs GameService, conn Conn, db *gorp.DbMap, log *log.Logger) error {
+	seats, err := getSeats(gameId, db)
+	if err != nil {
+		log.Printf("Couldn't get seats during move: %#v", err)
+		return err
+	}
+	turn := &TicTacToe_Turn{}
+	err = db.SelectOne(turn, "select * from tictactoe_turn where game=? and player=?", gameId, seats.Turn)
+	if err != nil || turn.Move == -1 {
+		log.Printf("Waiting on player %v to move", seats.Turn)
+		return nil // not an error, just nothing to do
+	}
+
+	board, err := getBoard(gameId, db)
+	if err != nil {
+		log.Printf("Couldn't get board: %#v", err)
+		return err
+	}
+	niceBoard, err := board.getGrid()
+	if err != nil {
+		log.Printf("Error getting board: %#v", err)
+		return err
+	}
+	if turn.Move < len(niceBoard.cells) && niceBoard.cells[turn.Move] == 0 {
+		niceBoard.cells[turn.Move] = seats.Turn
+	}
+	before := *seats
+	err = saveRound(board, niceBoard.cells, game.Rounds+1, map[int]*TicTacToe_Turn{seats.Turn: turn}, &before, db)
+	if err != nil {
+		log.Printf("Unable to save board after move: %v", err)
+		return err
+	}
+	turn.Move = -1
+	if _, err = db.Update(turn); err != nil {
+		log.Printf("Failed to update player turn: %#v", err)
+		return err
+	}
+	game.Rounds++
+	if _, err = db.Update(game); err != nil {
+		log.Printf("Unable to count round: %v", err)
+		return err
+	}
+
+	if winner := niceBoard.winner(); winner != 0 || niceBoard.full() {
+		log.Printf("Game %v is over, winner is %v", gameId, winner)
+		err = finishGame(game, winner, []int{seats.X, seats.O}, playerId, db)
+		if err != nil {
+			log.Printf("Unable to finish game: %#v", err)
+			return err
+		}
+		seats.rotate(winner)
+	} else {
+		seats.pass()
+	}
+	if err = saveSeats(seats, db); err != nil {
+		log.Printf("Unable to save seats: %#v", err)
+		return err
+	}
+	sendUpdate(gameId, playerId, gs, conn, db, boardUpdate(game, niceBoard))
+	sendSeats(gameId, seats, gs, conn)
+	if game.State == "finished" {
+		return sendSeries(game, gs, conn, db)
+	}
+	return nil
+}
+
+func containsInt(s []int, n int) bool {
+	for _, v := range s {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// The rules for settling a round when more than one player (or team) goes in the same cell, chosen with the
+// collisions option when the game is created.
+const (
+	CancelCollisions    = "cancel"    // nobody gets the cell
+	FirstCollisions     = "first"     // whoever moved first gets it
+	RandomCollisions    = "random"    // somebody picked at random gets it, from the game's seed so it can be replayed
+	ContestedCollisions = "contested" // nobody gets it, ever, since the cell is blocked for the rest of the game
+)
+
+var collisionRules = []string{CancelCollisions, FirstCollisions, RandomCollisions, ContestedCollisions}
+
+// what a contested cell holds once it's blocked
+const blockedCell = -1
+
+// the cell an owner wants this round, and when they asked for it
+type claim struct {
+	cell  int
+	moved time.Time
+}
+
+// a cell more than one owner wanted this round, and who ended up with it (0 if nobody did)
+type collision struct {
+	cell   int
+	owners []int
+	winner int
+}
+
+// The random tiebreaks of a round. Seeding from the game's seed and the round means the same game settles the same
+// way every time.
+func roundRand(options Message, round int) *rand.Rand {
+	seed, _ := toInt(options["seed"])
+	return rand.New(rand.NewSource(int64(seed) + int64(round)))
+}
+
+// Works out which owner gets each empty cell claimed this round, settling cells claimed more than once with the
+// rule. Claims on cells that are already taken are wasted. Returns cell -> owner, which is blockedCell for contested
+// cells, and the collisions.
+func settleRound(cells []int, claims map[int]claim, rule string, rng *rand.Rand) (map[int]int, []collision) {
+	wanted := map[int][]int{} // cell -> owners
+	for owner, c := range claims {
+		if c.cell >= 0 && c.cell < len(cells) && cells[c.cell] == 0 {
+			wanted[c.cell] = append(wanted[c.cell], owner)
+		}
+	}
+	// go through the cells in order so the random rule is the same each time for the same seed
+	order := []int{}
+	for cell := range wanted {
+		order = append(order, cell)
+	}
+	sort.Ints(order)
+
+	placed := map[int]int{}
+	collisions := []collision{}
+	for _, cell := range order {
+		owners := wanted[cell]
+		if len(owners) == 1 {
+			placed[cell] = owners[0]
+			continue
+		}
+		sort.Ints(owners)
+		c := collision{cell: cell, owners: owners}
+		switch rule {
+		case FirstCollisions:
+			c.winner = owners[0]
+			for _, owner := range owners[1:] {
+				if claims[owner].moved.Before(claims[c.winner].moved) {
+					c.winner = owner
+				}
+			}
+		case RandomCollisions:
+			c.winner = owners[rng.Intn(len(owners))]
+		case ContestedCollisions:
+			placed[cell] = blockedCell
+		}
+		if c.winner != 0 {
+			placed[cell] = c.winner
+		}
+		collisions = append(collisions, c)
+	}
+	return placed, collisions
+}
+
+// how a collision went for one of the owners in it
+func (c collision) outcome(owner int, rule string) string {
+	switch {
+	case rule == ContestedCollisions:
+		return "blocked"
+	case c.winner == 0:
+		return "cancelled"
+	case c.winner == owner:
+		return "won"
+	}
+	return "lost"
+}
+
+// Returns the collisions for the host's screen, and what to tell each player caught up in one about how it went for
+// them, keyed by player id. Players are told after the update with the board the collisions left.
+func reportCollisions(collisions []collision, rule string, players []*Player, turns map[int]*TicTacToe_Turn, teams bool) ([]Message, map[int]Message) {
+	summary := []Message{}
+	notices := map[int]Message{}
+	for _, c := range collisions {
+		summary = append(summary, Message{"cell": c.cell, "owners": c.owners, "winner": c.winner})
+		for _, owner := range c.owners {
+			for _, p := range players {
+				turn, ok := turns[p.Id]
+				if !ok || turn.Move != c.cell || (teams && p.Team != owner) || (!teams && p.Id != owner) {
+					continue
+				}
+				notices[p.Id] = Message{
+					"type":    "collision",
+					"cell":    c.cell,
+					"rule":    rule,
+					"outcome": c.outcome(owner, rule),
+					"owners":  c.owners,
+					"winner":  c.winner,
+				}
+			}
+		}
+	}
+	return summary, notices
+}
@@ -0,0 +1,109 @@
+package main
+
+// schemas of the properties several messages share
+var (
+	intSchema    = Message{"type": "integer"}
+	intsSchema   = Message{"type": "array", "items": intSchema}
+	playerSchema = Message{"type": "integer", "description": "a player id"}
+	stateSchema  = Message{"type": "string", "enum": []string{"lobby", "start", "paused", "finished"}}
+	// wins keyed by player, or team when playing in teams
+	tallySchema = Message{"type": "object", "additionalProperties": intSchema}
+)
+
+var ticTacToeSchemas = GameSchemas{
+	Inbound: map[string]Message{
+		// from phones
+		"move": messageSchema("move", Message{
+			"move": Message{"type": "integer", "minimum": 0, "description": "the cell, counting across each row in turn"},
+		}, "move"),
+		"chat":  messageSchema("chat", Message{"text": Message{"type": "string"}}),
+		"react": messageSchema("react", Message{"emoji": Message{"type": "string"}}),
+
+		// from the host's screen
+		"state": messageSchema("state", Message{
+			"state": Message{"type": "string", "enum": []string{"lobby", "start", "finished"}},
+		}, "state"),
+		"balance":   messageSchema("balance", Message{"teams": Message{"type": "integer", "minimum": 0}}),
+		"team":      messageSchema("team", Message{"player": playerSchema, "team": Message{"type": "integer", "minimum": 1}}),
+		"addbot":    messageSchema("addbot", Message{"bot": Message{"type": "string"}, "think": Message{"type": "number", "description": "milliseconds"}}),
+		"removebot": messageSchema("removebot", Message{"player": playerSchema}),
+		"mute":      messageSchema("mute", Message{"player": playerSchema}),
+		"unmute":    messageSchema("unmute", Message{"player": playerSchema}),
+		"chat_settings": messageSchema("chat_settings", Message{
+			"enabled":    Message{"type": "boolean"},
+			"phones":     Message{"type": "boolean"},
+			"max_length": intSchema,
+			"rate_limit": intSchema,
+		}),
+		"clear_chat": messageSchema("clear_chat", nil),
+		"undo":       messageSchema("undo", nil),
+		"pause":      messageSchema("pause", nil),
+		"resume":     messageSchema("resume", nil),
+		"rematch":    messageSchema("rematch", nil),
+	},
+	Outbound: map[string]Message{
+		"state": messageSchema("state", Message{"state": stateSchema}, "state"),
+		"update": messageSchema("update", Message{
+			"state":  stateSchema,
+			"board":  Message{"type": []string{"array", "null"}, "items": intSchema, "description": "each cell's owner, 0 when empty"},
+			"width":  intSchema,
+			"height": intSchema,
+			"win":    Message{"type": "integer", "description": "how many in a row wins"},
+			"winner": Message{"type": "integer", "description": "the player, or team, that won, 0 until then"},
+			"teams":  intSchema,
+			"scores": tallySchema,
+			"mode":   Message{"type": "string", "enum": []string{FreeMode, ClassicMode}},
+			"undone": Message{"type": "integer", "description": "the round taken back, when the update is for an undo"},
+			"undone_moves": Message{"type": "array", "description": "the moves of the round taken back, everyone moves again", "items": Message{
+				"type":       "object",
+				"properties": Message{"player": playerSchema, "move": intSchema},
+			}},
+		}, "state", "board"),
+		"players": messageSchema("players", Message{
+			"players": Message{"type": "array", "items": Message{
+				"type": "object",
+				"properties": Message{
+					"id":    playerSchema,
+					"name":  Message{"type": "string"},
+					"team":  intSchema,
+					"bot":   Message{"type": "string", "description": "how well a computer player plays, empty for people"},
+					"muted": Message{"type": "boolean"},
+				},
+			}},
+		}, "players"),
+		"seats": messageSchema("seats", Message{
+			"x":     playerSchema,
+			"o":     playerSchema,
+			"turn":  playerSchema,
+			"queue": intsSchema,
+		}, "x", "o", "turn", "queue"),
+		"turn": messageSchema("turn", nil),
+		"wait": messageSchema("wait", Message{"turn": playerSchema, "place": Message{"type": "integer", "minimum": 1}}, "turn"),
+		"series": messageSchema("series", Message{
+			"series":   intSchema,
+			"best_of":  intSchema,
+			"games":    intsSchema,
+			"score":    tallySchema,
+			"over":     Message{"type": "boolean"},
+			"champion": intSchema,
+			"teams":    intSchema,
+		}, "series", "best_of", "games", "score", "over", "champion"),
+		"collision": messageSchema("collision", Message{
+			"cell":    intSchema,
+			"rule":    Message{"type": "string"},
+			"outcome": Message{"type": "string", "enum": []string{"won", "lost", "cancelled", "blocked"}},
+			"owners":  intsSchema,
+			"winner":  intSchema,
+		}, "cell", "outcome"),
+		"chat":  messageSchema("chat", Message{"player": playerSchema, "name": Message{"type": "string"}, "text": Message{"type": "string"}}, "player", "text"),
+		"react": messageSchema("react", Message{"player": playerSchema, "name": Message{"type": "string"}, "emoji": Message{"type": "string"}}, "player", "emoji"),
+		"chat_settings": messageSchema("chat_settings", Message{
+			"enabled":    Message{"type": "boolean"},
+			"phones":     Message{"type": "boolean"},
+			"max_length": intSchema,
+			"rate_limit": intSchema,
+			"reactions":  Message{"type": "array", "items": Message{"type": "string"}},
+		}),
+		"clear_chat": messageSchema("clear_chat", nil),
+	},
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"log"
+
+	"github.com/coopernurse/gorp"
+)
+
+// the longest series a game can be created with
+const maxSeries = 99
+
+// Who won each game of a game's series, one row for every game played. Rematches carry on the series until it's
+// decided, then start the next one.
+type TicTacToe_Series struct {
+	Id     int
+	Game   string // foreign key to game
+	Series int    // which of the game's series it was part of, counting from 1
+	Winner int    // the player, or team when playing in teams, that won, 0 for a draw
+}
+
+// Works out whether a best of bestOf series with these winners so far is decided, and who took it. It's over once
+// somebody has won more than half of it or every game has been played, and the champion is 0 if it ended level.
+func seriesOutcome(winners []int, bestOf int) (int, bool) {
+	wins := map[int]int{}
+	for _, w := range winners {
+		if w != 0 {
+			wins[w]++
+		}
+	}
+	champion, most, level := 0, 0, false
+	for owner, n := range wins {
+		if n > most {
+			champion, most, level = owner, n, false
+		} else if n == most {
+			level = true
+		}
+	}
+	if most > bestOf/2 {
+		return champion, true
+	}
+	if len(winners) >= bestOf {
+		if level {
+			return 0, true
+		}
+		return champion, true
+	}
+	return 0, false
+}
+
+// the latest series of a game and the winners of its games so far, which is series 0 before any game has finished
+func getSeries(gameId string, db *gorp.DbMap) (int, []int, error) {
+	var games []*TicTacToe_Series
+	_, err := db.Select(&games, "select * from tictactoe_series where Game=? order by Id", gameId)
+	if err != nil {
+		return 0, nil, err
+	}
+	series, winners := 0, []int{}
+	for _, g := range games {
+		if g.Series != series {
+			series, winners = g.Series, []int{}
+		}
+		winners = append(winners, g.Winner)
+	}
+	return series, winners, nil
+}
+
+// how many games each of the game's series is the best of, which is 1 for games made before there were series
+func bestOf(game *Game) int {
+	options, err := game.getOptions()
+	if err != nil {
+		log.Printf("Unable to read options of game %v: %v", game.Id, err)
+	}
+	if n, ok := toInt(options["series"]); ok {
+		return n
+	}
+	return 1
+}
+
+// records the winner of a finished game in its series, starting the next series if the last one was decided
+func recordSeries(game *Game, winner int, db *gorp.DbMap) error {
+	series, winners, err := getSeries(game.Id, db)
+	if err != nil {
+		return err
+	}
+	if _, over := seriesOutcome(winners, bestOf(game)); series == 0 || over {
+		series++
+	}
+	return db.Insert(&TicTacToe_Series{Game: game.Id, Series: series, Winner: winner})
+}
+
+// the score of the game's latest series, shown between games
+func seriesMessage(game *Game, db *gorp.DbMap) (Message, error) {
+	series, winners, err := getSeries(game.Id, db)
+	if err != nil {
+		return nil, err
+	}
+	n := bestOf(game)
+	score := map[int]int{}
+	for _, w := range winners {
+		if w != 0 {
+			score[w]++
+		}
+	}
+	champion, over := seriesOutcome(winners, n)
+	return Message{
+		"type":     "series",
+		"series":   series,
+		"best_of":  n,
+		"games":    winners,
+		"score":    score,
+		"over":     over,
+		"champion": champion,
+		"teams":    game.Teams,
+	}, nil
+}
+
+// shows the series score on the host's screen and the phones once a game has finished
+func sendSeries(game *Game, gs GameService, conn Conn, db *gorp.DbMap) error {
+	msg, err := seriesMessage(game, db)
+	if err != nil {
+		return err
+	}
+	conn.Send(msg)
+	gs.Broadcast(game.Id, msg)
+	return nil
+}
+
+// The host plays the same game again with the same players, carrying on the series.
+func hostRematch(msg Message, gameId string, playerId int, gs GameService, conn Conn, db *gorp.DbMap, log *log.Logger) error {
+	game, _, err := gs.GetGame(db, gameId, playerId)
+	if err != nil {
+		log.Printf("Couldn't get game for rematch: %#v", err)
+		return err
+	}
+	if game.State != "finished" {
+		conn.Send(Message{"type": "error", "message": "A rematch can only start once the game has finished"})
+		return nil
+	}
+	return hostState(Message{"type": "state", "state": "start"}, gameId, playerId, gs, conn, db, log)
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/coopernurse/gorp"
+)
+
+func Test_GridLines(t *testing.T) {
+	g := newGrid(Message{})
+	if lines := g.lines(); len(lines) != 8 {
+		t.Errorf("A 3x3 board should have 8 winning lines, got %v", len(lines))
+	}
+
+	// gomoku: five in a row on a 15x15 board, here down a diagonal
+	g = newGrid(Message{"width": 15, "height": 15, "win": 5})
+	for i := 0; i < 4; i++ {
+		g.cells[(3+i)*15+10-i] = 7
+	}
+	if w := g.winner(); w != 0 {
+		t.Errorf("Four in a row shouldn't win, got %v", w)
+	}
+	g.cells[7*15+6] = 7
+	if w := g.winner(); w != 7 {
+		t.Errorf("Five in a row should win, got %v", w)
+	}
+}
+
+func Test_TicTacToeOptions(t *testing.T) {
+	options, err := ticTacToeOptions(Message{"width": float64(15), "height": float64(15), "win": float64(5)})
+	if err != nil || options["width"] != 15 || options["win"] != 5 {
+		t.Errorf("Gomoku options should be fine: %v %v", options, err)
+	}
+	options, err = ticTacToeOptions(Message{})
+	if err != nil || options["width"] != 3 || options["height"] != 3 || options["win"] != 3 {
+		t.Errorf("Options should default to 3x3: %v %v", options, err)
+	}
+	for _, bad := range []Message{
+		{"width": float64(2)},
+		{"width": float64(100)},
+		{"width": 3.5},
+		{"width": "big"},
+		{"win": float64(5)},
+		{"colour": "red"},
+		{"mode": "chaos"},
+		{"series": float64(0)},
+	} {
+		if _, err = ticTacToeOptions(bad); err == nil {
+			t.Errorf("Options %v should be refused", bad)
+		}
+	}
+}
+
+func Test_BotMoves(t *testing.T) {
+	board := func(cells ...int) grid {
+		g := newGrid(Message{})
+		copy(g.cells, cells)
+		return g
+	}
+	full := board(1, 2, 1, 1, 2, 2, 2, 1, 1)
+
+	for i := 0; i < 20; i++ {
+		if move := randomMove(board(1, 2, 0, 2, 1, 0, 0, 1, 2), 1); move != 2 && move != 5 && move != 6 {
+			t.Fatalf("Random bot should only pick empty cells, went %v", move)
+		}
+	}
+	for name, s := range map[string]strategy{"random": randomMove, "greedy": greedyMove, "minimax": minimaxMove} {
+		if move := s(full, 1); move != -1 {
+			t.Errorf("The %v bot moved on a full board, to %v", name, move)
+		}
+	}
+
+	// what greedy bots open with, minimax finds every opening draws so takes the first
+	cases := []struct {
+		name       string
+		board      grid
+		want       []int
+		greedyOnly bool
+	}{
+		{"wins rather than blocks", board(1, 1, 0, 2, 2, 0, 0, 0, 0), []int{2}, false},
+		{"blocks", board(2, 2, 0, 1, 0, 0, 0, 0, 0), []int{2}, false},
+		{"blocks another team", board(3, 3, 0, 0, 1, 0, 0, 0, 1), []int{2}, false},
+		{"takes the center", board(), []int{4}, true},
+		{"then a corner", board(0, 0, 0, 0, 2, 0, 0, 0, 0), []int{0, 2, 6, 8}, true},
+		{"leaves lines with a blocked cell", board(2, 2, blockedCell, 0, 0, 0, 0, 0, 0), []int{4}, true},
+	}
+	for _, c := range cases {
+		for name, s := range map[string]strategy{"greedy": greedyMove, "minimax": minimaxMove} {
+			if name == "minimax" && c.greedyOnly {
+				continue
+			}
+			move := s(c.board, 1)
+			found := false
+			for _, want := range c.want {
+				found = found || move == want
+			}
+			if !found {
+				t.Errorf("The %v bot %v: wanted one of %v, went %v", name, c.name, c.want, move)
+			}
+		}
+	}
+
+	// with the other player in opposite corners only an edge stops them making two lines at once
+	if move := minimaxMove(board(2, 0, 0, 0, 1, 0, 0, 0, 2), 1); move != 1 && move != 3 && move != 5 && move != 7 {
+		t.Errorf("Minimax bot should take an edge against opposite corners, went %v", move)
+	}
+}
+
+func Test_BotReceive(t *testing.T) {
+	bot := newTicTacToeBot(greedyMove)(&Player{Id: 1}, nil)
+	board := []interface{}{2.0, 2.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0, 0.0}
+
+	if moves := bot.Receive(Message{"type": "update", "state": "lobby", "board": board}); len(moves) != 0 {
+		t.Errorf("Bot moved in the lobby: %v", moves)
+	}
+	moves := bot.Receive(Message{"type": "update", "state": "start", "board": board})
+	if len(moves) != 1 || moves[0]["type"] != "move" || moves[0]["move"] != 2.0 {
+		t.Errorf("Bot should move to block at 2: %v", moves)
+	}
+
+	// in classic games it waits until it's told it's its turn, then plays the board it was last shown
+	classic := Message{"type": "update", "state": "start", "board": board, "mode": ClassicMode}
+	if moves = bot.Receive(classic); len(moves) != 0 {
+		t.Errorf("Bot moved before its turn: %v", moves)
+	}
+	if moves = bot.Receive(Message{"type": "turn"}); len(moves) != 1 || moves[0]["move"] != 2.0 {
+		t.Errorf("Bot should move on its turn: %v", moves)
+	}
+}
+
+func Test_BotsOnBigBoards(t *testing.T) {
+	g := newGrid(Message{"width": 15, "height": 15, "win": 5})
+	for i := 0; i < 4; i++ {
+		g.cells[i] = 2 // someone is about to win along the top
+	}
+	if move := greedyMove(g, 1); move != 4 {
+		t.Errorf("Greedy bot should block at 4, went %v", move)
+	}
+	if move := minimaxMove(g, 1); move != 4 {
+		t.Errorf("Minimax bot should fall back to greedy on a big board and block at 4, went %v", move)
+	}
+}
+
+func Test_RoundMoves(t *testing.T) {
+	now := time.Now()
+	players := []*Player{
+		{Id: 1, Team: 1}, {Id: 2, Team: 1}, {Id: 3, Team: 1},
+		{Id: 4, Team: 2}, {Id: 5, Team: 2},
+		{Id: 6, Team: 2}, // hasn't moved, so doesn't vote
+	}
+	turns := map[int]*TicTacToe_Turn{
+		1: {Move: 4, Moved: now.Add(2 * time.Second)},
+		2: {Move: 0, Moved: now},
+		3: {Move: 4, Moved: now.Add(time.Second)},
+		4: {Move: 6, Moved: now},
+		5: {Move: 2, Moved: now.Add(time.Second)},
+	}
+
+	// the team goes where most of it voted, claimed when the first of them voted there, and ties go to the lower cell
+	moves := roundMoves(players, turns, true)
+	if len(moves) != 2 {
+		t.Fatalf("Expected a move for each team, got %v", moves)
+	}
+	if c := moves[1]; c.cell != 4 || !c.moved.Equal(now.Add(time.Second)) {
+		t.Errorf("Team 1 should take 4 when its second voter did, got %v at %v", c.cell, c.moved)
+	}
+	if c := moves[2]; c.cell != 2 || !c.moved.Equal(now.Add(time.Second)) {
+		t.Errorf("Team 2 should break its tie with 2, got %v at %v", c.cell, c.moved)
+	}
+
+	// without teams everybody who moved plays for themselves
+	moves = roundMoves(players, turns, false)
+	if len(moves) != 5 {
+		t.Fatalf("Expected a move for each player who moved, got %v", moves)
+	}
+	for pid, turn := range turns {
+		if c := moves[pid]; c.cell != turn.Move || !c.moved.Equal(turn.Moved) {
+			t.Errorf("Player %v should take %v, got %v", pid, turn.Move, c.cell)
+		}
+	}
+}
+
+func Test_SettleRound(t *testing.T) {
+	now := time.Now()
+	cells := make([]int, 9)
+	cells[8] = 5 // already taken, so claiming it is wasted
+	claims := map[int]claim{
+		1: {cell: 4, moved: now.Add(time.Second)},
+		2: {cell: 4, moved: now},
+		3: {cell: 0, moved: now},
+		4: {cell: 8, moved: now},
+	}
+
+	expect := map[string]int{CancelCollisions: 0, FirstCollisions: 2, ContestedCollisions: blockedCell}
+	for rule, owner := range expect {
+		placed, collisions := settleRound(cells, claims, rule, roundRand(Message{}, 0))
+		if placed[0] != 3 {
+			t.Errorf("%v: uncontested cell should go to its only claimant: %v", rule, placed)
+		}
+		if _, ok := placed[8]; ok {
+			t.Errorf("%v: a taken cell shouldn't change hands: %v", rule, placed)
+		}
+		if placed[4] != owner {
+			t.Errorf("%v: expected cell 4 to end up with %v, got %v", rule, owner, placed[4])
+		}
+		if len(collisions) != 1 || collisions[0].cell != 4 || len(collisions[0].owners) != 2 {
+			t.Errorf("%v: expected one collision at 4, got %#v", rule, collisions)
+		}
+	}
+
+	// the same seed and round always settle the same way
+	first, _ := settleRound(cells, claims, RandomCollisions, roundRand(Message{"seed": 42}, 3))
+	for i := 0; i < 10; i++ {
+		again, _ := settleRound(cells, claims, RandomCollisions, roundRand(Message{"seed": 42}, 3))
+		if again[4] != first[4] {
+			t.Fatalf("Random collisions with the same seed went different ways: %v then %v", first[4], again[4])
+		}
+	}
+	if first[4] != 1 && first[4] != 2 {
+		t.Errorf("Random collision should go to one of those in it, went to %v", first[4])
+	}
+}
+
+// A free game on a database of its own, with players whose moves are set directly and rounds played by calling the
+// host's actions, as the host's goroutine would.
+type roundTest struct {
+	t    *testing.T
+	db   *gorp.DbMap
+	gs   *GameServiceImpl
+	game *Game
+	host int
+	pids []int
+	conn *recordConn
+	log  *log.Logger
+}
+
+func startRoundTest(t *testing.T, options Message, players int) (*roundTest, func()) {
+	db, done := tempDb(t)
+	r := &roundTest{t: t, db: db, gs: &GameServiceImpl{Fabric: NewMemoryFabric()}, conn: &recordConn{}, log: log.New(ioutil.Discard, "", 0)}
+	game, host, err := r.gs.NewGame("tictactoe", options, "", db)
+	if err != nil {
+		t.Fatalf("New game error: %v", err)
+	}
+	r.game, r.host = game, host.Id
+	r.gs.HostJoin(game.Id)
+	for i := 0; i < players; i++ {
+		p := &Player{Game: game.Id}
+		if err = db.Insert(p); err != nil {
+			t.Fatalf("Couldn't add player: %v", err)
+		}
+		ensureTurn(game.Id, p.Id, db)
+		r.pids = append(r.pids, p.Id)
+	}
+	if err = hostState(Message{"type": "state", "state": "start"}, game.Id, r.host, r.gs, r.conn, db, r.log); err != nil {
+		t.Fatalf("Couldn't start: %v", err)
+	}
+	return r, done
+}
+
+func (r *roundTest) cells() []int {
+	board, err := getBoard(r.game.Id, r.db)
+	if err != nil {
+		r.t.Fatalf("No board: %v", err)
+	}
+	g, err := board.getGrid()
+	if err != nil {
+		r.t.Fatalf("Bad board: %v", err)
+	}
+	return g.cells
+}
+
+// each player's move waiting for the round to be played, -1 for those who haven't moved
+func (r *roundTest) moves() []int {
+	moves := []int{}
+	for _, pid := range r.pids {
+		move, _ := r.db.SelectInt("select Move from tictactoe_turn where Game=? and Player=?", r.game.Id, pid)
+		moves = append(moves, int(move))
+	}
+	return moves
+}
+
+func (r *roundTest) rounds() int {
+	obj, _ := r.db.Get(Game{}, r.game.Id)
+	return obj.(*Game).Rounds
+}
+
+// moves for the players in order, -1 leaving a player's turn as it is, then lets the host play the round if it can
+func (r *roundTest) play(moves ...int) {
+	for i, move := range moves {
+		if move != -1 {
+			r.db.Exec("update tictactoe_turn set Move=?, Moved=? where Game=? and Player=?", move, time.Now(), r.game.Id, r.pids[i])
+		}
+	}
+	if err := hostMove(Message{"type": "move"}, r.game.Id, r.host, r.gs, r.conn, r.db, r.log); err != nil {
+		r.t.Fatalf("Couldn't play round: %v", err)
+	}
+}
+
+// a contested collision blocks its cell, and claims on it after are wasted
+func Test_ContestedCollision(t *testing.T) {
+	r, done := startRoundTest(t, Message{"collisions": ContestedCollisions}, 2)
+	defer done()
+	phones := []chan Message{}
+	for _, pid := range r.pids {
+		phones = append(phones, r.gs.PlayerJoin(r.game.Id, pid))
+	}
+
+	r.play(4, 4)
+	if c := r.cells(); c[4] != blockedCell || len(emptyCells(c)) != 8 {
+		t.Errorf("Both wanting the center should block it: %v", c)
+	}
+	// each phone sees the blocked board before being told why its move didn't land
+	for i, phone := range phones {
+		if msg := <-phone; msg["type"] != "update" {
+			t.Errorf("Phone %v should get the update first, got %#v", i, msg)
+		}
+		if msg := <-phone; msg["type"] != "collision" || msg["outcome"] != "blocked" {
+			t.Errorf("Phone %v should be told the cell is blocked after the update, got %#v", i, msg)
+		}
+	}
+	r.play(0, 4)
+	if c := r.cells(); c[0] != r.pids[0] || c[4] != blockedCell || len(emptyCells(c)) != 7 {
+		t.Errorf("The first should have the corner and the center stay blocked: %v", c)
+	}
+	if m := r.moves(); m[0] != -1 || m[1] != -1 || r.rounds() != 2 {
+		t.Errorf("After two rounds moves should be cleared, got %v and %v rounds", m, r.rounds())
+	}
+}
+
+// undoing takes rounds off the board one at a time, and everyone moves again before the round is played again
+func Test_Undo(t *testing.T) {
+	r, done := startRoundTest(t, nil, 2)
+	defer done()
+	undo := func() {
+		if err := hostUndo(Message{"type": "undo"}, r.game.Id, r.host, r.gs, r.conn, r.db, r.log); err != nil {
+			t.Fatalf("Couldn't undo: %v", err)
+		}
+	}
+
+	r.play(4, 0)
+	r.play(8, 2) // the second player meant 6
+	r.conn.msgs = nil
+	undo()
+	if c := r.cells(); c[4] != r.pids[0] || c[0] != r.pids[1] || len(emptyCells(c)) != 7 {
+		t.Errorf("Undo should leave the first round's board: %v", c)
+	}
+	if m := r.moves(); m[0] != -1 || m[1] != -1 || r.rounds() != 1 {
+		t.Errorf("Undo should leave everyone to move again, got %v and %v rounds", m, r.rounds())
+	}
+	update := r.conn.msgs[len(r.conn.msgs)-1]
+	if undone, _ := update["undone_moves"].([]roundMove); update["undone"] != 2 || len(undone) != 2 {
+		t.Errorf("The update should say which round and moves were undone: %#v", update)
+	}
+
+	// the first player, or a bot, moving straight away doesn't play the round with the undone move
+	r.play(8, -1)
+	if c := r.cells(); c[8] != 0 || r.rounds() != 1 {
+		t.Errorf("Round was played before everyone moved again: %v", c)
+	}
+	r.play(-1, 6)
+	if c := r.cells(); c[8] != r.pids[0] || c[6] != r.pids[1] || c[2] != 0 || r.rounds() != 2 {
+		t.Errorf("Round should be played with the new moves: %v", c)
+	}
+
+	undo()
+	undo()
+	if c := r.cells(); len(emptyCells(c)) != 9 || r.rounds() != 0 {
+		t.Errorf("Undoing both rounds should empty the board: %v", c)
+	}
+	r.conn.msgs = nil
+	undo()
+	if len(r.conn.msgs) != 1 || r.conn.msgs[0]["message"] != "There's no round to undo" {
+		t.Errorf("Undo with no rounds played should be refused: %v", r.conn.msgs)
+	}
+}
+
+// the host can only change a game's state to one it can get to from where it is
+func Test_HostTransitions(t *testing.T) {
+	r, done := startRoundTest(t, nil, 2)
+	defer done()
+	state := func(to string) string {
+		r.conn.msgs = nil
+		if err := hostState(Message{"type": "state", "state": to}, r.game.Id, r.host, r.gs, r.conn, r.db, r.log); err != nil {
+			t.Fatalf("Couldn't change state to %v: %v", to, err)
+		}
+		obj, _ := r.db.Get(Game{}, r.game.Id)
+		return obj.(*Game).State
+	}
+	refused := func(from, to string) {
+		if got := state(to); got != from {
+			t.Errorf("A game that's %v was changed to %v", from, got)
+		}
+		if len(r.conn.msgs) != 1 || r.conn.msgs[0]["type"] != "error" {
+			t.Errorf("Changing a game that's %v to %v should be refused: %v", from, to, r.conn.msgs)
+		}
+	}
+
+	r.play(4, 0)
+	refused("start", "start")
+	refused("start", "lobby")
+	if got := state("finished"); got != "finished" {
+		t.Fatalf("Game in play should end early, got %v", got)
+	}
+	refused("finished", "finished")
+	if got := state("start"); got != "start" || r.rounds() != 0 {
+		t.Errorf("Finished game should start again from nothing, got %v after %v rounds", got, r.rounds())
+	}
+	r.db.Exec("update games set State='paused' where Id=?", r.game.Id)
+	refused("paused", "start")
+	refused("paused", "lobby")
+	state("finished")
+	if got := state("lobby"); got != "lobby" {
+		t.Errorf("Finished game should go back to the lobby, got %v", got)
+	}
+	refused("lobby", "finished")
+}
+
+func Test_ClassicSeats(t *testing.T) {
+	seats := &TicTacToe_Seats{Queue: "[]"}
+	for pid := 1; pid <= 4; pid++ {
+		seats.sit(pid)
+	}
+	if seats.X != 1 || seats.O != 2 || seats.Turn != 1 || seats.Queue != "[3,4]" {
+		t.Fatalf("First two should sit and the rest queue: %#v", seats)
+	}
+	seats.pass()
+	if seats.Turn != 2 {
+		t.Errorf("Turn should pass to O: %#v", seats)
+	}
+
+	// X wins and stays on as O, the loser goes to the back and the next challenger moves first
+	seats.rotate(1)
+	if seats.X != 3 || seats.O != 1 || seats.Turn != 3 || seats.Queue != "[4,2]" {
+		t.Errorf("Winner should stay on: %#v", seats)
+	}
+	// a draw keeps the champion on
+	seats.rotate(0)
+	if seats.X != 4 || seats.O != 1 || seats.Queue != "[2,3]" {
+		t.Errorf("Champion should stay on after a draw: %#v", seats)
+	}
+
+	// somebody leaving their seat mid-game hands it, and the turn, to the next in line
+	seats.stand(4)
+	if seats.X != 2 || seats.Turn != 2 || seats.Queue != "[3]" {
+		t.Errorf("Next in line should take the empty seat: %#v", seats)
+	}
+	seats.stand(3)
+	seats.stand(1)
+	if seats.O != 0 || seats.Turn != 0 {
+		t.Errorf("Nobody should have the turn with an empty seat: %#v", seats)
+	}
+}
+
+func Test_SeriesOutcome(t *testing.T) {
+	for _, c := range []struct {
+		winners  []int
+		bestOf   int
+		champion int
+		over     bool
+	}{
+		{[]int{}, 3, 0, false},
+		{[]int{7}, 1, 7, true},
+		{[]int{7, 0}, 3, 0, false},
+		{[]int{7, 8, 7}, 3, 7, true},
+		{[]int{7, 7}, 5, 0, false},
+		{[]int{7, 7, 7}, 5, 7, true},
+		{[]int{7, 8, 0}, 3, 0, true},
+	} {
+		champion, over := seriesOutcome(c.winners, c.bestOf)
+		if champion != c.champion || over != c.over {
+			t.Errorf("Best of %v won by %v should be %v %v, got %v %v", c.bestOf, c.winners, c.champion, c.over, champion, over)
+		}
+	}
+}
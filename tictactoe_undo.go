@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/coopernurse/gorp"
+)
+
+// a move that went into a round, kept with the round's board
+type roundMove struct {
+	Player int       `json:"player"`
+	Move   int       `json:"move"`
+	Moved  time.Time `json:"moved"`
+}
+
+// Saves the board a round left as a new row on top of the boards before it, along with the moves that made it and
+// the seats of a classic game as they were, so the round can be undone.
+func saveRound(board *TicTacToe_Board, cells []int, round int, turns map[int]*TicTacToe_Turn, seats *TicTacToe_Seats, db *gorp.DbMap) error {
+	next := &TicTacToe_Board{Game: board.Game, Width: board.Width, Height: board.Height, Win: board.Win, Round: round}
+	err := next.setBoard(cells)
+	if err != nil {
+		return err
+	}
+	moves := []roundMove{}
+	for _, turn := range turns {
+		moves = append(moves, roundMove{Player: turn.Player, Move: turn.Move, Moved: turn.Moved})
+	}
+	b, err := json.Marshal(moves)
+	if err != nil {
+		return err
+	}
+	next.Moves = string(b)
+	if seats != nil {
+		b, err = json.Marshal(seats)
+		if err != nil {
+			return err
+		}
+		next.Seats = string(b)
+	}
+	return db.Insert(next)
+}
+
+// Undoes the last round for when somebody mis-taps. The board goes back to how it was before the round, everyone
+// moves again, and a game the round finished is back in play with its results and its place in the series taken
+// back. The moves that were undone go out with the update, for showing but not for playing, as putting them back
+// would play the mis-tap again as soon as anybody moved.
+func hostUndo(msg Message, gameId string, playerId int, gs GameService, conn Conn, db *gorp.DbMap, log *log.Logger) error {
+	game, _, err := gs.GetGame(db, gameId, playerId)
+	if err != nil {
+		log.Printf("Couldn't get game to undo: %#v", err)
+		return err
+	}
+	board, err := getBoard(gameId, db)
+	if (game.State != "start" && game.State != "finished") || err != nil || board.Round == 0 {
+		conn.Send(Message{"type": "error", "message": "There's no round to undo"})
+		return nil
+	}
+	moves := []roundMove{}
+	if err = json.Unmarshal([]byte(board.Moves), &moves); err != nil {
+		log.Printf("Can't read moves of round %v: %#v", board.Round, err)
+		return err
+	}
+	if _, err = db.Delete(board); err != nil {
+		log.Printf("Unable to delete board of round %v: %#v", board.Round, err)
+		return err
+	}
+
+	_, err = db.Exec("update tictactoe_turn set Move=-1, Moved=? where Game=?", time.Time{}, gameId)
+	if err != nil {
+		log.Printf("Couldn't clear turns: %#v", err)
+		return err
+	}
+
+	var seats *TicTacToe_Seats
+	if board.Seats != "" {
+		seats = &TicTacToe_Seats{}
+		if err = json.Unmarshal([]byte(board.Seats), seats); err != nil {
+			log.Printf("Can't read seats of round %v: %#v", board.Round, err)
+			return err
+		}
+		if err = saveSeats(seats, db); err != nil {
+			log.Printf("Unable to restore seats: %#v", err)
+			return err
+		}
+	}
+
+	game.Rounds = board.Round - 1
+	if game.State == "finished" {
+		_, err = db.Exec("delete from results where Game=? and Finished=?", gameId, game.Finished)
+		if err != nil {
+			log.Printf("Unable to take back results: %#v", err)
+			return err
+		}
+		_, err = db.Exec("delete from tictactoe_series where Id=(select max(Id) from tictactoe_series where Game=?)", gameId)
+		if err != nil {
+			log.Printf("Unable to take back series game: %#v", err)
+			return err
+		}
+		from := game.State
+		game.State = "start"
+		game.Finished = time.Time{}
+		if err = logTransition(db, gameId, playerId, from, game.State); err != nil {
+			log.Printf("Failed to record undone finish: %v", err)
+		}
+	}
+	if _, err = db.Update(game); err != nil {
+		log.Printf("Unable to save game after undo: %#v", err)
+		return err
+	}
+
+	board, err = getBoard(gameId, db)
+	if err != nil {
+		log.Printf("Couldn't get board before round %v: %#v", game.Rounds+1, err)
+		return err
+	}
+	niceBoard, err := board.getGrid()
+	if err != nil {
+		log.Printf("Error getting board: %#v", err)
+		return err
+	}
+	update := boardUpdate(game, niceBoard)
+	update["undone"] = game.Rounds + 1
+	update["undone_moves"] = moves
+	sendUpdate(gameId, playerId, gs, conn, db, update)
+	if seats != nil {
+		sendSeats(gameId, seats, gs, conn)
+	}
+	return nil
+}